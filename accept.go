@@ -0,0 +1,16 @@
+package main
+
+// SetAccept sets the Accept header of requests without one, e.g. application/json
+// for upstreams responding with html otherwise. The Accept of a connection request
+// takes precedence. Defaults to none.
+func (o *Orchestra) SetAccept(accept string) {
+	o.opts.accept = accept
+}
+
+// acceptHeader returns the Accept header of requests of c, empty for none.
+func (c *Conn) acceptHeader() string {
+	if c.accept != "" {
+		return c.accept
+	}
+	return c.opts.accept
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Aggregate functions.
+const (
+	aggregateSum = "sum"
+	aggregateAvg = "avg"
+	aggregateMin = "min"
+	aggregateMax = "max"
+)
+
+var errInvalidAggregate = errors.New("Invalid aggregate function. Must be one of sum, avg, min and max")
+
+// SetAggregate instructs the Orchestra to compute function, one of sum, avg, min and
+// max, of the number at path of the Json body of each successful response, e.g. sum
+// and $.count. path is a JSONPath of object keys and array indexes e.g.
+// $.items[0].price. The aggregate is included in the summary. Responses without a
+// number at path are not aggregated. It returns an error if function or path is
+// invalid.
+func (o *Orchestra) SetAggregate(function, path string) error {
+	a, err := parseAggregate(function, path)
+	if err != nil {
+		return err
+	}
+	o.opts.aggregate = a
+	return nil
+}
+
+// aggregateSpec is the function and path of an aggregate.
+type aggregateSpec struct {
+	function string
+	path     string
+	tokens   []interface{} // object keys and array indexes of path
+}
+
+// aggregate is the output struct of an aggregate in the summary. Value is nil if no
+// response was aggregated.
+type aggregate struct {
+	Function string   `json:"function"`
+	Path     string   `json:"path"`
+	Value    *float64 `json:"value"`
+	Count    int      `json:"count"`
+}
+
+// parseAggregate parses the aggregate of function of the numbers at path.
+func parseAggregate(function, path string) (*aggregateSpec, error) {
+	switch function {
+	case aggregateSum, aggregateAvg, aggregateMin, aggregateMax:
+	default:
+		return nil, errInvalidAggregate
+	}
+	tokens, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &aggregateSpec{function: function, path: path, tokens: tokens}, nil
+}
+
+// parseJSONPath parses path, a JSONPath of object keys and array indexes such as
+// $.items[0].price or $['a key'], into its keys and indexes.
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSONPath %q, must start with $", path)
+	}
+	var tokens []interface{}
+	for p := path[1:]; p != ""; {
+		switch {
+		case p[0] == '.':
+			end := strings.IndexAny(p[1:], ".[") + 1
+			if end == 0 {
+				end = len(p)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("invalid JSONPath %q, empty key", path)
+			}
+			tokens = append(tokens, p[1:end])
+			p = p[end:]
+		case strings.HasPrefix(p, "['"):
+			end := strings.Index(p, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q, unterminated key", path)
+			}
+			tokens = append(tokens, p[2:end])
+			p = p[end+2:]
+		case p[0] == '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q, unterminated index", path)
+			}
+			i, err := strconv.Atoi(p[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q, invalid index %q", path, p[1:end])
+			}
+			tokens = append(tokens, i)
+			p = p[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q", path)
+		}
+	}
+	return tokens, nil
+}
+
+// number returns the number at the path of a in the Json body, and false if there
+// is none.
+func (a *aggregateSpec) number(body []byte) (float64, bool) {
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return 0, false
+	}
+	for _, t := range a.tokens {
+		switch t := t.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return 0, false
+			}
+			v = m[t]
+		case int:
+			s, ok := v.([]interface{})
+			if !ok || t >= len(s) {
+				return 0, false
+			}
+			v = s[t]
+		}
+	}
+	n, ok := v.(float64)
+	return n, ok
+}
+
+// extractAggregated stores the number to aggregate in body, the Json body of r, if
+// any.
+func (r *Response) extractAggregated(body []byte) {
+	if r.opts == nil || r.opts.aggregate == nil || !r.isSuccess() {
+		return
+	}
+	if n, ok := r.opts.aggregate.number(body); ok {
+		r.aggregated = &n
+	}
+}
+
+// aggregate returns the aggregate of resps, nil if o does not aggregate. It should be
+// called after the response bodies are read.
+func (o *Orchestra) aggregate(resps []*Response) *aggregate {
+	spec := o.opts.aggregate
+	if spec == nil {
+		return nil
+	}
+	a := &aggregate{Function: spec.function, Path: spec.path}
+	var value float64
+	for _, r := range resps {
+		if r.aggregated == nil {
+			continue
+		}
+		n := *r.aggregated
+		switch {
+		case a.Count == 0:
+			value = n
+		case spec.function == aggregateSum || spec.function == aggregateAvg:
+			value += n
+		case spec.function == aggregateMin && n < value:
+			value = n
+		case spec.function == aggregateMax && n > value:
+			value = n
+		}
+		a.Count++
+	}
+	if a.Count == 0 {
+		return a
+	}
+	if spec.function == aggregateAvg {
+		value /= float64(a.Count)
+	}
+	a.Value = &value
+	return a
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the record of a request sent by an Orchestra.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name,omitempty"`
+	Id       string    `json:"id"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Status   int       `json:"status,omitempty"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	Body     string    `json:"body,omitempty"`
+}
+
+// redactedParams are substrings of query parameter names with values hidden from
+// audit records.
+var redactedParams = []string{"token", "key", "secret", "password", "signature", "auth"}
+
+// SetAudit sets the function called with the record of every request sent,
+// including retries and batch requests. It is called concurrently.
+func (o *Orchestra) SetAudit(audit func(AuditRecord)) {
+	o.opts.audit = audit
+}
+
+// SetAuditBodies instructs the Orchestra to include up to max bytes of the response
+// body in the audit records of responses that filter reports true for, e.g. failed
+// responses. Values of secret fields in Json and form encoded bodies are redacted.
+// The output is unaffected.
+func (o *Orchestra) SetAuditBodies(filter func(*Response) bool, max int) {
+	o.opts.auditBodies = filter
+	o.opts.auditBodySize = max
+}
+
+// NewAuditWriter returns an audit function for SetAudit writing each record to w
+// as a line of Json. It is safe for concurrent use.
+func NewAuditWriter(w io.Writer) func(AuditRecord) {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(r AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(r)
+	}
+}
+
+// audit records the request of r, if sent, with the audit function of c.
+func (c *Conn) audit(r *Response) {
+	if c.opts.audit == nil || r.req == nil {
+		return
+	}
+	record := newAuditRecord(r.id, r.req, r.Response, r.err, r.duration)
+	record.Name = c.opts.name
+	if c.opts.auditBodies != nil && r.Response != nil && c.opts.auditBodies(r) {
+		record.Body = redactBody(peekBody(r, c.opts.auditBodySize))
+	}
+	c.opts.audit(record)
+}
+
+// newAuditRecord creates the record of req with its response resp or error err.
+func newAuditRecord(id string, req *http.Request, resp *http.Response, err error, d time.Duration) AuditRecord {
+	record := AuditRecord{
+		Time:     time.Now().Add(-d).UTC(),
+		Id:       id,
+		Method:   req.Method,
+		URL:      redactURL(req),
+		Duration: d.String(),
+	}
+	if resp != nil {
+		record.Status = resp.StatusCode
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// redactURL returns the url of req with passwords and secret query parameters redacted.
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	values := u.Query()
+	redacted := false
+	for k := range values {
+		name := strings.ToLower(k)
+		for _, p := range redactedParams {
+			if strings.Contains(name, p) {
+				values.Set(k, "REDACTED")
+				redacted = true
+				break
+			}
+		}
+	}
+	if redacted {
+		u.RawQuery = values.Encode()
+	}
+	return u.Redacted()
+}
+
+// redactedFields matches fields with secret names and their values in Json and form
+// encoded bodies.
+var redactedFields = regexp.MustCompile(`(?i)("?[\w.-]*(?:` + strings.Join(redactedParams, "|") + `)[\w.-]*"?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^&\s,}\]]*)`)
+
+// redactBody returns body with the values of secret fields redacted.
+func redactBody(body []byte) string {
+	return redactedFields.ReplaceAllStringFunc(string(body), func(m string) string {
+		sub := redactedFields.FindStringSubmatch(m)
+		if strings.HasPrefix(sub[2], `"`) {
+			return sub[1] + `"REDACTED"`
+		}
+		return sub[1] + "REDACTED"
+	})
+}
+
+// peekBody returns up to n bytes of the body of r without consuming them.
+func peekBody(r *Response, n int) []byte {
+	if r.Body == nil || n <= 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	n, err := io.ReadFull(r.Body, b)
+	b = b[:n]
+	var rest io.Reader = r.Body
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		rest = errReader{err}
+	}
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(b), rest), r.Body}
+	return b
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
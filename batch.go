@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBatchSize = errors.New("Batcher returned the wrong number of responses.")
+
+// Batcher combines connections to an upstream with a bulk endpoint into a single
+// request and splits the bulk response into a response per connection.
+type Batcher interface {
+	// Key returns the key of the batch c belongs to, and false if c cannot be batched.
+	Key(c *Conn) (string, bool)
+	// Request creates the bulk request of conns.
+	Request(conns []*Conn) (*http.Request, error)
+	// Split splits the bulk response into the response of each of conns, in order.
+	// The bulk response body is closed after Split returns.
+	Split(resp *http.Response, conns []*Conn) ([]*http.Response, error)
+}
+
+// SetBatcher sets the Batcher used to combine connections into bulk requests.
+// Connections are only combined if there are at least two in a batch. Connections
+// with a dependency, sequential group or fallbacks are not combined, nor are any
+// if retries or a cache are set, as bulk requests are neither retried nor cached.
+// The responses of combined connections are checked, stored and sent to webhooks
+// like those of single connections.
+func (o *Orchestra) SetBatcher(b Batcher) {
+	o.batcher = b
+}
+
+// batches groups conns by the batcher of o. It returns the batches and
+// the connections not batched.
+func (o *Orchestra) batches(conns []*Conn) ([][]*Conn, []*Conn) {
+	if o.batcher == nil {
+		return nil, conns
+	}
+	var keys []string
+	var single []*Conn
+	groups := make(map[string][]*Conn)
+	for _, c := range conns {
+		key, ok := o.batcher.Key(c)
+		if !ok || c.dependsOn != "" || c.group != "" || !c.batchable() {
+			single = append(single, c)
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+	var batches [][]*Conn
+	for _, key := range keys {
+		if len(groups[key]) < 2 {
+			single = append(single, groups[key]...)
+			continue
+		}
+		batches = append(batches, groups[key])
+	}
+	return batches, single
+}
+
+// batchable reports if c can be combined into a bulk request, not needing retries,
+// fallbacks or the cache, which apply to single requests only.
+func (c *Conn) batchable() bool {
+	return len(c.fallbacks) == 0 && c.opts.retries <= 0 && (c.opts.cache == nil || c.noCache)
+}
+
+// fetchBatch sends the bulk request of conns and stores the Response of each.
+// start is the start of the orchestration the start offset of the request is
+// reported from.
+func fetchBatch(o *Orchestra, conns []*Conn, wg *sync.WaitGroup, l *limiter, start time.Time) {
+	defer wg.Done()
+	queued := l.acquire(nil)
+	var started time.Duration
+	defer func() {
+		for _, c := range conns {
+			c.Response.queued = queued
+			c.Response.started = started
+			dispatchWebhook(c)
+		}
+	}()
+	defer func() { l.release(conns[0].Response) }()
+	defer releaseFetch(acquireFetch())
+	started = time.Since(start)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic fetching batch: %v\n%s", r, debug.Stack())
+			setBatchErr(conns, nil, fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	now := time.Now()
+	req, err := o.batcher.Request(conns)
+	if err != nil {
+		log.Println(err)
+		setBatchErr(conns, nil, err)
+		return
+	}
+	if o.opts.ctx != nil {
+		req = req.WithContext(o.opts.ctx)
+	}
+	client := &http.Client{Timeout: o.timeout}
+	if o.opts.transport != nil {
+		client.Transport = o.opts.transport
+	}
+	client.Transport = wrapTransport(o.opts, client.Transport)
+	resp, err := client.Do(req)
+	if o.opts.audit != nil {
+		ids := make([]string, len(conns))
+		for i := range conns {
+			ids[i] = conns[i].id
+		}
+		record := newAuditRecord(strings.Join(ids, ","), req, resp, err, time.Since(now))
+		record.Name = o.opts.name
+		o.opts.audit(record)
+	}
+	if err != nil {
+		log.Println(err)
+		setBatchErr(conns, req, err)
+		return
+	}
+	defer resp.Body.Close()
+	resps, err := o.batcher.Split(resp, conns)
+	if err == nil && len(resps) != len(conns) {
+		err = errBatchSize
+	}
+	if err != nil {
+		log.Println(err)
+		setBatchErr(conns, req, err)
+		return
+	}
+	duration := time.Since(now)
+	for i, c := range conns {
+		c.Response = &Response{
+			Response: resps[i],
+			id:       c.id,
+			duration: duration,
+			connReq:  &c.ConnRequest,
+			req:      req,
+			opts:     c.opts,
+		}
+		c.check(c.Response)
+		c.store(c.Response)
+	}
+}
+
+// setBatchErr sets an error Response for each of conns.
+func setBatchErr(conns []*Conn, req *http.Request, err error) {
+	for _, c := range conns {
+		c.Response = &Response{id: c.id, err: err, connReq: &c.ConnRequest, req: req, opts: c.opts}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPooledBuffer is the maximum capacity of body buffers returned to the pool
+// when there is no maximum body size.
+const maxPooledBuffer = 1 << 20
+
+// maxJSONBodySize is the maximum size of bodies buffered for Json output if there
+// is no lower maximum body size. Larger bodies are reported as errors. Delimiter,
+// zip and directory output stream bodies without buffering them.
+var maxJSONBodySize int64 = 64 << 20
+
+// bufferPool pools the buffers bodies are read into for Json output.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool unless larger than the maximum body
+// size, or maxPooledBuffer if there is none.
+func putBuffer(buf *bytes.Buffer, maxBodySize int64) {
+	max := int64(maxPooledBuffer)
+	if maxBodySize > 0 {
+		max = maxBodySize
+	}
+	if int64(buf.Cap()) > max {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// errBodyTooLarge is the error reading a body larger than the maximum body size.
+type errBodyTooLarge int64
+
+func (e errBodyTooLarge) Error() string {
+	return fmt.Sprintf("response body exceeds the maximum size of %d bytes", int64(e))
+}
+
+// SetMaxBodySize sets the maximum size in bytes of response bodies in the output.
+// Larger bodies are reported as errors. 0 means no limit. Defaults to 0.
+func (o *Orchestra) SetMaxBodySize(n int64) {
+	o.opts.maxBodySize = n
+}
+
+// maxBodySize returns the maximum body size of r, 0 if there is none. The
+// maximum of the connection takes precedence over that of the Orchestra.
+func (r *Response) maxBodySize() int64 {
+	if r.connReq != nil && r.connReq.maxBodySize > 0 {
+		return r.connReq.maxBodySize
+	}
+	if r.opts == nil {
+		return 0
+	}
+	return r.opts.maxBodySize
+}
+
+// bodyReader returns the body of r limited to its maximum body size.
+func (r *Response) bodyReader() io.Reader {
+	return r.limitBody(r.maxBodySize())
+}
+
+// jsonBodyReader returns the body of r limited to its maximum body size, or
+// maxJSONBodySize if lower, for buffering in Json output.
+func (r *Response) jsonBodyReader() io.Reader {
+	n := r.maxBodySize()
+	if n <= 0 || n > maxJSONBodySize {
+		n = maxJSONBodySize
+	}
+	return r.limitBody(n)
+}
+
+// limitBody returns the body of r limited to n bytes, unlimited if n is 0, and
+// to the body timeout of its connection, if any.
+func (r *Response) limitBody(n int64) io.Reader {
+	var body io.Reader = r.Body
+	if r.connReq != nil && r.connReq.bodyTimeout > 0 {
+		body = &timedBody{rc: r.Body, d: r.connReq.bodyTimeout}
+	}
+	if n <= 0 {
+		return body
+	}
+	return &limitedBody{r: body, n: n, max: n}
+}
+
+// limitedBody reads from r until n bytes and returns errBodyTooLarge if there
+// are more.
+type limitedBody struct {
+	r   io.Reader
+	n   int64 // bytes remaining
+	max int64 // reported maximum
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	// read one byte past the limit to detect larger bodies.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, errBodyTooLarge(l.max)
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// errBodyTimeout is the error reading a body for longer than the body timeout of
+// its connection.
+type errBodyTimeout time.Duration
+
+func (e errBodyTimeout) Error() string {
+	return fmt.Sprintf("body read timeout after %v", time.Duration(e))
+}
+
+// timedBody reads from rc until d elapsed since the first read, after which rc is
+// closed and errBodyTimeout returned. This catches bodies dribbled slowly after the
+// headers arrived fast.
+type timedBody struct {
+	rc      io.ReadCloser
+	d       time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func (t *timedBody) Read(p []byte) (int, error) {
+	if t.timer == nil {
+		t.timer = time.AfterFunc(t.d, func() {
+			atomic.StoreInt32(&t.expired, 1)
+			t.rc.Close()
+		})
+	}
+	if atomic.LoadInt32(&t.expired) == 1 {
+		return 0, errBodyTimeout(t.d)
+	}
+	n, err := t.rc.Read(p)
+	if err != nil {
+		if atomic.LoadInt32(&t.expired) == 1 {
+			return n, errBodyTimeout(t.d)
+		}
+		t.timer.Stop()
+	}
+	return n, err
+}
+
+// isBodyReadErr reports if err is errBodyTooLarge, errBodyTimeout or errDeadline,
+// errors of a single body reported in place.
+func isBodyReadErr(err error) bool {
+	switch err.(type) {
+	case errBodyTooLarge, errBodyTimeout, errDeadline:
+		return true
+	}
+	return false
+}
+
+// truncatedMarker marks the end of truncated error bodies.
+const truncatedMarker = "..."
+
+// SetErrorBodySize sets the maximum size in bytes of the bodies of responses with
+// 4xx and 5xx status codes in Json output, e.g. to keep large error pages from
+// cluttering the output. Longer bodies are truncated and end with "...". 0 means
+// no limit. Defaults to 4096.
+func (o *Orchestra) SetErrorBodySize(n int) {
+	o.opts.errorBodySize = n
+}
+
+// truncateError returns body, the body of r, truncated to the maximum error body
+// size if r has an error status code.
+func (r *Response) truncateError(body []byte) []byte {
+	if r.opts == nil || r.opts.errorBodySize <= 0 || r.StatusCode < 400 || len(body) <= r.opts.errorBodySize {
+		return body
+	}
+	n := r.opts.errorBodySize
+	// keep whole UTF-8 characters.
+	for n > 0 && !utf8.RuneStart(body[n]) {
+		n--
+	}
+	truncated := make([]byte, n, n+len(truncatedMarker))
+	copy(truncated, body)
+	return append(truncated, truncatedMarker...)
+}
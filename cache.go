@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cache defaults.
+const (
+	defaultCacheTTL      = 10 * time.Minute
+	defaultCacheBodySize = 1 << 20
+)
+
+// Cache stores the last successful response of each url and request headers. It is safe for concurrent
+// use and can be shared across Orchestras.
+type Cache struct {
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	maxEntries  int
+	ttl         time.Duration // duration entries are served for
+	maxBodySize int64         // maximum size of cached bodies
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	statusCode int
+	status     string
+	header     http.Header
+	body       []byte
+	time       time.Time
+}
+
+// NewCache creates a new Cache holding at most maxEntries responses with bodies of at
+// most 1MB for 10 minutes. An arbitrary entry is evicted when full.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		entries:     make(map[string]cacheEntry),
+		maxEntries:  maxEntries,
+		ttl:         defaultCacheTTL,
+		maxBodySize: defaultCacheBodySize,
+	}
+}
+
+// SetTTL sets the duration responses are served from c for after they are cached.
+// Expired responses are neither served stale nor as unchanged. Defaults to 10 minutes.
+func (c *Cache) SetTTL(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = d
+}
+
+// SetMaxBodySize sets the maximum size in bytes of the bodies of responses cached in
+// c. Responses with larger bodies are not cached, and bodies are never read beyond the
+// maximum body size of their connection. Defaults to 1MB.
+func (c *Cache) SetMaxBodySize(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBodySize = n
+}
+
+// bodyLimit returns the maximum size of the cached body of r.
+func (c *Cache) bodyLimit(r *Response) int64 {
+	c.mu.Lock()
+	n := c.maxBodySize
+	c.mu.Unlock()
+	if max := r.maxBodySize(); max > 0 && max < n {
+		return max
+	}
+	return n
+}
+
+// get returns the unexpired entry of url. Its header is a copy, safe to modify.
+func (c *Cache) get(url string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Since(e.time) >= c.ttl {
+		delete(c.entries, url)
+		return cacheEntry{}, false
+	}
+	e.header = e.header.Clone()
+	return e, true
+}
+
+func (c *Cache) set(url string, e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[url]; !ok && len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[url] = e
+}
+
+// SetCache sets the cache successful responses are stored in.
+func (o *Orchestra) SetCache(c *Cache) {
+	o.opts.cache = c
+}
+
+// SetStaleIfError instructs the Orchestra to serve the cached response of a failed
+// request, marked as stale. Requires a cache to be set.
+func (o *Orchestra) SetStaleIfError(b bool) {
+	o.opts.staleIfError = b
+}
+
+// cache stores r in the cache if successful. If r failed and stale if error is
+// enabled, the cached response is returned instead if any.
+func (c *Conn) cache(r *Response) *Response {
+	if c.opts.cache == nil || c.noCache || r.req == nil || r.req.Method != http.MethodGet {
+		return r
+	}
+	url := cacheKey(r.req)
+	if !r.failed() {
+		if r.isSuccess() {
+			if body, ok := readCacheable(r, c.opts.cache.bodyLimit(r)); ok {
+				c.opts.cache.set(url, cacheEntry{r.StatusCode, r.Status, r.Header.Clone(), body, time.Now()})
+			}
+		}
+		return r
+	}
+	if !c.opts.staleIfError {
+		return r
+	}
+	e, ok := c.opts.cache.get(url)
+	if !ok {
+		return r
+	}
+	r.discard()
+	return &Response{
+		Response: &http.Response{
+			StatusCode: e.statusCode,
+			Status:     e.status,
+			Header:     e.header,
+			Body:       ioutil.NopCloser(bytes.NewReader(e.body)),
+		},
+		id:       r.id,
+		duration: r.duration,
+		stale:    true,
+		connReq:  r.connReq,
+		req:      r.req,
+		opts:     r.opts,
+	}
+}
+
+// cacheKey returns the key of the cached response of req, its url and a digest of its
+// host and headers. Responses are only served to requests sent with the same
+// credentials, cookies and other headers.
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, req.Host+"\n")
+	req.Header.Write(h)
+	return req.URL.String() + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// readCacheable reads the body of r if it is at most n bytes and returns it, and false
+// if it is larger or fails to read. The body of r is left to be read in full by the
+// output either way, and read errors are left for the output to report.
+func readCacheable(r *Response, n int64) ([]byte, bool) {
+	if r.ContentLength > n {
+		return nil, false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, n+1))
+	if err != nil || int64(len(b)) > n {
+		rest := r.Body
+		if err != nil {
+			rest = ioutil.NopCloser(errReader{err})
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), rest), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	// a stored body is removed when closed.
+	r.stored = nil
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Synthetic failures injected by chaos testing.
+const (
+	chaosDelay    = "delay"
+	chaosError    = "error"
+	chaosTruncate = "truncate"
+)
+
+// defaultChaosDelay is the delay of delayed requests if none is set.
+const defaultChaosDelay = time.Second
+
+// chaosFaults are the synthetic failures connections are chosen a fault from.
+var chaosFaults = []string{chaosDelay, chaosError, chaosTruncate}
+
+// chaosIntn returns a random number in [0,n) for choosing connections to fail.
+var chaosIntn = rand.Intn
+
+// errChaos is the error of requests failed by chaos testing.
+var errChaos = errors.New("chaos: injected failure")
+
+// SetChaos instructs the Orchestra to inject synthetic failures into percent, from 0
+// to 100, of its connections for resilience testing, without failing the upstreams.
+// Each connection chosen is failed, including its retries, with one of a delay of d
+// before sending the request, an error instead of sending it, or a body cut off at
+// half its length, at the start if unknown. Batched connections are not failed. The
+// failure of each connection is included in the output as chaos. d of 0 is one
+// second. It returns an error if percent is out of range. Never enable this in
+// production. Defaults to 0.
+func (o *Orchestra) SetChaos(percent int, d time.Duration) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid chaos percentage %d, must be from 0 to 100", percent)
+	}
+	if d <= 0 {
+		d = defaultChaosDelay
+	}
+	o.opts.chaos = percent
+	o.opts.chaosDelay = d
+	return nil
+}
+
+// chaosFault chooses the synthetic failure of c, empty if it is not failed.
+func (c *Conn) chaosFault() string {
+	if c.opts.chaos <= 0 || chaosIntn(100) >= c.opts.chaos {
+		return ""
+	}
+	return chaosFaults[chaosIntn(len(chaosFaults))]
+}
+
+// chaosKey is the context key of the synthetic failure of a request.
+type chaosKey struct{}
+
+// withChaos returns req with the synthetic failure of c, if any, for chaosTransport.
+func (c *Conn) withChaos(req *http.Request) *http.Request {
+	if c.chaos == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), chaosKey{}, c.chaos))
+}
+
+// chaosTransport is a RoundTripper injecting the synthetic failure of each request,
+// if any, into the round trip of rt.
+type chaosTransport struct {
+	rt    http.RoundTripper
+	delay time.Duration
+}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	fault, _ := req.Context().Value(chaosKey{}).(string)
+	switch fault {
+	case chaosDelay:
+		timer := time.NewTimer(t.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	case chaosError:
+		return nil, errChaos
+	case chaosTruncate:
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &truncatedBody{rc: resp.Body, n: resp.ContentLength / 2}
+		return resp, nil
+	}
+	return rt.RoundTrip(req)
+}
+
+// truncatedBody is a body cut off after n bytes, after which reads fail with
+// io.ErrUnexpectedEOF.
+type truncatedBody struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.rc.Read(p)
+	b.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.rc.Close()
+}
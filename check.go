@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// check asserts the expectations of c against r. Responses not meeting
+// them are marked as not ok with the reason.
+func (c *Conn) check(r *Response) {
+	if r.err != nil || r.Response == nil {
+		return
+	}
+	if c.contentType != "" {
+		r.checked = true
+		if !matchContentType(r.Header.Get("Content-Type"), c.contentType) {
+			r.reason = "expected content type " + c.contentType + " found " + r.Header.Get("Content-Type")
+		}
+	}
+	// the body is read once, as it is spooled, for the assertions on it.
+	var sinks []io.Writer
+	contains := c.criteria.bodyMatcher()
+	if contains != nil {
+		sinks = append(sinks, contains)
+	}
+	h := c.checksumHash()
+	if h != nil {
+		sinks = append(sinks, h)
+	}
+	if len(sinks) > 0 {
+		if err := c.spool(r, io.MultiWriter(sinks...)); err != nil {
+			if _, ok := err.(errBodyTooLarge); ok && r.reason == "" {
+				r.checked = true
+				r.reason = err.Error()
+			}
+			// other errors are reported when the body is output.
+			return
+		}
+	}
+	c.checkCriteria(r, contains)
+	c.checkChecksum(r, h)
+}
+
+// matchContentType reports if the media type of contentType is expected.
+// Parameters such as charset are ignored.
+func matchContentType(contentType, expected string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	e, _, err := mime.ParseMediaType(expected)
+	if err != nil {
+		e = expected
+	}
+	return strings.EqualFold(t, e)
+}
+
+// ok returns if r met the expectations of its connection, nil if there were none.
+func (r *Response) ok() *bool {
+	if !r.checked {
+		return nil
+	}
+	ok := r.reason == ""
+	return &ok
+}
+
+// Criteria is a composable success criteria of a connection. A response meets it
+// if it meets each assertion set, all of All and at least one of Any. Assertions
+// not set always pass.
+type Criteria struct {
+	Status       []int         // status code is one of
+	BodyContains string        // body contains the string
+	MaxLatency   time.Duration // duration is at most
+	ContentType  string        // media type of the body, parameters are ignored
+	All          []Criteria
+	Any          []Criteria
+}
+
+// failures returns the descriptions of the assertions of c that r fails, none if
+// r meets c. contains holds the strings of c found in the body of r.
+func (c *Criteria) failures(r *Response, contains *containsWriter) []string {
+	var failed []string
+	if len(c.Status) > 0 && !containsInt(c.Status, r.StatusCode) {
+		failed = append(failed, fmt.Sprintf("expected status %s found %d", joinInts(c.Status, " or "), r.StatusCode))
+	}
+	if c.BodyContains != "" && !contains.found[c.BodyContains] {
+		failed = append(failed, fmt.Sprintf("expected body containing %q", c.BodyContains))
+	}
+	if c.MaxLatency > 0 && r.duration > c.MaxLatency {
+		failed = append(failed, fmt.Sprintf("expected latency at most %v found %v", c.MaxLatency, r.duration.Round(time.Millisecond)))
+	}
+	if c.ContentType != "" && !matchContentType(r.Header.Get("Content-Type"), c.ContentType) {
+		failed = append(failed, "expected content type "+c.ContentType+" found "+r.Header.Get("Content-Type"))
+	}
+	for i := range c.All {
+		failed = append(failed, c.All[i].failures(r, contains)...)
+	}
+	if len(c.Any) > 0 {
+		var alts []string
+		for i := range c.Any {
+			f := c.Any[i].failures(r, contains)
+			if len(f) == 0 {
+				alts = nil
+				break
+			}
+			alts = append(alts, strings.Join(f, " and "))
+		}
+		if alts != nil {
+			failed = append(failed, "any of: "+strings.Join(alts, "; "))
+		}
+	}
+	return failed
+}
+
+// checkCriteria evaluates the criteria of c against r, if any. contains holds the
+// strings of the criteria found in the body, nil if there are none. The failed
+// assertions are kept with r and r is marked as not ok.
+func (c *Conn) checkCriteria(r *Response, contains *containsWriter) {
+	if c.criteria == nil {
+		return
+	}
+	r.checked = true
+	r.failures = c.criteria.failures(r, contains)
+	if len(r.failures) > 0 && r.reason == "" {
+		r.reason = "criteria not met"
+	}
+}
+
+// bodyMatcher returns a writer finding the body strings of c, nil if c has none.
+func (c *Criteria) bodyMatcher() *containsWriter {
+	if c == nil {
+		return nil
+	}
+	w := &containsWriter{found: make(map[string]bool)}
+	c.addBodyStrings(w)
+	if len(w.found) == 0 {
+		return nil
+	}
+	return w
+}
+
+// addBodyStrings adds the body strings of c and its nested criteria to w.
+func (c *Criteria) addBodyStrings(w *containsWriter) {
+	if s := c.BodyContains; s != "" {
+		w.found[s] = false
+		if len(s) > w.max {
+			w.max = len(s)
+		}
+	}
+	for i := range c.All {
+		c.All[i].addBodyStrings(w)
+	}
+	for i := range c.Any {
+		c.Any[i].addBodyStrings(w)
+	}
+}
+
+// containsWriter finds strings in the bytes written to it, keeping only the end of
+// the bytes written, shorter than the longest string, to match across writes.
+type containsWriter struct {
+	found map[string]bool // strings and whether they are found
+	max   int             // length of the longest string
+	tail  []byte
+}
+
+func (w *containsWriter) Write(p []byte) (int, error) {
+	b := append(w.tail, p...)
+	for s, found := range w.found {
+		if !found && bytes.Contains(b, []byte(s)) {
+			w.found[s] = true
+		}
+	}
+	if n := w.max - 1; len(b) > n {
+		b = b[len(b)-n:]
+	}
+	w.tail = append([]byte(nil), b...)
+	return len(p), nil
+}
+
+// containsInt reports if ints contains n.
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+// joinInts joins ints with sep.
+func joinInts(ints []int, sep string) string {
+	s := make([]string, len(ints))
+	for i, n := range ints {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, sep)
+}
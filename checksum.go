@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// checksumHashes are the hash functions of checksums by algorithm.
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseChecksum parses an expected checksum of a response body, a hex encoded digest
+// prefixed by its algorithm e.g. sha256:9f86d0..., or sha256 if unprefixed. It returns
+// the checksum as algorithm:digest in lower case.
+func parseChecksum(s string) (string, error) {
+	algorithm, digest := "sha256", strings.ToLower(strings.TrimSpace(s))
+	if i := strings.IndexByte(digest, ':'); i >= 0 {
+		algorithm, digest = digest[:i], digest[i+1:]
+	}
+	newHash, ok := checksumHashes[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm %q, must be one of md5, sha1, sha256 and sha512", algorithm)
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != newHash().Size() {
+		return "", fmt.Errorf("invalid %s checksum %q", algorithm, digest)
+	}
+	return algorithm + ":" + digest, nil
+}
+
+// checksumHash returns the hash of the expected checksum of c, nil if there is none.
+func (c *Conn) checksumHash() hash.Hash {
+	if c.checksum == "" {
+		return nil
+	}
+	return checksumHashes[c.checksum[:strings.IndexByte(c.checksum, ':')]]()
+}
+
+// checkChecksum compares h, the hash of the body of r, with the expected checksum of
+// c, if any. r is marked as not ok on mismatch.
+func (c *Conn) checkChecksum(r *Response, h hash.Hash) {
+	if h == nil {
+		return
+	}
+	r.checked = true
+	i := strings.IndexByte(c.checksum, ':')
+	algorithm, expected := c.checksum[:i], c.checksum[i+1:]
+	if found := hex.EncodeToString(h.Sum(nil)); found != expected && r.reason == "" {
+		r.reason = "expected " + algorithm + " checksum " + expected + " found " + found
+	}
+}
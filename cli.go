@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UseDir instructs the Orchestra to write each response body to a file in dir named
+// by the connection id, as in zip output, and output the responses in the Json format
+// without the bodies, including the file of each. dir is created if it does not exist.
+func (o *Orchestra) UseDir(dir string) {
+	o.responseType = typeDir
+	o.dir = dir
+}
+
+// outputDir writes the body of each of resps to a file in the output directory of o
+// and the responses without the bodies to w.
+func outputDir(o *Orchestra, resps []*Response, w io.Writer) error {
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	manifest := make([]respOutput, len(resps))
+	names := newFilenames()
+	for i, resp := range resps {
+		manifest[i] = resp.output()
+		if manifest[i].Error != "" {
+			continue
+		}
+		manifest[i].File = names.name(resp.id)
+		n, err := writeFile(filepath.Join(o.dir, manifest[i].File), resp.bodyReader())
+		resp.responseBytes += n
+		resp.accountBytes(&manifest[i])
+		if err != nil {
+			resp.discard()
+			manifest[i] = respOutput{Id: resp.id, Meta: resp.meta(), Error: err.Error()}
+		}
+	}
+	return json.NewEncoder(w).Encode(manifest)
+}
+
+// writeFile writes r to the file name.
+func writeFile(name string, r io.Reader) (int64, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// runCLI runs the connection requests read from in, one or more comma separated
+// 'id:url' entries per line, and writes the output to out. Response bodies are
+// written to files in dir instead if not empty.
+func runCLI(in io.Reader, out io.Writer, dir string) error {
+	var lines []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	conns, err := parseRequests(strings.Join(lines, ","))
+	if err != nil {
+		return err
+	}
+	if errs := resolveConns(conns); errs != nil {
+		return errs
+	}
+	orchestra := NewOrchestra(conns...)
+	orchestra.SetMaxURLLength(*maxURLLength)
+	orchestra.SetMaxHeaders(*maxHeaders, *maxHeaderSize)
+	orchestra.SetMaxBodySize(*maxBodySize)
+	if *spillSize > 0 {
+		orchestra.SetBodyStore(TempFileStore{Dir: *spillDir}, *spillSize)
+	}
+	if serverTokenProvider != nil {
+		orchestra.SetTokenProvider(serverTokenProvider)
+	}
+	if serverClientCert != nil {
+		orchestra.SetClientCertificate(*serverClientCert)
+	}
+	if serverDNSCache != nil {
+		orchestra.SetDNSCache(serverDNSCache)
+	}
+	if serverAudit != nil {
+		orchestra.SetAudit(serverAudit)
+		if *auditBodies != "" {
+			orchestra.SetAuditBodies(auditBodyFilter(*auditBodies), *auditBodySize)
+		}
+	}
+	if dir != "" {
+		orchestra.UseDir(dir)
+	}
+	orchestra.Process(&cliWriter{Writer: out, header: make(http.Header)})
+	return nil
+}
+
+// cliWriter is an http.ResponseWriter writing the output of the CLI.
+type cliWriter struct {
+	io.Writer
+	header http.Header
+}
+
+func (c *cliWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *cliWriter) WriteHeader(int) {}
@@ -0,0 +1,63 @@
+package main
+
+import "net/url"
+
+// SetCollapseErrors instructs the Orchestra to output connections failing with the
+// same error as a single entry of the error and the ids of the connections, at the
+// position of the first, instead of one entry per connection. Errors are compared
+// without the method and url of the request, so connections to a host that is down
+// are collapsed. Errors of a single connection and responses with a status code are
+// output as is. It applies to Json output. Defaults to false.
+func (o *Orchestra) SetCollapseErrors(b bool) {
+	o.opts.collapseErrors = b
+}
+
+// errorGroup is the output struct of the connections failing with the same error.
+type errorGroup struct {
+	Ids     []string `json:"ids"`
+	Timeout string   `json:"timeout,omitempty"`
+	Error   string   `json:"error"`
+
+	first *Response // response the group is output in place of
+}
+
+// errorGroups returns the group of each of resps failing with the same error as
+// another, nil if o does not collapse errors.
+func (o *Orchestra) errorGroups(resps []*Response) map[*Response]*errorGroup {
+	if !o.opts.collapseErrors {
+		return nil
+	}
+	type key struct{ timeout, err string }
+	byErr := make(map[key]*errorGroup)
+	for _, r := range resps {
+		if r.err == nil {
+			continue
+		}
+		k := key{r.timeout, collapsedError(r.err)}
+		g, ok := byErr[k]
+		if !ok {
+			g = &errorGroup{Timeout: k.timeout, Error: k.err, first: r}
+			byErr[k] = g
+		}
+		g.Ids = append(g.Ids, r.id)
+	}
+	groups := make(map[*Response]*errorGroup)
+	for _, r := range resps {
+		if r.err == nil {
+			continue
+		}
+		if g := byErr[key{r.timeout, collapsedError(r.err)}]; len(g.Ids) > 1 {
+			groups[r] = g
+		}
+	}
+	return groups
+}
+
+// collapsedError returns the message of err without the method and url of the
+// request, if any.
+func collapsedError(err error) string {
+	if e, ok := err.(*url.Error); ok {
+		return e.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetCompare instructs the Orchestra to output a comparison of the responses of the
+// connections with ids a and b, e.g. a primary and a replica, instead of the
+// responses. The comparison reports if the status codes match and the differences
+// of the Json bodies, or if the bodies are equal when either is not Json.
+func (o *Orchestra) SetCompare(a, b string) {
+	o.opts.compare = []string{a, b}
+}
+
+// comparison is the output struct of the comparison of two responses.
+type comparison struct {
+	IDs         []string     `json:"ids"`
+	StatusCodes []int        `json:"status_codes,omitempty"`
+	StatusMatch bool         `json:"status_match"`
+	Equal       bool         `json:"equal"`
+	Diff        []difference `json:"diff,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// difference is a difference between the Json bodies of two responses at Path, a
+// Json pointer. Change is added, removed or changed going from A to B.
+type difference struct {
+	Path   string      `json:"path"`
+	Change string      `json:"change"`
+	A      interface{} `json:"a,omitempty"`
+	B      interface{} `json:"b,omitempty"`
+}
+
+// outputComparison writes the comparison of the responses of the compared
+// connections of o to w.
+func (o *Orchestra) outputComparison(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(o.compareResponses(o.opts.compare[0], o.opts.compare[1]))
+}
+
+// compareResponses compares the responses of the connections with ids a and b.
+func (o *Orchestra) compareResponses(a, b string) comparison {
+	c := comparison{IDs: []string{a, b}}
+	var bodies [2][]byte
+	for i, id := range c.IDs {
+		r := o.response(id)
+		if r == nil {
+			c.Error = fmt.Sprintf("no response for '%s'", id)
+			return c
+		}
+		if r.err != nil {
+			c.Error = fmt.Sprintf("%s: %v", id, r.err)
+			return c
+		}
+		var buf bytes.Buffer
+		_, err := buf.ReadFrom(r.jsonBodyReader())
+		r.discard()
+		if err != nil {
+			c.Error = fmt.Sprintf("%s: %v", id, err)
+			return c
+		}
+		bodies[i] = buf.Bytes()
+		c.StatusCodes = append(c.StatusCodes, r.StatusCode)
+	}
+	c.StatusMatch = c.StatusCodes[0] == c.StatusCodes[1]
+
+	var va, vb interface{}
+	if json.Unmarshal(bodies[0], &va) != nil || json.Unmarshal(bodies[1], &vb) != nil {
+		c.Equal = bytes.Equal(bodies[0], bodies[1])
+		return c
+	}
+	c.Diff = diffJSON("", va, vb, nil)
+	c.Equal = len(c.Diff) == 0
+	return c
+}
+
+// response returns the response of the connection of o with id, nil if there is
+// none.
+func (o *Orchestra) response(id string) *Response {
+	for _, c := range o.conns {
+		if c.id == id {
+			return c.Response
+		}
+	}
+	return nil
+}
+
+// diffJSON appends the differences between the decoded Json values a and b at path
+// to diffs. Objects are compared by key and arrays by index.
+func diffJSON(path string, a, b interface{}, diffs []difference) []difference {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			ea, inA := va[k]
+			eb, inB := vb[k]
+			switch {
+			case !inA:
+				diffs = append(diffs, difference{Path: p, Change: "added", B: eb})
+			case !inB:
+				diffs = append(diffs, difference{Path: p, Change: "removed", A: ea})
+			default:
+				diffs = diffJSON(p, ea, eb, diffs)
+			}
+		}
+		return diffs
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(va) || i < len(vb); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(va):
+				diffs = append(diffs, difference{Path: p, Change: "added", B: vb[i]})
+			case i >= len(vb):
+				diffs = append(diffs, difference{Path: p, Change: "removed", A: va[i]})
+			default:
+				diffs = diffJSON(p, va[i], vb[i], diffs)
+			}
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(a, b) {
+		diffs = append(diffs, difference{Path: path, Change: "changed", A: a, B: b})
+	}
+	return diffs
+}
+
+// escapePointer escapes the Json pointer reference token s.
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
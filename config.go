@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// serverTypes are the built-in response types served, the first being the default.
+// Output formats registered with RegisterOutputFormat are served too.
+var serverTypes = []string{"json", "delimiter", "zip", "stream", "split", "health"}
+
+// serverConfig is the effective configuration and limits of the server. It
+// excludes secrets such as token credentials and key files.
+type serverConfig struct {
+	Types             []string `json:"types"`
+	DefaultTimeout    int64    `json:"default_timeout_ms"`
+	HandlerTimeout    int64    `json:"handler_timeout_ms"`
+	BodyDeadline      int64    `json:"body_deadline_ms"`
+	MaxURLLength      int      `json:"max_url_length"`
+	MaxHeaders        int      `json:"max_headers"`
+	MaxHeaderSize     int      `json:"max_header_size"`
+	MaxBodySize       int64    `json:"max_body_size"`
+	MaxConfigSize     int      `json:"max_config_size"`
+	SpillSize         int64    `json:"spill_size"`
+	MaxFetches        int      `json:"max_fetches"`
+	MaxOrchestrations int      `json:"max_orchestrations"`
+	AllowPrivate      bool     `json:"allow_private"`
+	Chaos             bool     `json:"chaos"`
+	Token             bool     `json:"token"`
+	ClientCertificate bool     `json:"client_certificate"`
+	AuditLog          bool     `json:"audit_log"`
+}
+
+// currentConfig returns the effective configuration of the server.
+func currentConfig() serverConfig {
+	return serverConfig{
+		Types:             responseTypes(),
+		DefaultTimeout:    int64(defaultTimeout / time.Millisecond),
+		HandlerTimeout:    int64(*handlerTimeout / time.Millisecond),
+		BodyDeadline:      int64(*bodyDeadline / time.Millisecond),
+		MaxURLLength:      *maxURLLength,
+		MaxHeaders:        *maxHeaders,
+		MaxHeaderSize:     *maxHeaderSize,
+		MaxBodySize:       *maxBodySize,
+		MaxConfigSize:     maxConfigSize,
+		SpillSize:         *spillSize,
+		MaxFetches:        *maxFetches,
+		MaxOrchestrations: *maxOrchestrations,
+		AllowPrivate:      *allowPrivate,
+		Chaos:             *chaosEnabled,
+		Token:             serverTokenProvider != nil,
+		ClientCertificate: serverClientCert != nil,
+		AuditLog:          serverAudit != nil,
+	}
+}
+
+// configHandler responds with the effective configuration and limits of the server
+// so clients can adapt their requests.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(currentConfig())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetTotalTimeout sets a hard wall-clock limit on Process, independent of the
+// timeouts of connections. Requests in flight are cancelled when it elapses. Stream
+// output ends with the responses completed so far, other output types respond with
+// 504 Gateway Timeout. 0 means no limit. Defaults to 0.
+func (o *Orchestra) SetTotalTimeout(d time.Duration) {
+	o.opts.totalTimeout = d
+}
+
+// withTotalTimeout sets the context of the requests of o to one cancelled after the
+// total timeout, if any. It returns the function releasing the context.
+func (o *Orchestra) withTotalTimeout() context.CancelFunc {
+	if o.opts.totalTimeout <= 0 {
+		o.opts.ctx = nil
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.opts.totalTimeout)
+	o.opts.ctx = ctx
+	return cancel
+}
+
+// expired returns a channel closed when the total timeout of o elapsed, nil if
+// there is none.
+func (o *Orchestra) expired() <-chan struct{} {
+	if o.opts.ctx == nil {
+		return nil
+	}
+	return o.opts.ctx.Done()
+}
+
+// untilExpired returns a channel closed when done is closed or the total timeout
+// of o elapsed, whichever is first.
+func (o *Orchestra) untilExpired(done <-chan struct{}) <-chan struct{} {
+	if o.opts.ctx == nil {
+		return done
+	}
+	c := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-o.opts.ctx.Done():
+		}
+		close(c)
+	}()
+	return c
+}
+
+// writeTotalTimeout responds with 504 Gateway Timeout as the total timeout of o
+// elapsed before all connections were fetched.
+func (o *Orchestra) writeTotalTimeout(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("orchestration exceeded the total timeout of %v", o.opts.totalTimeout), http.StatusGatewayTimeout)
+}
+
+// SetDeadline sets the absolute time by which each request, including its body, must
+// complete, replacing the timeout for connections without a deadline of their own.
+// The time budget of each request, and of retries, is from when it is sent until t.
+// The zero time means no deadline. Defaults to none.
+func (o *Orchestra) SetDeadline(t time.Time) {
+	o.opts.deadline = t
+}
+
+// connDeadline returns the deadline of c, its own or that of the Orchestra, and false
+// if there is none.
+func (c *Conn) connDeadline() (time.Time, bool) {
+	if !c.deadline.IsZero() {
+		return c.deadline, true
+	}
+	return c.opts.deadline, !c.opts.deadline.IsZero()
+}
+
+// errDeadline is the error reading a body after the deadline of its connection.
+type errDeadline time.Time
+
+func (e errDeadline) Error() string {
+	return fmt.Sprintf("deadline %s exceeded", time.Time(e).Format(time.RFC3339Nano))
+}
+
+// deadlineExceeded reports if err is due to the deadline of c.
+func (c *Conn) deadlineExceeded(err error) bool {
+	t, ok := c.connDeadline()
+	return ok && errors.Is(err, context.DeadlineExceeded) && !time.Now().Before(t)
+}
+
+// parseDeadline parses an absolute deadline in RFC 3339 format.
+func parseDeadline(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %q, must be in RFC 3339 format e.g. 2006-01-02T15:04:05Z", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// definitionsTimeout is the timeout of requests_url requests.
+	definitionsTimeout = 10 * time.Second
+	// definitionsTTL is how long fetched connection definitions are cached.
+	definitionsTTL = 30 * time.Second
+)
+
+var (
+	errInvalidRequestsURL = errors.New("Invalid requests_url. Must be an absolute http or https url")
+	errPrivateAddress     = errors.New("address is not public")
+)
+
+// definitionsClient is the http.Client used for requests_url requests. It refuses to
+// connect to non public addresses unless allowed by the -allow-private flag. The check
+// is done when dialing, after name resolution, so redirects and dns are covered too.
+// Requests are never proxied, as the check would apply to the address of the proxy
+// instead of that of the requested host.
+var definitionsClient = &http.Client{
+	Timeout: definitionsTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: defaultDialTimeout,
+			Control: publicAddressControl,
+		}).DialContext,
+	},
+}
+
+// publicAddressControl rejects connections to loopback, private, link local and
+// unspecified addresses.
+func publicAddressControl(network, address string, _ syscall.RawConn) error {
+	if *allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// definitions caches connection definitions fetched from requests_url.
+var definitions = struct {
+	sync.Mutex
+	entries map[string]definitionsEntry
+}{entries: make(map[string]definitionsEntry)}
+
+type definitionsEntry struct {
+	conns   []ConnRequest
+	expires time.Time
+}
+
+// fetchConnConfigs fetches and parses the Json connection definitions at rawurl.
+// Definitions are cached for definitionsTTL.
+func fetchConnConfigs(rawurl string) ([]ConnRequest, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("Bad Request: " + errInvalidRequestsURL.Error())
+	}
+
+	definitions.Lock()
+	for k, e := range definitions.entries {
+		if time.Now().After(e.expires) {
+			delete(definitions.entries, k)
+		}
+	}
+	e, ok := definitions.entries[rawurl]
+	definitions.Unlock()
+	if ok {
+		return copyConns(e.conns), nil
+	}
+
+	resp, err := definitionsClient.Get(rawurl)
+	if err != nil {
+		return nil, errors.New("Bad Request: requests_url: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad Request: requests_url: %s", resp.Status)
+	}
+	conns, err := parseConnConfigs(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return nil, err
+	}
+
+	definitions.Lock()
+	definitions.entries[rawurl] = definitionsEntry{conns: conns, expires: time.Now().Add(definitionsTTL)}
+	definitions.Unlock()
+	return copyConns(conns), nil
+}
+
+// copyConns copies conns so cached definitions are not modified by request parameters.
+func copyConns(conns []ConnRequest) []ConnRequest {
+	c := make([]ConnRequest, len(conns))
+	copy(c, conns)
+	return c
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// conditionSuccess is the condition of a dependency with a 2xx status code.
+	conditionSuccess = "success"
+	// statusSkipped is the status of a connection skipped as its condition is not met.
+	statusSkipped = "skipped"
+)
+
+var (
+	errDependencyCycle  = errors.New("Dependency cycle.")
+	errInvalidCondition = errors.New("Invalid condition. Must be success or a status code")
+)
+
+// parseCondition validates the dependency condition cond.
+func parseCondition(cond string) error {
+	if cond == "" || cond == conditionSuccess {
+		return nil
+	}
+	if _, err := strconv.Atoi(cond); err != nil {
+		return errInvalidCondition
+	}
+	return nil
+}
+
+// dependencies returns the connection each of conns depends on. Connections with
+// unknown dependencies, or that wait on themselves through dependencies and the
+// sequences after, are returned with errors instead.
+func dependencies(conns []*Conn, after map[*Conn]*Conn) (map[*Conn]*Conn, map[*Conn]error) {
+	byId := make(map[string]*Conn, len(conns))
+	for _, c := range conns {
+		if _, ok := byId[c.id]; !ok {
+			byId[c.id] = c
+		}
+	}
+	deps := make(map[*Conn]*Conn)
+	errs := make(map[*Conn]error)
+	for _, c := range conns {
+		if c.dependsOn == "" {
+			continue
+		}
+		d, ok := byId[c.dependsOn]
+		if !ok {
+			errs[c] = fmt.Errorf("unknown dependency '%s'", c.dependsOn)
+			continue
+		}
+		deps[c] = d
+	}
+	for c := range deps {
+		if waitsOn(deps[c], c, deps, after, make(map[*Conn]bool)) {
+			errs[c] = errDependencyCycle
+		}
+	}
+	for c := range errs {
+		delete(deps, c)
+	}
+	return deps, errs
+}
+
+// waitsOn reports if c is, or waits on, target through deps and after.
+func waitsOn(c, target *Conn, deps, after map[*Conn]*Conn, visited map[*Conn]bool) bool {
+	if c == nil || visited[c] {
+		return false
+	}
+	if c == target {
+		return true
+	}
+	visited[c] = true
+	return waitsOn(deps[c], target, deps, after, visited) || waitsOn(after[c], target, deps, after, visited)
+}
+
+// conditionMet reports if r, the Response of the dependency of c, meets the
+// condition of c.
+func (c *Conn) conditionMet(r *Response) bool {
+	if c.condition == "" || c.condition == conditionSuccess {
+		return r.isSuccess()
+	}
+	code, err := strconv.Atoi(c.condition)
+	return err == nil && r.err == nil && r.Response != nil && r.StatusCode == code
+}
+
+// skippedResponse returns the Response of c skipped as its condition is not met.
+func skippedResponse(c *Conn) *Response {
+	return &Response{
+		Response: &http.Response{Status: statusSkipped, Body: http.NoBody},
+		id:       c.id,
+		skipped:  true,
+		connReq:  &c.ConnRequest,
+		opts:     c.opts,
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dialFunc is the signature of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DNSCache caches the addresses host names resolve to for a TTL, so repeated
+// connections to the same hosts skip name resolution. It is safe for concurrent use
+// and can be shared across Orchestras.
+type DNSCache struct {
+	mu         sync.Mutex
+	entries    map[string]dnsEntry
+	ttl        time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsEntry is a cached resolution of a host.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewDNSCache creates a new DNSCache keeping the addresses of each host for ttl.
+func NewDNSCache(ttl time.Duration) *DNSCache {
+	return &DNSCache{
+		entries:    make(map[string]dnsEntry),
+		ttl:        ttl,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+}
+
+// lookup returns the addresses of host, resolved if not cached or expired. Failed
+// resolutions are not cached.
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, host)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.addrs, nil
+	}
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// dialContext returns dial dialing the addresses of host names from c, in order
+// until one connects. Addresses that are already ip addresses are dialed as is.
+// A nil c returns dial.
+func (c *DNSCache) dialContext(dial dialFunc) dialFunc {
+	if c == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, a := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// SetDNSCache sets the cache of the addresses of the hosts connections are made to.
+// It applies to the transport of the Orchestra and not to a round tripper set by
+// SetRoundTripper. Defaults to nil for no cache.
+func (o *Orchestra) SetDNSCache(c *DNSCache) {
+	o.opts.dnsCache = c
+	t := o.transport()
+	dial := dialFunc(t.DialContext)
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: defaultDialTimeout}).DialContext
+	}
+	t.DialContext = c.dialContext(dial)
+}
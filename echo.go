@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// SetEcho instructs the Orchestra to include the connection request of each response,
+// its id, method, url as given and the url requested after any base url or name
+// resolution, in the Json output. Sensitive headers are redacted.
+func (o *Orchestra) SetEcho(b bool) {
+	o.opts.echo = b
+}
+
+// echoOutput is the output struct of the connection request of a response.
+type echoOutput struct {
+	Id     string      `json:"id"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Target string      `json:"target,omitempty"`
+	Header http.Header `json:"headers,omitempty"`
+}
+
+// echoOutput returns the connection request of r if echo is enabled.
+func (r *Response) echoOutput() *echoOutput {
+	if r.connReq == nil || r.opts == nil || !r.opts.echo {
+		return nil
+	}
+	out := &echoOutput{
+		Id:     r.connReq.id,
+		Method: r.connReq.requestMethod(),
+		URL:    redactRawURL(r.connReq.url),
+	}
+	if r.connReq.rawURL != "" {
+		out.URL = redactRawURL(r.connReq.rawURL)
+	}
+	if r.req != nil {
+		out.Target = redactURL(r.req)
+		out.Header = redactHeader(r.req.Header)
+	}
+	return out
+}
+
+// redactRawURL returns raw with passwords and secret query parameters redacted.
+func redactRawURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return redactURL(&http.Request{URL: u})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// requestEncoding requests gzip explicitly for connections with raw encoding, so the
+// transport does not decompress transparently and the Content-Encoding and
+// Content-Length headers of the response are those transferred.
+func (c *Conn) requestEncoding(req *http.Request) {
+	if !c.rawEncoding || req.Method == http.MethodHead || req.Header.Get("Accept-Encoding") != "" {
+		return
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// decodeBody decompresses the gzip encoded body of r, received with raw encoding, as
+// it is read. The encoded bytes read are counted for the response bytes of r.
+func (c *Conn) decodeBody(r *Response) {
+	if !c.rawEncoding || r.Response == nil || !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	r.encoded = &byteCounter{r: r.Body}
+	r.Body = &gzipBody{encoded: r.encoded, closer: r.Body}
+}
+
+// transferredBytes returns the response body bytes transferred, the encoded bytes if
+// the body was decompressed.
+func (r *Response) transferredBytes() int64 {
+	if r.encoded != nil {
+		return r.encoded.n
+	}
+	return r.responseBytes
+}
+
+// byteCounter counts the bytes read from r.
+type byteCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipBody decompresses a gzip encoded body. The gzip header is read with the first
+// read, so an invalid header fails as a body read.
+type gzipBody struct {
+	encoded *byteCounter
+	closer  io.Closer
+	zr      *gzip.Reader
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		zr, err := gzip.NewReader(b.encoded)
+		if err != nil {
+			return 0, err
+		}
+		b.zr = zr
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hostFailureWindow is the period of recent requests the health of a host is
+	// judged by.
+	hostFailureWindow = time.Minute
+	// maxHostOutcomes is the maximum number of recent requests kept per host.
+	maxHostOutcomes = 100
+)
+
+// hostStats holds the outcomes of recent requests per host of all Orchestras of the
+// process deferring failing hosts.
+var hostStats = &hostHealth{hosts: make(map[string][]hostOutcome)}
+
+// SetDeferFailingHosts instructs the Orchestra to defer connections to hosts that have
+// recently been failing, so connections to healthy hosts complete first. A host is
+// failing if at least half of its requests in the last minute failed with an error
+// or 5xx status code. Deferred connections wait for a free slot until the others have
+// started, which requires concurrency to be set. With debug enabled the scheduling of
+// each connection is included in the output. Defaults to false.
+func (o *Orchestra) SetDeferFailingHosts(b bool) {
+	o.opts.deferFailing = b
+}
+
+// schedule is the scheduling decision of a connection by the health of its host.
+type schedule struct {
+	Host         string `json:"host"`
+	Deferred     bool   `json:"deferred"`
+	HostFailures int    `json:"host_failures"`
+	HostRequests int    `json:"host_requests"`
+
+	pending bool // deferred connections wait for it to start
+}
+
+// deferred reports if s is deferred. A nil schedule is not.
+func (s *schedule) deferred() bool {
+	return s != nil && s.Deferred
+}
+
+// scheduleFailing returns the schedule of each of conns by the health of their hosts
+// and conns reordered with the connections to failing hosts last. prioritized reports
+// if a connection starts right away, without waiting for another, so deferred
+// connections can wait for it. It returns nil schedules if o does not defer failing
+// hosts.
+func (o *Orchestra) scheduleFailing(conns []*Conn, prioritized func(*Conn) bool) (map[*Conn]*schedule, []*Conn) {
+	if !o.opts.deferFailing {
+		return nil, conns
+	}
+	schedules := make(map[*Conn]*schedule, len(conns))
+	for _, c := range conns {
+		s := &schedule{Host: hostOf(c)}
+		s.HostFailures, s.HostRequests = hostStats.stats(s.Host)
+		s.Deferred = s.HostFailures > 0 && 2*s.HostFailures >= s.HostRequests
+		s.pending = !s.Deferred && prioritized(c)
+		schedules[c] = s
+	}
+	ordered := append([]*Conn(nil), conns...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !schedules[ordered[i]].Deferred && schedules[ordered[j]].Deferred
+	})
+	return schedules, ordered
+}
+
+// pending returns the number of schedules deferred connections wait for to start.
+func pending(schedules map[*Conn]*schedule) int {
+	n := 0
+	for _, s := range schedules {
+		if s.pending {
+			n++
+		}
+	}
+	return n
+}
+
+// hostOf returns the scheme and host of the url of c, the url if it has none.
+func hostOf(c *Conn) string {
+	u, err := url.Parse(c.targetURL())
+	if err != nil || u.Host == "" {
+		return c.targetURL()
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// recordOutcome records the outcome of the Response of c with schedule s, if any,
+// in the stats of its host.
+func recordOutcome(c *Conn, s *schedule) {
+	if s == nil || c.Response == nil {
+		return
+	}
+	hostStats.record(s.Host, c.Response.failed())
+}
+
+// scheduleOutput returns the schedule of r if debug is enabled.
+func (r *Response) scheduleOutput() *schedule {
+	if r.opts == nil || !r.opts.debug {
+		return nil
+	}
+	return r.schedule
+}
+
+// hostHealth holds the outcomes of recent requests per host.
+type hostHealth struct {
+	mu     sync.Mutex
+	hosts  map[string][]hostOutcome
+	pruned time.Time // last removal of hosts without recent requests
+}
+
+// hostOutcome is the outcome of a request to a host.
+type hostOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// record records the outcome of a request to host. Hosts without recent requests
+// are removed at most once per failure window so hosts are not kept forever.
+func (h *hostHealth) record(host string, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.Sub(h.pruned) >= hostFailureWindow {
+		h.prune()
+		h.pruned = now
+	}
+	outcomes := append(h.recent(host), hostOutcome{at: time.Now(), failed: failed})
+	if len(outcomes) > maxHostOutcomes {
+		outcomes = outcomes[len(outcomes)-maxHostOutcomes:]
+	}
+	h.hosts[host] = outcomes
+}
+
+// stats returns the number of failed and all recent requests to host.
+func (h *hostHealth) stats(host string) (failures, requests int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	outcomes := h.recent(host)
+	if len(outcomes) == 0 {
+		delete(h.hosts, host)
+	} else {
+		h.hosts[host] = outcomes
+	}
+	for _, o := range outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	return failures, len(outcomes)
+}
+
+// prune removes the hosts without requests within the failure window. h.mu must be
+// held.
+func (h *hostHealth) prune() {
+	for host := range h.hosts {
+		if len(h.recent(host)) == 0 {
+			delete(h.hosts, host)
+		}
+	}
+}
+
+// recent returns the outcomes of host within the failure window. h.mu must be held.
+func (h *hostHealth) recent(host string) []hostOutcome {
+	outcomes := h.hosts[host]
+	since := time.Now().Add(-hostFailureWindow)
+	i := sort.Search(len(outcomes), func(i int) bool { return outcomes[i].at.After(since) })
+	return outcomes[i:]
+}
@@ -0,0 +1,18 @@
+package main
+
+// currentURL returns the url of c being fetched, the url or one of the fallbacks.
+func (c *Conn) currentURL() string {
+	if c.fallback > 0 && c.fallback <= len(c.fallbacks) {
+		return c.fallbacks[c.fallback-1]
+	}
+	return c.url
+}
+
+// servedBy returns the url that served the response of c, resolved against the base
+// url if any, or empty if c has no fallbacks.
+func (c *Conn) servedBy() string {
+	if len(c.fallbacks) == 0 {
+		return ""
+	}
+	return c.targetURL()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// outputFields are the names of the Json fields of respOutput in output order.
+var outputFields = func() []string {
+	t := reflect.TypeOf(respOutput{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return names
+}()
+
+// SetFields restricts Json output to the named fields of each response e.g. id,
+// status_code and duration. It returns an error for unknown fields. No fields
+// means all fields.
+func (o *Orchestra) SetFields(fields ...string) error {
+	if len(fields) == 0 {
+		o.opts.fields = nil
+		return nil
+	}
+	set := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !isOutputField(f) {
+			return fmt.Errorf("unknown field '%s'", f)
+		}
+		set[f] = true
+	}
+	o.opts.fields = set
+	return nil
+}
+
+// SetCamelCase instructs the Orchestra to name the Json fields of each response in
+// camelCase, e.g. statusCode instead of status_code. SetFields takes the snake_case
+// names regardless.
+func (o *Orchestra) SetCamelCase(b bool) {
+	o.opts.camelCase = b
+}
+
+// SetDurationMs instructs the Orchestra to output the duration of each response as
+// a Json number of milliseconds, duration_ms, instead of a string e.g. "123ms".
+// Defaults to false.
+func (o *Orchestra) SetDurationMs(b bool) {
+	o.opts.durationMs = b
+}
+
+// camelCase returns the snake_case name in camelCase.
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// isOutputField reports if name is a Json field of respOutput.
+func isOutputField(name string) bool {
+	for _, f := range outputFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal marshals out restricted to the fields of r, if any, and named in
+// camelCase if enabled.
+func (r *Response) marshal(out respOutput) ([]byte, error) {
+	if r.opts == nil || (r.opts.fields == nil && !r.opts.camelCase) {
+		return json.Marshal(out)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	v := reflect.ValueOf(out)
+	for i, name := range outputFields {
+		f := v.Field(i)
+		if r.opts.fields != nil && !r.opts.fields[name] {
+			continue
+		}
+		// fields other than id are omitted when empty as in respOutput.
+		if name != "id" && f.IsZero() {
+			continue
+		}
+		b, err := json.Marshal(f.Interface())
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		if r.opts.camelCase {
+			name = camelCase(name)
+		}
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+)
+
+// formContentType is the content type of form encoded bodies.
+const formContentType = "application/x-www-form-urlencoded"
+
+// SetDecodeForm instructs the Orchestra to output form encoded response bodies as a
+// Json object in the form field of Json output, instead of the body. Keys with a
+// single value map to the value and keys with more to the list of values.
+func (o *Orchestra) SetDecodeForm(b bool) {
+	o.opts.decodeForm = b
+}
+
+// decodeForm reports if form encoded bodies of r are decoded.
+func (r *Response) decodeForm() bool {
+	if r.connReq != nil && r.connReq.decodeForm {
+		return true
+	}
+	return r.opts != nil && r.opts.decodeForm
+}
+
+// form returns body decoded as a form if form decoding is enabled for r and r is
+// form encoded. It returns false otherwise or if body is not a valid form.
+func (r *Response) form(body []byte) (map[string]interface{}, bool) {
+	if !r.decodeForm() || !matchContentType(r.Header.Get("Content-Type"), formContentType) {
+		return nil, false
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false
+	}
+	form := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if len(v) == 1 {
+			form[k] = v[0]
+			continue
+		}
+		form[k] = v
+	}
+	return form, true
+}
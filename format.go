@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OutputFormat writes the responses of an Orchestra in a format, e.g. csv or xml,
+// selected by name.
+type OutputFormat interface {
+	// Name returns the name of the format, the type parameter selecting it.
+	Name() string
+	// ContentType returns the Content-Type of the output, empty for none.
+	ContentType() string
+	// Write writes resps to w.
+	Write(w io.Writer, resps []*Response) error
+}
+
+var (
+	outputFormatsMu sync.RWMutex
+	outputFormats   = make(map[string]OutputFormat)
+)
+
+// RegisterOutputFormat registers f to be selected by its name as the type parameter
+// of the server, replacing any format of the same name. Names are case insensitive
+// and the built-in types take precedence.
+func RegisterOutputFormat(f OutputFormat) {
+	outputFormatsMu.Lock()
+	defer outputFormatsMu.Unlock()
+	outputFormats[strings.ToLower(f.Name())] = f
+}
+
+// UnregisterOutputFormat removes the format registered with name, if any.
+func UnregisterOutputFormat(name string) {
+	outputFormatsMu.Lock()
+	defer outputFormatsMu.Unlock()
+	delete(outputFormats, strings.ToLower(name))
+}
+
+// registeredOutputFormat returns the format registered with name, and false if
+// there is none.
+func registeredOutputFormat(name string) (OutputFormat, bool) {
+	outputFormatsMu.RLock()
+	defer outputFormatsMu.RUnlock()
+	f, ok := outputFormats[strings.ToLower(name)]
+	return f, ok
+}
+
+// outputFormatNames returns the sorted names of the registered formats, except those
+// of built-in types.
+func outputFormatNames() []string {
+	outputFormatsMu.RLock()
+	defer outputFormatsMu.RUnlock()
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		if !containsString(serverTypes, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// responseTypes returns the response types served, the built-in types followed by
+// the names of the registered formats.
+func responseTypes() []string {
+	return append(append([]string{}, serverTypes...), outputFormatNames()...)
+}
+
+// invalidResponseTypeError returns the error of a response type not served, listing
+// the types that are.
+func invalidResponseTypeError() error {
+	return errors.New("Invalid Response Type specified. Must be one of " + strings.Join(responseTypes(), ", "))
+}
+
+// containsString reports if strs contains s.
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// UseOutputFormat instructs the Orchestra to use f for output.
+func (o *Orchestra) UseOutputFormat(f OutputFormat) {
+	o.format = f
+	o.responseType = typeCustom
+}
+
+// outputFormat returns the format of the output type of o, nil if the output type
+// is not written by a format.
+func (o *Orchestra) outputFormat() OutputFormat {
+	switch o.responseType {
+	case typeJson:
+		return jsonFormat{o}
+	case typeDelimiter:
+		return delimiterFormat{o}
+	case typeZip:
+		return zipFormat{o}
+	case typeDir:
+		return dirFormat{o}
+	case typeSplit:
+		return splitFormat{o}
+	case typeHealth:
+		return healthFormat{o}
+	case typeCustom:
+		return o.format
+	}
+	return nil
+}
+
+// jsonFormat is the Json output of an Orchestra.
+type jsonFormat struct {
+	o *Orchestra
+}
+
+func (jsonFormat) Name() string {
+	return "json"
+}
+
+func (jsonFormat) ContentType() string {
+	return "application/json"
+}
+
+func (f jsonFormat) Write(w io.Writer, resps []*Response) error {
+	return outputJson(f.o, resps, w)
+}
+
+// delimiterFormat is the delimiter separated output of an Orchestra.
+type delimiterFormat struct {
+	o *Orchestra
+}
+
+func (delimiterFormat) Name() string {
+	return "delimiter"
+}
+
+func (delimiterFormat) ContentType() string {
+	return ""
+}
+
+func (f delimiterFormat) Write(w io.Writer, resps []*Response) error {
+	return outputDelimiter(f.o, resps, w)
+}
+
+// zipFormat is the zip archive output of an Orchestra.
+type zipFormat struct {
+	o *Orchestra
+}
+
+func (zipFormat) Name() string {
+	return "zip"
+}
+
+func (zipFormat) ContentType() string {
+	return "application/zip"
+}
+
+func (f zipFormat) Write(w io.Writer, resps []*Response) error {
+	return outputZip(f.o, resps, w)
+}
+
+// dirFormat is the output of an Orchestra writing bodies to its output directory.
+type dirFormat struct {
+	o *Orchestra
+}
+
+func (dirFormat) Name() string {
+	return "dir"
+}
+
+func (dirFormat) ContentType() string {
+	return ""
+}
+
+func (f dirFormat) Write(w io.Writer, resps []*Response) error {
+	return outputDir(f.o, resps, w)
+}
+
+// splitFormat is the Json output of an Orchestra split into results and errors.
+type splitFormat struct {
+	o *Orchestra
+}
+
+func (splitFormat) Name() string {
+	return "split"
+}
+
+func (splitFormat) ContentType() string {
+	return "application/json"
+}
+
+func (f splitFormat) Write(w io.Writer, resps []*Response) error {
+	return outputSplit(f.o, resps, w)
+}
+
+// healthFormat is the health output of an Orchestra.
+type healthFormat struct {
+	o *Orchestra
+}
+
+func (healthFormat) Name() string {
+	return "health"
+}
+
+func (healthFormat) ContentType() string {
+	return "application/json"
+}
+
+func (f healthFormat) Write(w io.Writer, resps []*Response) error {
+	return outputHealth(f.o, resps, w)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// SetHeadFirst instructs the Orchestra to send a HEAD request before each GET request
+// and only send the GET request if the resource changed since it was cached, going by
+// the ETag or Last-Modified header, and its content length is within the maximum set
+// with SetHeadMaxLength. Unchanged resources are served from the cache. Requires a
+// cache to be set to skip unchanged resources.
+func (o *Orchestra) SetHeadFirst(b bool) {
+	o.opts.headFirst = b
+}
+
+// SetHeadMaxLength sets the maximum content length, reported by the HEAD request, of
+// resources fetched with head first. Larger resources are not fetched and respond with
+// the HEAD response, not ok. 0 means no limit. Defaults to 0.
+func (o *Orchestra) SetHeadMaxLength(n int64) {
+	o.opts.headMaxLength = n
+}
+
+// fetchHeadFirst sends a HEAD request to Conn's url followed by a GET request if the
+// resource changed and is not too large. The GET request is sent regardless if the
+// HEAD request fails.
+func (c *Conn) fetchHeadFirst() *Response {
+	head := c.send(http.MethodHead)
+	if head.err != nil || head.StatusCode < 200 || head.StatusCode >= 300 {
+		c.audit(head)
+		head.discard()
+		return c.send(http.MethodGet)
+	}
+	if r := c.cached(head); r != nil {
+		return r
+	}
+	if max := c.opts.headMaxLength; max > 0 && head.ContentLength > max {
+		head.checked = true
+		head.reason = fmt.Sprintf("content length %d exceeds the maximum of %d", head.ContentLength, max)
+		return head
+	}
+	c.audit(head)
+	head.discard()
+	return c.send(http.MethodGet)
+}
+
+// cached returns the cached response of Conn's url if unchanged going by the
+// validators of head, nil otherwise.
+func (c *Conn) cached(head *Response) *Response {
+	if c.opts.cache == nil || c.noCache {
+		return nil
+	}
+	e, ok := c.opts.cache.get(cacheKey(head.req))
+	if !ok || !e.matches(head.Header) {
+		return nil
+	}
+	head.discard()
+	return &Response{
+		Response: &http.Response{
+			StatusCode: e.statusCode,
+			Status:     e.status,
+			Header:     e.header,
+			Body:       ioutil.NopCloser(bytes.NewReader(e.body)),
+		},
+		id:       head.id,
+		duration: head.duration,
+		cached:   true,
+		req:      head.req,
+		opts:     head.opts,
+	}
+}
+
+// matches reports if e is the response with the ETag, or Last-Modified if
+// there is none, of header.
+func (e cacheEntry) matches(header http.Header) bool {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag == e.header.Get("ETag")
+	}
+	if modified := header.Get("Last-Modified"); modified != "" {
+		return modified == e.header.Get("Last-Modified")
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// SetHeader sets the header name to value for requests of all connections. Headers
+// set for the host of a connection, and on the connection, take precedence.
+func (o *Orchestra) SetHeader(name, value string) {
+	if o.opts.headers == nil {
+		o.opts.headers = make(http.Header)
+	}
+	o.opts.headers.Set(name, value)
+}
+
+// SetHostHeader sets the header name to value for requests of connections to host,
+// e.g. an API key of the host. host is matched against the host name of connection
+// urls, without the port. Headers set on a connection take precedence.
+func (o *Orchestra) SetHostHeader(host, name, value string) {
+	if o.opts.hostHeaders == nil {
+		o.opts.hostHeaders = make(map[string]http.Header)
+	}
+	if o.opts.hostHeaders[host] == nil {
+		o.opts.hostHeaders[host] = make(http.Header)
+	}
+	o.opts.hostHeaders[host].Set(name, value)
+}
+
+// SetMaxHeaders sets the maximum number of headers and their total size in bytes,
+// names and values, of requests, to catch misconfigured header sets merged from the
+// headers of all connections, hosts and connections. Requests exceeding either fail
+// without being sent. 0 means no limit. Defaults to 100 headers and 64KB.
+func (o *Orchestra) SetMaxHeaders(n, size int) {
+	o.opts.maxHeaders = n
+	o.opts.maxHeaderSize = size
+}
+
+// checkHeader returns an error if h, the header of a request of c, exceeds the
+// maximum number of headers or size.
+func (c *Conn) checkHeader(h http.Header) error {
+	var n, size int
+	for k, v := range h {
+		for _, s := range v {
+			n++
+			size += len(k) + len(s)
+		}
+	}
+	if max := c.opts.maxHeaders; max > 0 && n > max {
+		return fmt.Errorf("%d request headers exceed the maximum of %d", n, max)
+	}
+	if max := c.opts.maxHeaderSize; max > 0 && size > max {
+		return fmt.Errorf("request headers of %d bytes exceed the maximum of %d", size, max)
+	}
+	return nil
+}
+
+// requestHeader returns the headers of requests of c. The headers of c take
+// precedence over those of its host, which take precedence over those of all
+// connections.
+func (c *Conn) requestHeader() http.Header {
+	header := make(http.Header, len(c.Header))
+	merge(header, c.opts.headers)
+	if c.opts.hostHeaders != nil {
+		if u, err := url.Parse(c.targetURL()); err == nil {
+			merge(header, c.opts.hostHeaders[u.Hostname()])
+		}
+	}
+	merge(header, c.Header)
+	if a := c.acceptHeader(); a != "" && header.Get("Accept") == "" {
+		header.Set("Accept", a)
+	}
+	return header
+}
+
+// merge sets the values of each header of src in dst, replacing existing values.
+func merge(dst, src http.Header) {
+	for k, v := range src {
+		dst[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+}
+
+// SetForwardHeaders copies the headers names of r, the incoming request the Orchestra
+// serves, to requests of connections to host, or of all connections if host is empty.
+// Headers missing from r are not set. Only forward the headers upstreams need, e.g.
+// Authorization, as all connections to host receive them.
+func (o *Orchestra) SetForwardHeaders(r *http.Request, host string, names ...string) {
+	for _, name := range names {
+		v := r.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		if host == "" {
+			o.SetHeader(name, v)
+			continue
+		}
+		o.SetHostHeader(host, name, v)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// UseHealth instructs the Orchestra to output only whether the orchestration is
+// healthy, its aggregate status is ok, as {"healthy": true} with 200 OK or
+// {"healthy": false} with 503 Service Unavailable. The status takes the required
+// connections and the expectations of connections into account.
+func (o *Orchestra) UseHealth() {
+	o.responseType = typeHealth
+}
+
+// outputHealth writes the health of o to w, with the status 503 Service Unavailable
+// if unhealthy and w is an http.ResponseWriter. The bodies of resps are discarded.
+func outputHealth(o *Orchestra, resps []*Response, w io.Writer) error {
+	for _, r := range resps {
+		r.discard()
+	}
+	healthy := o.status() == statusOK
+	if rw, ok := w.(http.ResponseWriter); ok && !healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Healthy bool `json:"healthy"`
+	}{healthy})
+}
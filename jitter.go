@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jitterInt63n returns a random number in [0,n) for jittering fetches.
+var jitterInt63n = rand.Int63n
+
+// SetJitter sets the window within which the start of each fetch is randomly
+// delayed, so load arrives as realistic traffic rather than a synchronized burst.
+// Jitter is added to the stagger and connection delays and fetches still wait for
+// the concurrency limit, if any. The offset each request started at is included in
+// the output as start_ms. 0 means no jitter. Defaults to 0.
+func (o *Orchestra) SetJitter(d time.Duration) {
+	o.opts.jitter = d
+}
+
+// jitter returns a random delay within the jitter window of o, 0 if none.
+func (o *Orchestra) jitter() time.Duration {
+	if o.opts.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(jitterInt63n(int64(o.opts.jitter)))
+}
+
+// startMs returns the milliseconds since the start of the orchestration r was
+// requested at, nil if there is no jitter.
+func (r *Response) startMs() *int64 {
+	if r.opts == nil || r.opts.jitter <= 0 {
+		return nil
+	}
+	ms := int64(r.started / time.Millisecond)
+	return &ms
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// methodOverrideHeader is the header clients limited to GET and POST set the
+// method of the requests with.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// methods are the supported request methods.
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+var errInvalidMethod = errors.New("Invalid method. Must be one of GET, HEAD, POST, PUT, PATCH, DELETE and OPTIONS")
+
+// parseMethod validates and normalizes the request method m.
+func parseMethod(m string) (string, error) {
+	m = strings.ToUpper(strings.TrimSpace(m))
+	if m == "" {
+		return "", nil
+	}
+	if !methods[m] {
+		return "", errInvalidMethod
+	}
+	return m, nil
+}
+
+// requestMethod returns the method of the request, GET if none is set.
+func (c ConnRequest) requestMethod() string {
+	if c.method == "" {
+		return http.MethodGet
+	}
+	return c.method
+}
+
+// idempotent reports if requests with method can be sent more than once without
+// further effect.
+func idempotent(method string) bool {
+	return method != http.MethodPost && method != http.MethodPatch
+}
+
+// parseBody returns the request body of the Json value b. Strings are sent as is,
+// any other value as Json.
+func parseBody(b json.RawMessage) ([]byte, error) {
+	if len(b) == 0 || b[0] != '"' {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// requestBody returns the body of a request with method, nil if it has none.
+// HEAD requests never have a body.
+func (c ConnRequest) requestBody(method string) io.Reader {
+	if len(c.body) == 0 || method == http.MethodHead {
+		return nil
+	}
+	return bytes.NewReader(c.body)
+}
+
+// setBodyType sets the Content-Type of the body of req, unless set by a header.
+// It defaults to application/json for Json bodies and text/plain otherwise.
+func (c ConnRequest) setBodyType(req *http.Request) {
+	if req.Body == nil || req.Header.Get("Content-Type") != "" {
+		return
+	}
+	t := c.bodyType
+	if t == "" && json.Valid(c.body) {
+		t = "application/json"
+	} else if t == "" {
+		t = "text/plain; charset=utf-8"
+	}
+	req.Header.Set("Content-Type", t)
+}
@@ -0,0 +1,62 @@
+package main
+
+import "math/rand"
+
+// mirrorIntn returns a random number in [0,n) for selecting mirrors.
+var mirrorIntn = rand.Intn
+
+// selectMirrors returns the connections of o to fetch. Connections in the same
+// mirror group are collapsed to one chosen at random by weight. The Response of
+// each connection not chosen is cleared.
+func (o *Orchestra) selectMirrors() []*Conn {
+	var keys []string
+	groups := make(map[string][]*Conn)
+	for _, c := range o.conns {
+		if c.mirror == "" {
+			continue
+		}
+		if _, ok := groups[c.mirror]; !ok {
+			keys = append(keys, c.mirror)
+		}
+		groups[c.mirror] = append(groups[c.mirror], c)
+	}
+	if len(groups) == 0 {
+		return o.conns
+	}
+	chosen := make(map[*Conn]bool, len(keys))
+	for _, key := range keys {
+		chosen[chooseMirror(groups[key])] = true
+	}
+	conns := make([]*Conn, 0, len(o.conns))
+	for _, c := range o.conns {
+		if c.mirror != "" && !chosen[c] {
+			c.Response = nil
+			continue
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// chooseMirror chooses one of mirrors at random by weight.
+func chooseMirror(mirrors []*Conn) *Conn {
+	total := 0
+	for _, c := range mirrors {
+		total += c.mirrorWeight()
+	}
+	n := mirrorIntn(total)
+	for _, c := range mirrors {
+		if n -= c.mirrorWeight(); n < 0 {
+			return c
+		}
+	}
+	return mirrors[len(mirrors)-1]
+}
+
+// mirrorWeight returns the weight of c as a mirror. Defaults to 1.
+func (c *Conn) mirrorWeight() int {
+	if c.weight <= 0 {
+		return 1
+	}
+	return c.weight
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// nameHeader is the response header with the name of the orchestration.
+const nameHeader = "X-Orchestra-Name"
+
+// SetName sets the name of the orchestration to correlate it across systems. It is
+// included in the summary, audit records and the X-Orchestra-Name response header.
+// Defaults to none.
+func (o *Orchestra) SetName(name string) {
+	o.opts.name = name
+}
+
+// setNameHeader sets the name header of w to the name of o, if any.
+func (o *Orchestra) setNameHeader(w http.ResponseWriter) {
+	if o.opts.name != "" {
+		w.Header().Set(nameHeader, o.opts.name)
+	}
+}
+
+// newName generates a random orchestration name.
+func newName() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
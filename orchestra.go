@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,16 +23,33 @@ import (
 const (
 	typeJson = iota
 	typeDelimiter
+	typeZip
+	typeDir
+	typeStream
+	typeSplit
+	typeHealth
+	typeCustom
 
-	defaultTimeout   = 10 * time.Second
-	defaultDelimiter = "\n---XXX---\n"
+	defaultTimeout       = 10 * time.Second
+	defaultDelimiter     = "\n---XXX---\n"
+	defaultRetryBackoff  = 100 * time.Millisecond
+	defaultMaxURLLength  = 8192
+	defaultDialTimeout   = 30 * time.Second
+	defaultErrorBodySize = 4096
+	defaultMaxHeaders    = 100
+	defaultMaxHeaderSize = 64 << 10
+	defaultBodyDeadline  = 5 * time.Minute
 )
 
 var (
-	errInvalidResponseType = errors.New("Invalid Response Type specified. Must be one of typeJson, typeDelimiter")
-	errTimeout             = errors.New("Timeout exceeded! Connection terminated.")
+	errTimeout        = errors.New("Timeout exceeded! Connection terminated.")
+	errInvalidBaseURL = errors.New("Invalid base url. Must be an absolute url e.g. http://url.com")
+	errInvalidProxy   = errors.New("Invalid proxy. Must be an absolute url e.g. http://proxy.com:3128 or " + proxyDirect)
 )
 
+// proxyDirect is the proxy value for connecting without a proxy.
+const proxyDirect = "direct"
+
 // Orchestra is the high level representation of the Orchestration Layer.
 type Orchestra struct {
 	conns        []*Conn
@@ -33,20 +57,150 @@ type Orchestra struct {
 	cLock        *sync.Mutex
 	delimiter    string
 	timeout      time.Duration
+	opts         *options
+	batcher      Batcher
+	dir          string       // output directory of response bodies
+	format       OutputFormat // custom output format, nil for none
+}
+
+// options holds the Orchestra wide settings shared with each Conn.
+type options struct {
+	baseURL       *url.URL                   // base for resolving relative connection urls
+	maxURLLength  int                        // maximum length of request urls, 0 for no limit
+	maxHeaders    int                        // maximum number of request headers, 0 for no limit
+	maxHeaderSize int                        // maximum size in bytes of request headers, 0 for no limit
+	summary       bool                       // wrap json output with a summary
+	onlyFailed    bool                       // output only errors and non 2xx responses
+	noContent     bool                       // respond with 204 if every response is filtered out
+	transport     *http.Transport            // transport shared by connections, nil for http.DefaultTransport
+	dnsCache      *DNSCache                  // cache of resolved host addresses, nil for none
+	debug         bool                       // include request details in json output
+	echo          bool                       // include the connection request in json output
+	compare       []string                   // ids of the connections compared instead of output, nil for none
+	aggregate     *aggregateSpec             // aggregate of the response bodies in the summary, nil for none
+	finalURL      bool                       // include the url requested after params and redirects
+	maxBodySize   int64                      // maximum size of response bodies in output, 0 for no limit
+	labels        map[string]string          // labels of every response in output
+	tokenProvider *TokenProvider             // provider of bearer tokens, nil for none
+	stagger       time.Duration              // interval between the start of fetches
+	jitter        time.Duration              // window of random delays of the start of fetches
+	fields        map[string]bool            // Json output fields, nil for all
+	camelCase     bool                       // name Json output fields in camelCase
+	durationMs    bool                       // output durations as a number of milliseconds
+	hostCerts     map[string]tls.Certificate // client certificates by host
+	sniCerts      bool                       // select client certificates by server name (SNI)
+	tlsInfo       bool                       // include the certificate of the server in output
+	headers       http.Header                // request headers of all connections
+	hostHeaders   map[string]http.Header     // request headers by host
+	audit         func(AuditRecord)          // called with the record of every request sent
+	auditBodies   func(*Response) bool       // reports if the body of a response is audited
+	auditBodySize int                        // maximum size of audited bodies
+
+	captureHeaders []string // canonical response header names in output, * for all
+	collapseErrors bool     // output connections failing with the same error as one entry
+
+	bodyStore          BodyStore // store of large bodies, nil for none
+	bodyStoreThreshold int64     // size in bytes of bodies stored in bodyStore
+
+	invalidUTF8   InvalidUTF8 // handling of bodies not valid UTF-8 in json output
+	name          string      // name of the orchestration, empty for none
+	accept        string      // Accept header of requests without one, empty for none
+	decodeForm    bool        // output form encoded bodies as a json object
+	errorBodySize int         // maximum size of error bodies in json output, 0 for no limit
+
+	roundTripper http.RoundTripper                           // replaces the transport of all connections, nil for none
+	wrappers     []func(http.RoundTripper) http.RoundTripper // wrappers of the transport of each connection
+
+	transportsMu sync.Mutex
+	transports   []*http.Transport // copies of the transport made for connections
+
+	warmup       bool // send a HEAD request to each host before fetching
+	warmupTiming bool // output the duration of the warmup of each host
+
+	headFirst     bool  // send a HEAD request before each GET request
+	headMaxLength int64 // maximum content length of GET requests after HEAD, 0 for no limit
+
+	retries          int                  // maximum retries of a failed request
+	retryBackoff     time.Duration        // wait before the first retry, doubled for each retry
+	retryPredicate   func(*Response) bool // reports if a response should be retried
+	maxRetryDuration time.Duration        // maximum time spent retrying a request, 0 for no limit
+
+	heartbeat time.Duration // interval of writes while fetching, 0 for none
+
+	trailingNewline bool // end delimiter output with a newline
+	inputOrder      bool // stream responses in input order instead of completion order
+
+	totalTimeout time.Duration   // hard limit on the duration of Process, 0 for none
+	ctx          context.Context // context of requests, cancelled after the total timeout
+	bodyDeadline time.Duration   // limit of requests whose bodies the timeout does not limit, 0 for none
+	deadline     time.Time       // absolute deadline of connections without their own, zero for none
+
+	concurrency    int  // maximum concurrent fetches, 0 for no limit
+	adaptive       bool // adjust concurrency by latency and errors
+	maxConcurrency int  // maximum adaptive concurrency
+	deferFailing   bool // defer connections to failing hosts
+
+	rampStart int           // concurrency at the start of the ramp
+	ramp      time.Duration // duration of the ramp up to concurrency, 0 for none
+
+	cache        *Cache // cache of successful responses
+	staleIfError bool   // serve cached responses when requests fail
+
+	chaos      int           // percentage of connections failed synthetically, 0 for none
+	chaosDelay time.Duration // delay of synthetically delayed requests
+
+	maxRedirectBodySize int64 // maximum size of redirect bodies read to reuse their connection, 0 for the client default
 }
 
 // ConnRequest is the representation of the Connection Request used to initialize the Orchestra.
 type ConnRequest struct {
-	id  string // identification
-	url string // target url
+	id          string            // identification
+	url         string            // target url
+	rawURL      string            // url as given if resolved by a Resolver
+	proxy       string            // proxy url or direct, overrides the Orchestra proxy
+	meta        map[string]string // arbitrary labels echoed in the output
+	webhook     string            // url the result is posted to on success
+	contentType string            // expected media type of the response
+	mirror      string            // mirror group, only one connection of a group is fetched
+	weight      int               // weight of the connection among its mirrors, defaults to 1
+	ttfb        time.Duration     // time to first byte timeout, replaces the total timeout if set
+	maxBodySize int64             // maximum size of the response body, overrides the Orchestra maximum
+	bodyTimeout time.Duration     // maximum time reading the response body, 0 for none
+	sla         time.Duration     // expected maximum duration, longer responses are flagged, 0 for none
+	required    bool              // counts towards the aggregate status
+	delay       time.Duration     // wait before fetching, after any stagger
+	dependsOn   string            // id of the connection fetched first, whose result is the condition of fetching
+	condition   string            // success or the status code of the dependency, defaults to success
+	group       string            // sequential group, connections of a group are fetched one after another
+	order       int               // order of the connection in its group
+	method      string            // request method, defaults to GET
+	body        []byte            // request body, nil for none
+	bodyType    string            // Content-Type of the body, detected if empty
+	accept      string            // Accept header, overrides that of the orchestra
+	noCache     bool              // bypass the cache of the orchestra
+	decodeForm  bool              // output form encoded bodies as a json object
+	criteria    *Criteria         // success criteria, nil for none
+	fallbacks   []string          // urls fetched in order if the url fails
+	checksum    string            // expected checksum of the body as algorithm:digest, empty for none
+	rawEncoding bool              // request gzip explicitly, reporting the encoded size and headers
+	deadline    time.Time         // absolute deadline replacing the timeout, zero for none
 }
 
 // NewOrchestra creates a new orchestra. It initializes with ConnRequest(s)
 func NewOrchestra(requests ...ConnRequest) *Orchestra {
+	opts := &options{
+		maxURLLength:  defaultMaxURLLength,
+		retryBackoff:  defaultRetryBackoff,
+		errorBodySize: defaultErrorBodySize,
+		maxHeaders:    defaultMaxHeaders,
+		maxHeaderSize: defaultMaxHeaderSize,
+		bodyDeadline:  defaultBodyDeadline,
+	}
 	conns := make([]*Conn, len(requests))
 	for i := range requests {
 		conns[i] = NewConn(requests[i])
 		conns[i].Timeout = defaultTimeout
+		conns[i].opts = opts
 	}
 	return &Orchestra{
 		conns,
@@ -54,6 +208,10 @@ func NewOrchestra(requests ...ConnRequest) *Orchestra {
 		&sync.Mutex{},
 		defaultDelimiter,
 		defaultTimeout,
+		opts,
+		nil,
+		"",
+		nil,
 	}
 }
 
@@ -63,6 +221,7 @@ func (o *Orchestra) Add(r ConnRequest) {
 	defer o.cLock.Unlock()
 	conn := NewConn(r)
 	conn.Timeout = o.timeout
+	conn.opts = o.opts
 	o.conns = append(o.conns, conn)
 }
 
@@ -74,123 +233,713 @@ func (o *Orchestra) SetTimeout(t time.Duration) {
 	}
 }
 
-// SetDelimiter instructs the Orchestra to use separate plain text outputs with delimeter instead of json.
+// SetBaseURL sets the base url relative connection urls are resolved against.
+// e.g. with base http://url.com, a connection url /path targets http://url.com/path.
+func (o *Orchestra) SetBaseURL(base string) error {
+	u, err := parseBaseURL(base)
+	if err != nil {
+		return err
+	}
+	o.opts.baseURL = u
+	return nil
+}
+
+// parseBaseURL parses base and ensures it is an absolute url.
+func parseBaseURL(base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, errInvalidBaseURL
+	}
+	return u, nil
+}
+
+// SetProxy sets the proxy url used by all connections. Use direct to connect without a
+// proxy. Connections with their own proxy are not affected.
+// Defaults to the proxy specified by the environment.
+func (o *Orchestra) SetProxy(proxy string) error {
+	p, err := parseProxy(proxy)
+	if err != nil {
+		return err
+	}
+	o.transport().Proxy = p
+	return nil
+}
+
+// parseProxy parses proxy into a function suitable for http.Transport.Proxy.
+// direct returns nil.
+func parseProxy(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == proxyDirect {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, errInvalidProxy
+	}
+	return http.ProxyURL(u), nil
+}
+
+// SetKeepAlive sets the keep-alive period of the TCP connections used for requests.
+// Keep-alive probes detect dead peers on connections held open by slow or long
+// polling upstreams. The timeout still bounds each request, so a keep-alive period
+// longer than the timeout has no effect on dead peer detection.
+// A negative period disables keep-alive. Defaults to 30 seconds.
+func (o *Orchestra) SetKeepAlive(d time.Duration) {
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: d,
+	}
+	o.transport().DialContext = o.opts.dnsCache.dialContext(dialer.DialContext)
+}
+
+// transport returns the transport shared by the connections, creating it from
+// http.DefaultTransport on first use.
+func (o *Orchestra) transport() *http.Transport {
+	if o.opts.transport == nil {
+		o.opts.transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return o.opts.transport
+}
+
+// SetMaxURLLength sets the maximum length of request urls, including query parameters.
+// Requests with longer urls fail without being sent. 0 means no limit.
+// Defaults to 8192.
+func (o *Orchestra) SetMaxURLLength(n int) {
+	o.opts.maxURLLength = n
+}
+
+// SetStagger sets the interval between the start of fetches, so backends receive
+// requests spread over time rather than all at once. Fetches wait for their turn
+// before waiting for the concurrency limit, if any. Connection delays are added to
+// the stagger. 0 means no stagger. Defaults to 0.
+func (o *Orchestra) SetStagger(d time.Duration) {
+	o.opts.stagger = d
+}
+
+// SetHeartbeat sets the interval at which a newline is written to the output while
+// fetching. This keeps intermediaries from dropping idle connections during long
+// orchestrations. 0 means no heartbeat. Defaults to 0.
+func (o *Orchestra) SetHeartbeat(d time.Duration) {
+	o.opts.heartbeat = d
+}
+
+// SetOnlyFailed instructs the Orchestra to output only the connections that failed
+// or returned a non 2xx status code. Skipped connections are not output.
+func (o *Orchestra) SetOnlyFailed(b bool) {
+	o.opts.onlyFailed = b
+}
+
+// SetNoContentIfFiltered instructs the Orchestra to respond with 204 No Content,
+// instead of an empty output, if every response is filtered out. It has no effect
+// with a heartbeat, which responds before the responses are filtered.
+func (o *Orchestra) SetNoContentIfFiltered(b bool) {
+	o.opts.noContent = b
+}
+
+// SetSummary instructs the Orchestra to wrap Json output in an object with the
+// results and a summary of the orchestration including total bytes transferred.
+func (o *Orchestra) SetSummary(b bool) {
+	o.opts.summary = b
+}
+
+// SetDebug instructs the Orchestra to include details of the request sent for each
+// connection in Json output. Sensitive headers are redacted.
+func (o *Orchestra) SetDebug(b bool) {
+	o.opts.debug = b
+}
+
+// SetFinalURL instructs the Orchestra to include the url each connection finally
+// requested, after merging params and following redirects, in Json output.
+func (o *Orchestra) SetFinalURL(b bool) {
+	o.opts.finalURL = b
+}
+
+// SetOutputLabel sets a label included in the output of every connection e.g. the
+// tenant or environment of the orchestration.
+func (o *Orchestra) SetOutputLabel(key, value string) {
+	if o.opts.labels == nil {
+		o.opts.labels = make(map[string]string)
+	}
+	o.opts.labels[key] = value
+}
+
+// SetCaptureHeaders sets the names of response headers to include in the output.
+// Names are case insensitive and * includes all headers except hop-by-hop headers and
+// Set-Cookie, which are only included if named explicitly. Defaults to none.
+func (o *Orchestra) SetCaptureHeaders(names ...string) {
+	o.opts.captureHeaders = make([]string, len(names))
+	for i := range names {
+		o.opts.captureHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(names[i]))
+	}
+}
+
+// SetDelimiter instructs the Orchestra to use separate plain text outputs with delimiter d
+// instead of json. It is SetDelimiterString followed by UseDelimiter.
 func (o *Orchestra) SetDelimiter(d string) {
+	o.SetDelimiterString(d)
+	o.UseDelimiter()
+}
+
+// SetDelimiterString sets the delimiter between the outputs of delimiter output without
+// changing the output type.
+func (o *Orchestra) SetDelimiterString(d string) {
 	o.delimiter = "\n" + d
 	if !strings.HasSuffix(d, "\n") {
 		o.delimiter += "\n"
 	}
+}
+
+// UseDelimiter instructs the Orchestra to use separate plain text outputs with the
+// delimiter, set by SetDelimiterString, for output.
+func (o *Orchestra) UseDelimiter() {
 	o.responseType = typeDelimiter
 }
 
-// UseDelimeter instructs the Orchestra to use Json for output.
+// SetTrailingNewline instructs the Orchestra to end delimiter output with a newline,
+// unless the last output already ends with one or there are no outputs. Otherwise
+// delimiter output ends with the last output as is. Defaults to false.
+func (o *Orchestra) SetTrailingNewline(b bool) {
+	o.opts.trailingNewline = b
+}
+
+// UseDelimeter is UseDelimiter.
+//
+// Deprecated: use UseDelimiter.
 func (o *Orchestra) UseDelimeter() {
-	o.responseType = typeDelimiter
+	o.UseDelimiter()
 }
 
-// UseJson instructs the Orchestra to use Json for output.
-func (o *Orchestra) UseJson() {
+// UseJSON instructs the Orchestra to use a Json array for output. This is the default.
+func (o *Orchestra) UseJSON() {
 	o.responseType = typeJson
 }
 
+// UseJson is UseJSON.
+//
+// Deprecated: use UseJSON.
+func (o *Orchestra) UseJson() {
+	o.UseJSON()
+}
+
 // Process processes all connection requests and send them concurrently
-// When done, it outputs to w.
+// When done, it outputs to w. An Orchestra without connections outputs an empty
+// Json array, empty delimiter or stream output and a zip with only the manifest.
 func (o *Orchestra) Process(w http.ResponseWriter) {
-	var wg sync.WaitGroup
-	wg.Add(len(o.conns))
-	for i := range o.conns {
-		go fetchConns(o.conns[i], &wg)
+	defer o.withTotalTimeout()()
+	o.setNameHeader(w)
+	if o.responseType == typeStream && o.opts.compare == nil {
+		o.processStream(w)
+		return
+	}
+	done, _ := o.fetch(nil)
+	defer o.cleanup(done)
+	o.heartbeat(w, o.untilExpired(done))
+	select {
+	case <-done:
+	default:
+		o.writeTotalTimeout(w)
+		return
+	}
+	if o.opts.compare != nil {
+		o.outputComparison(w)
+		return
 	}
-	wg.Wait()
 	processConns(o, w)
 }
 
-func fetchConns(conn *Conn, wg *sync.WaitGroup) {
+// cleanup releases the resources of the responses of o once done, closed when all
+// connections are fetched, is closed. Bodies not output, such as those of responses
+// not compared or fetched after the total timeout, are closed, stored bodies removed
+// and idle connections of the transports of o closed. Fetches still in flight after
+// the total timeout are cleaned up in the background.
+func (o *Orchestra) cleanup(done <-chan struct{}) {
+	select {
+	case <-done:
+	default:
+		go func() {
+			<-done
+			o.cleanup(done)
+		}()
+		return
+	}
+	for _, c := range o.conns {
+		if r := c.Response; r != nil && r.Response != nil && r.Body != nil && r.stored == nil {
+			r.Body.Close()
+		}
+	}
+	o.removeStoredBodies()
+	o.closeIdleConnections()
+}
+
+// fetch fetches the connections of o concurrently. It returns a channel closed when
+// all are fetched and the connections to fetch, in input order. Each connection is
+// also sent to completed, if not nil, when fetched. completed must not block.
+func (o *Orchestra) fetch(completed chan<- *Conn) (<-chan struct{}, []*Conn) {
+	var wg sync.WaitGroup
+	conns := o.selectMirrors()
+	if o.opts.warmup {
+		warmup(conns)
+	}
+	batches, single := o.batches(conns)
+	wg.Add(len(batches) + len(single))
+	l := o.newLimiter()
+	after := sequences(conns)
+	deps, depErrs := dependencies(conns, after)
+	schedules, single := o.scheduleFailing(single, func(c *Conn) bool {
+		_, seq := after[c]
+		_, dep := deps[c]
+		return !seq && !dep && depErrs[c] == nil
+	})
+	l.setPending(pending(schedules))
+	finished := make(map[*Conn]chan struct{}, len(conns))
+	for _, c := range conns {
+		finished[c] = make(chan struct{})
+	}
+	notify := func(conns ...*Conn) {
+		for _, c := range conns {
+			close(finished[c])
+			if completed != nil {
+				completed <- c
+			}
+		}
+	}
+	start := time.Now()
+	for i := range batches {
+		go func(conns []*Conn, delay time.Duration) {
+			time.Sleep(delay)
+			fetchBatch(o, conns, &wg, l, start)
+			notify(conns...)
+		}(batches[i], o.opts.stagger*time.Duration(i)+o.jitter())
+	}
+	for i := range single {
+		go func(conn *Conn, delay time.Duration) {
+			defer notify(conn)
+			if err := depErrs[conn]; err != nil {
+				conn.Response = &Response{id: conn.id, err: err, connReq: &conn.ConnRequest, opts: conn.opts}
+				wg.Done()
+				return
+			}
+			if prev, ok := after[conn]; ok {
+				<-finished[prev]
+			}
+			if dep, ok := deps[conn]; ok {
+				<-finished[dep]
+				if !conn.conditionMet(dep.Response) {
+					conn.Response = skippedResponse(conn)
+					wg.Done()
+					return
+				}
+			}
+			time.Sleep(delay + conn.delay)
+			fetchConns(conn, &wg, l, start, schedules[conn])
+		}(single[i], o.opts.stagger*time.Duration(len(batches)+i)+o.jitter())
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done, conns
+}
+
+// heartbeat writes a newline to w at every heartbeat interval until done is closed.
+// This keeps intermediaries from dropping idle connections during long orchestrations.
+// The newlines are leading whitespace to Json and delimiter outputs. Zip, health and
+// custom output have no heartbeat, as the status code of health output depends on the
+// results and custom formats may not allow leading whitespace.
+func (o *Orchestra) heartbeat(w http.ResponseWriter, done <-chan struct{}) {
+	if o.opts.heartbeat <= 0 || o.responseType == typeZip || o.responseType == typeHealth || o.responseType == typeCustom {
+		<-done
+		return
+	}
+	ticker := time.NewTicker(o.opts.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// headers are sent with the first write.
+			o.setContentType(w)
+			if _, err := w.Write([]byte("\n")); err != nil {
+				log.Println(err)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+// fetchConns fetches conn within the concurrency limits. start is the start of the
+// orchestration the start offset of the request is reported from. s is the schedule
+// of conn by the health of its host, nil if failing hosts are not deferred.
+func fetchConns(conn *Conn, wg *sync.WaitGroup, l *limiter, start time.Time, s *schedule) {
+	defer wg.Done()
+	queued := l.acquire(s)
+	defer func() { l.release(conn.Response) }()
+	defer releaseFetch(acquireFetch())
+	started := time.Since(start)
+	defer recoverFetch(conn)
 	conn.Fetch()
-	wg.Done()
+	conn.Response.queued = queued
+	conn.Response.started = started
+	conn.Response.schedule = s
+	recordOutcome(conn, s)
+	dispatchWebhook(conn)
+}
+
+// recoverFetch recovers from a panic while fetching conn. The panic is logged
+// and stored as an error Response so other connections and the server are unaffected.
+func recoverFetch(conn *Conn) {
+	if r := recover(); r != nil {
+		log.Printf("panic fetching %v: %v\n%s", conn.id, r, debug.Stack())
+		conn.Response = &Response{id: conn.id, err: fmt.Errorf("panic: %v", r), connReq: &conn.ConnRequest, opts: conn.opts}
+	}
 }
 
 // processConns distributes the output handler to respective function based on type.
 func processConns(o *Orchestra, w http.ResponseWriter) error {
-	var err error
-	switch o.responseType {
-	case typeDelimiter:
-		err = outputDelimiter(o, w)
-		break
-	case typeJson:
-		w.Header().Set("Content-type", "application/json")
-		err = outputJson(o, w)
-		break
-	default:
-		return errInvalidResponseType
+	resps := o.responses()
+	if len(resps) == 0 && o.opts.noContent && o.fetched() > 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
 	}
-	return err
+	f := o.outputFormat()
+	if f == nil {
+		return invalidResponseTypeError()
+	}
+	o.setContentType(w)
+	return f.Write(w, resps)
 }
 
-// outputJson extracts all responses from o and json encode into w.
-func outputJson(o *Orchestra, w io.Writer) error {
-	resps := make([]*Response, len(o.conns))
-	for i := range resps {
-		resps[i] = o.conns[i].Response
+// setContentType sets the Content-type header of w for the output type.
+func (o *Orchestra) setContentType(w http.ResponseWriter) {
+	if f := o.outputFormat(); f != nil {
+		if ct := f.ContentType(); ct != "" {
+			w.Header().Set("Content-type", ct)
+		}
 	}
-	encoder := json.NewEncoder(w)
-	return encoder.Encode(resps)
 }
 
-// outputDelimiter extracts all responses from o and writes to w. It separates each response with
-// the specified delimiter.
-func outputDelimiter(o *Orchestra, w io.Writer) error {
+// responses returns the responses of o to output. Responses filtered out are discarded.
+func (o *Orchestra) responses() []*Response {
+	resps := make([]*Response, 0, len(o.conns))
 	for i := range o.conns {
-		_, err := o.conns[i].Response.writeTo(w)
+		r := o.conns[i].Response
+		if r == nil {
+			// mirror not chosen
+			continue
+		}
+		if o.filtered(r) {
+			r.discard()
+			continue
+		}
+		resps = append(resps, r)
+	}
+	return resps
+}
+
+// filtered reports if r is filtered out of the output.
+func (o *Orchestra) filtered(r *Response) bool {
+	return o.opts.onlyFailed && !r.isFailure()
+}
+
+// fetched returns the number of connections of o fetched, filtered out or not.
+func (o *Orchestra) fetched() int {
+	n := 0
+	for _, c := range o.conns {
+		if c.Response != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// outputJson json encodes resps into w. When summary is enabled, resps are
+// wrapped in an object with the results and the summary.
+func outputJson(o *Orchestra, resps []*Response, w io.Writer) error {
+	groups := o.errorGroups(resps)
+	if !o.opts.summary {
+		if err := writeJsonArray(w, resps, groups); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+	if _, err := io.WriteString(w, `{"results":`); err != nil {
+		return err
+	}
+	// results are written first as the summary depends on the bodies read.
+	if err := writeJsonArray(w, resps, groups); err != nil {
+		return err
+	}
+	s := newSummary(resps)
+	s.Filtered = o.fetched() - len(resps)
+	s.Name = o.opts.name
+	s.Status = o.status()
+	s.Ramp = o.rampSchedule()
+	s.Aggregate = o.aggregate(resps)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `,"summary":%s}`+"\n", b)
+	return err
+}
+
+// writeJsonArray writes resps to w as a Json array. Responses are marshaled one
+// at a time so only one body is held in memory. Responses in groups are written as
+// their group in place of the first response of the group.
+func writeJsonArray(w io.Writer, resps []*Response, groups map[*Response]*errorGroup) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	n := 0
+	for _, r := range resps {
+		var v interface{} = r
+		if g, ok := groups[r]; ok {
+			if g.first != r {
+				continue
+			}
+			v = g
+		}
+		if n > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		n++
+		b, err := json.Marshal(v)
 		if err != nil {
-			log.Println(err)
 			return err
 		}
-		if i < len(o.conns)-1 {
-			_, err = w.Write([]byte(o.delimiter))
-			if err != nil {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// summary is the summary of an orchestration.
+type summary struct {
+	Name          string `json:"name,omitempty"`
+	Count         int    `json:"count"`
+	Failed        int    `json:"failed"`
+	Filtered      int    `json:"filtered"`
+	Status        string `json:"status"`
+	RequestBytes  int64  `json:"request_bytes"`
+	ResponseBytes int64  `json:"response_bytes"`
+
+	Ramp      []rampStep `json:"ramp,omitempty"`
+	Aggregate *aggregate `json:"aggregate,omitempty"`
+}
+
+// Aggregate statuses of an orchestration.
+const (
+	statusOK     = "ok"
+	statusFailed = "failed"
+)
+
+// status returns the aggregate status of the connections of o. It is failed if any
+// required connection did not succeed. If no connection is required, all are.
+func (o *Orchestra) status() string {
+	required := false
+	for _, c := range o.conns {
+		if c.required {
+			required = true
+			break
+		}
+	}
+	for _, c := range o.conns {
+		if c.Response == nil || (required && !c.required) {
+			continue
+		}
+		if c.Response.isFailure() {
+			return statusFailed
+		}
+	}
+	return statusOK
+}
+
+// newSummary creates a summary of resps. It should be called after the
+// response bodies are read.
+func newSummary(resps []*Response) summary {
+	s := summary{Count: len(resps)}
+	for _, r := range resps {
+		if r.isFailure() {
+			s.Failed++
+		}
+		s.RequestBytes += r.requestBytes
+		s.ResponseBytes += r.transferredBytes()
+	}
+	return s
+}
+
+// outputDelimiter writes resps to w. Responses are separated by the delimiter,
+// which is written between responses only, and the output ends with a newline if
+// set.
+func outputDelimiter(o *Orchestra, resps []*Response, w io.Writer) error {
+	lw := &lastByteWriter{Writer: w}
+	for i := range resps {
+		if i > 0 {
+			if _, err := io.WriteString(lw, o.delimiter); err != nil {
 				log.Println(err)
 				return err
 			}
 		}
+		if _, err := resps[i].writeTo(lw); err != nil {
+			log.Println(err)
+			return err
+		}
+		// bodies are streamed, flush so each reaches the client as written.
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if o.opts.trailingNewline && len(resps) > 0 && lw.last != '\n' {
+		if _, err := io.WriteString(lw, "\n"); err != nil {
+			log.Println(err)
+			return err
+		}
 	}
 	return nil
 }
 
+// lastByteWriter is an io.Writer recording the last byte written.
+type lastByteWriter struct {
+	io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.last = p[n-1]
+	}
+	return n, err
+}
+
 // Conn is the individual connection that is handled by Orchestra.
-// TODO allow other request methods apart from GET
 type Conn struct {
 	*http.Client
-	id       string            // identification
-	url      string            // target url
-	Header   http.Header       // http headers
-	Params   map[string]string // form parameters
-	Response *Response         // request response
+	ConnRequest                   // identification, target url and settings
+	Header      http.Header       // http headers
+	Params      map[string]string // form parameters
+	Response    *Response         // request response
+	opts        *options          // orchestra wide settings
+	warmup      time.Duration     // duration of the warmup request of the host
+	fallback    int               // url fetched, 0 for url and i for fallbacks[i-1]
+	chaos       string            // synthetic failure of the connection, empty for none
 }
 
 // NewConn creates a new Connection. It initiates with a ConnRequest for Id and Url.
 func NewConn(r ConnRequest) *Conn {
 	return &Conn{
 		&http.Client{},
-		r.id,
-		r.url,
+		r,
 		make(http.Header),
 		make(map[string]string),
 		nil,
+		&options{},
+		0,
+		0,
+		"",
 	}
 }
 
-// Fetch sends GET request to Conn's url and stores Response.
+// Fetch sends a request to Conn's url, GET unless a method is set, and stores Response.
+// Relative urls are resolved against the base url if set.
+// Failed requests are retried if retries are set, and then fetched from the fallback
+// urls in order, if any.
 func (c *Conn) Fetch() error {
+	start := time.Now()
+	attempts := 0
+	c.chaos = c.chaosFault()
+	for c.fallback = 0; ; c.fallback++ {
+		attempts += c.fetchRetries(start)
+		if c.fallback >= len(c.fallbacks) || !c.shouldRetry(c.Response) {
+			break
+		}
+		c.Response.discard()
+		log.Printf("%v failed, falling back to %v\n", c.id, c.fallbacks[c.fallback])
+	}
+	c.check(c.Response)
+	c.Response = c.cache(c.Response)
+	c.store(c.Response)
+	c.Response.attempts = attempts
+	c.Response.warmup = c.warmup
+	c.Response.chaos = c.chaos
+	c.Response.servedBy = c.servedBy()
+	return c.Response.err
+}
+
+// fetchRetries fetches the current url of c, retrying failed requests if retries are
+// set, and stores Response. start is the start of the fetch the maximum retry
+// duration applies from. It returns the attempts made.
+func (c *Conn) fetchRetries(start time.Time) int {
+	attempt := 0
+	for ; ; attempt++ {
+		c.Response = c.fetch()
+		c.Response.connReq = &c.ConnRequest
+		c.audit(c.Response)
+		if attempt >= c.opts.retries || !c.shouldRetry(c.Response) {
+			break
+		}
+		wait := c.retryWait(c.Response, attempt)
+		if max := c.opts.maxRetryDuration; max > 0 && time.Since(start)+wait > max {
+			log.Printf("not retrying %v, maximum retry duration of %v exceeded\n", c.id, max)
+			break
+		}
+		c.Response.discard()
+		log.Printf("retrying %v in %v, attempt %d of %d\n", c.id, wait, attempt+1, c.opts.retries)
+		time.Sleep(wait)
+	}
+	return attempt + 1
+}
+
+// fetch sends a single request to Conn's url and returns the Response.
+// GET requests are preceded by a HEAD request if head first is enabled.
+func (c *Conn) fetch() *Response {
+	if c.opts.headFirst && !c.noCache && c.requestMethod() == http.MethodGet {
+		return c.fetchHeadFirst()
+	}
+	return c.send(c.requestMethod())
+}
+
+// send sends a request with method to Conn's url and returns the Response.
+func (c *Conn) send(method string) *Response {
 	now := time.Now()
-	req, err := http.NewRequest("GET", c.url, nil)
+	req, err := http.NewRequest(method, c.targetURL(), c.requestBody(method))
 	if err != nil {
 		log.Println(err)
-		c.Response = &Response{nil, c.id, err, 0}
-		return err
+		return &Response{id: c.id, err: err, opts: c.opts}
+	}
+	if c.opts.ctx != nil {
+		req = req.WithContext(c.opts.ctx)
 	}
+	req = c.withChaos(req)
 	// pass headers
-	req.Header = c.Header
+	req.Header = c.requestHeader()
+	c.setBodyType(req)
+	c.requestEncoding(req)
+	if err := c.authorize(req); err != nil {
+		log.Println(err)
+		return &Response{id: c.id, err: err, req: req, opts: c.opts}
+	}
+
+	if err := c.checkHeader(req.Header); err != nil {
+		log.Println(err)
+		return &Response{id: c.id, err: err, req: req, opts: c.opts}
+	}
+
+	if c.Transport == nil {
+		c.Transport, err = c.newTransport()
+		if err != nil {
+			log.Println(err)
+			return &Response{id: c.id, err: err, opts: c.opts}
+		}
+	}
 
 	// workaround for query params
 	values := req.URL.Query()
@@ -199,42 +948,323 @@ func (c *Conn) Fetch() error {
 	}
 	req.URL.RawQuery = values.Encode()
 
-	response, err := c.Do(req)
+	if n := len(req.URL.String()); c.opts.maxURLLength > 0 && n > c.opts.maxURLLength {
+		err := fmt.Errorf("url length %d exceeds the maximum of %d", n, c.opts.maxURLLength)
+		log.Println(err)
+		return &Response{id: c.id, err: err, req: req, opts: c.opts}
+	}
+
+	var size requestSize
+	req = size.trace(req)
+
+	response, err := c.do(req)
 	if err != nil {
 		log.Println(err)
-		c.Response = &Response{nil, c.id, err, 0}
-		return err
+		return &Response{id: c.id, err: err, timeout: c.timeoutOf(err), duration: time.Since(now), req: req, requestBytes: size.bytes(), opts: c.opts}
 	}
-	c.Response = &Response{
-		response,
-		c.id,
-		nil,
-		time.Since(now),
+	r := &Response{
+		Response:     response,
+		id:           c.id,
+		duration:     time.Since(now),
+		req:          req,
+		requestBytes: size.bytes(),
+		opts:         c.opts,
 	}
-	return nil
+	c.decodeBody(r)
+	return r
+}
+
+// targetURL returns the current url of c resolved against the base url, if any.
+func (c *Conn) targetURL() string {
+	raw := c.currentURL()
+	if c.opts.baseURL == nil {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		// leave it to http.NewRequest to report
+		return raw
+	}
+	return c.opts.baseURL.ResolveReference(u).String()
+}
+
+// newTransport returns the transport for c, or the round tripper of the Orchestra if
+// set, wrapped with the round tripper wrappers of the Orchestra and, if chaos testing,
+// the injection of synthetic failures.
+func (c *Conn) newTransport() (http.RoundTripper, error) {
+	t, err := c.baseTransport()
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.sniCerts && t != nil {
+		t = serverNameTransport{t}
+	}
+	rt := wrapTransport(c.opts, t)
+	if c.opts.maxRedirectBodySize > 0 {
+		rt = redirectTransport{rt: rt, max: c.opts.maxRedirectBodySize}
+	}
+	if c.opts.chaos > 0 {
+		rt = chaosTransport{rt: rt, delay: c.opts.chaosDelay}
+	}
+	return rt, nil
+}
+
+// baseTransport returns the transport for c. It is the Orchestra's transport unless
+// c has its own proxy, time to first byte timeout or host client certificate, in which
+// case a copy with them is returned.
+func (c *Conn) baseTransport() (http.RoundTripper, error) {
+	cert, hostCert := c.hostCertificate()
+	if c.proxy == "" && c.ttfb <= 0 && !hostCert {
+		if c.opts.transport == nil {
+			return nil, nil
+		}
+		return c.opts.transport, nil
+	}
+	t := c.opts.transport
+	if t == nil {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	c.opts.addTransport(t)
+	if c.proxy != "" {
+		proxy, err := parseProxy(c.proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = proxy
+	}
+	if c.ttfb > 0 {
+		t.ResponseHeaderTimeout = c.ttfb
+	}
+	if hostCert {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		// the host certificate overrides any selected by server name.
+		t.TLSClientConfig.GetClientCertificate = nil
+	}
+	return t, nil
 }
 
 // Response is a wrapper around http.Response.
 type Response struct {
 	*http.Response
-	id       string
-	err      error
-	duration time.Duration
+	id            string
+	err           error
+	timeout       string // timeout that caused err, if any
+	duration      time.Duration
+	queued        time.Duration // wait for a worker slot under the concurrency limit
+	started       time.Duration // offset from the start of the orchestration the request started at
+	warmup        time.Duration // duration of the warmup request of the host
+	chaos         string        // synthetic failure injected, empty for none
+	attempts      int           // attempts made, including retries
+	connReq       *ConnRequest  // connection request of the response
+	req           *http.Request // request sent, nil if it could not be created
+	stale         bool          // served from cache after the request failed
+	skipped       bool          // not fetched as the condition of its dependency is not met
+	cached        bool          // served from cache as HEAD found it unchanged
+	checked       bool          // expectations of the connection were checked
+	reason        string        // why expectations were not met, empty if met
+	failures      []string      // assertions of the success criteria not met
+	servedBy      string        // url that served the response, if the connection has fallbacks
+	schedule      *schedule     // scheduling by the health of the host, nil if not deferring failing hosts
+	aggregated    *float64      // number of the body aggregated in the summary, nil for none
+	encoded       *byteCounter  // encoded body of a decompressed response, nil if not decompressed
+	requestBytes  int64         // bytes of the request line, headers and body sent
+	responseBytes int64         // response body bytes read
+	stored        io.Closer     // closer removing the body from the body store, if stored
+	spooled       bool          // body read into memory or the body store
+	opts          *options      // orchestra wide settings
 }
 
 // Output returns a Json marshal friendly struct of Response for output.
 func (r *Response) output() respOutput {
 	if r.err != nil {
 		return respOutput{
-			Id:    r.id,
-			Error: r.err.Error(),
+			Id:       r.id,
+			Meta:     r.meta(),
+			Labels:   r.labels(),
+			FinalURL: r.finalURL(),
+			ServedBy: r.servedBy,
+			QueuedMs: r.queuedMs(),
+			StartMs:  r.startMs(),
+			WarmupMs: r.warmupMs(),
+			Attempts: r.attemptsMade(),
+			Request:  r.requestOutput(),
+			Schedule: r.scheduleOutput(),
+			Echo:     r.echoOutput(),
+			Chaos:    r.chaos,
+			Timeout:  r.timeout,
+			Error:    r.err.Error(),
 		}
 	}
 	return respOutput{
-		Id:         r.id,
-		StatusCode: r.StatusCode,
-		Status:     r.Status,
-		Duration:   r.durationStr(),
+		Id:          r.id,
+		Meta:        r.meta(),
+		Labels:      r.labels(),
+		StatusCode:  r.StatusCode,
+		Status:      r.Status,
+		Duration:    r.durationOutput(),
+		DurationMs:  r.durationMs(),
+		QueuedMs:    r.queuedMs(),
+		StartMs:     r.startMs(),
+		WarmupMs:    r.warmupMs(),
+		Attempts:    r.attemptsMade(),
+		Stale:       r.stale,
+		Cached:      r.cached,
+		SLABreached: r.slaBreached(),
+		OK:          r.ok(),
+		Reason:      r.reason,
+		Failures:    r.failures,
+		FinalURL:    r.finalURL(),
+		ServedBy:    r.servedBy,
+		TLS:         r.tlsOutput(),
+		Header:      r.capturedHeaders(),
+		Request:     r.requestOutput(),
+		Schedule:    r.scheduleOutput(),
+		Echo:        r.echoOutput(),
+		Chaos:       r.chaos,
+	}
+}
+
+// strippedHeaders are hop-by-hop and sensitive response headers excluded from the
+// output unless named explicitly.
+var strippedHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Set-Cookie",
+}
+
+// isStrippedHeader reports if the response header k of r is excluded from the output
+// unless named explicitly. This includes headers listed in the Connection header.
+func (r *Response) isStrippedHeader(k string) bool {
+	for _, h := range strippedHeaders {
+		if k == h {
+			return true
+		}
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(h)) == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capturedHeaders returns the response headers of r to include in the output.
+// Header names are canonical, and sorted when marshaled to Json, so the output
+// is stable for the same response.
+func (r *Response) capturedHeaders() http.Header {
+	if r.opts == nil || len(r.opts.captureHeaders) == 0 {
+		return nil
+	}
+	// headers set by a Batcher or RoundTripper may not be canonical. They are merged
+	// in sorted order so the values are in a stable order.
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	canonical := make(http.Header, len(r.Header))
+	for _, k := range keys {
+		ck := http.CanonicalHeaderKey(k)
+		canonical[ck] = append(canonical[ck], r.Header[k]...)
+	}
+	header := make(http.Header)
+	for _, k := range r.opts.captureHeaders {
+		if k == "*" {
+			for k, v := range canonical {
+				if !r.isStrippedHeader(k) {
+					header[k] = v
+				}
+			}
+			continue
+		}
+		if v, ok := canonical[k]; ok {
+			header[k] = v
+		}
+	}
+	if len(header) == 0 {
+		return nil
+	}
+	return header
+}
+
+// meta returns the metadata of the connection request of r.
+func (r *Response) meta() map[string]string {
+	if r.connReq == nil {
+		return nil
+	}
+	return r.connReq.meta
+}
+
+// labels returns the output labels of r.
+func (r *Response) labels() map[string]string {
+	if r.opts == nil {
+		return nil
+	}
+	return r.opts.labels
+}
+
+// redactedHeaders are request headers with values hidden from output.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactHeader returns a copy of h with the values of redactedHeaders hidden.
+func redactHeader(h http.Header) http.Header {
+	header := make(http.Header, len(h))
+	for k, v := range h {
+		header[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if header.Get(k) != "" {
+			header.Set(k, "REDACTED")
+		}
+	}
+	return header
+}
+
+// requestOutput returns the details of the request sent if debug is enabled.
+func (r *Response) requestOutput() *reqOutput {
+	if r.req == nil || r.opts == nil || !r.opts.debug {
+		return nil
+	}
+	return &reqOutput{
+		Method: r.req.Method,
+		URL:    r.req.URL.Redacted(),
+		Header: redactHeader(r.req.Header),
+	}
+}
+
+// finalURL returns the url finally requested for r if enabled. It is the url of the
+// last request of any redirects, or the request sent otherwise.
+func (r *Response) finalURL() string {
+	if r.opts == nil || !r.opts.finalURL {
+		return ""
+	}
+	if r.Response != nil && r.Response.Request != nil {
+		return r.Response.Request.URL.Redacted()
+	}
+	if r.req != nil {
+		return r.req.URL.Redacted()
+	}
+	return ""
+}
+
+// accountBytes includes the request and response sizes in out if summary is enabled.
+func (r *Response) accountBytes(out *respOutput) {
+	if r.opts != nil && r.opts.summary {
+		out.RequestBytes = r.requestBytes
+		out.ResponseBytes = r.transferredBytes()
 	}
 }
 
@@ -245,8 +1275,58 @@ func (r *Response) Read(p []byte) (int, error) {
 }
 
 // ReadAll reads all bytes from Response. It returns the bytes and an error if any.
+// The body is buffered so it can be read again, e.g. when writing the output.
 func (r *Response) ReadAll() ([]byte, error) {
-	return ioutil.ReadAll(r)
+	b, err := ioutil.ReadAll(r)
+	r.Body.Close()
+	var rest io.Reader = eofReader{}
+	if err != nil {
+		rest = errReader{err}
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b), rest))
+	return b, err
+}
+
+// isSuccess reports if r has a 2xx status code and met the expectations of its connection.
+func (r *Response) isSuccess() bool {
+	return r.err == nil && r.StatusCode >= 200 && r.StatusCode < 300 && r.reason == ""
+}
+
+// failed reports if r is a network error or has a 5xx status code. Skipped
+// responses have not failed.
+func (r *Response) failed() bool {
+	return !r.skipped && (r.err != nil || r.StatusCode >= 500)
+}
+
+// isFailure reports if r is not successful and not skipped, counting as failed in
+// the summary and status.
+func (r *Response) isFailure() bool {
+	return !r.skipped && !r.isSuccess()
+}
+
+// discard reads and closes the body of r if any.
+func (r *Response) discard() {
+	if r.Response == nil || r.Body == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+}
+
+// eofReader is an empty io.Reader.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// errReader is an io.Reader that always returns err.
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
 }
 
 // writeTo writes Response of delimiter type into w.
@@ -255,11 +1335,21 @@ func (resp *Response) writeTo(w io.Writer) (int, error) {
 	if r.Error != "" {
 		return resp.writeErrTo(w, r.Error)
 	}
-	_, err := w.Write([]byte(fmt.Sprintf("Id: %v, Status: %v, Duration: %v\n", r.Id, r.Status, resp.durationStr())))
+	status := fmt.Sprintf("Id: %v, Status: %v, Duration: %v", r.Id, r.Status, resp.durationStr())
+	if r.Reason != "" {
+		status += ", Reason: " + r.Reason
+	}
+	_, err := w.Write([]byte(status + "\n"))
 	if err != nil {
 		return resp.writeErrTo(w, err.Error())
 	}
-	nn, err := io.Copy(w, resp.Body)
+	nn, err := io.Copy(w, resp.bodyReader())
+	resp.responseBytes += nn
+	if isBodyReadErr(err) {
+		// report in place so other responses are still written.
+		resp.discard()
+		_, err = w.Write([]byte("\n" + err.Error()))
+	}
 	return int(nn), err
 }
 
@@ -272,14 +1362,27 @@ func (r *Response) writeErrTo(w io.Writer, err string) (int, error) {
 func (resp *Response) MarshalJSON() ([]byte, error) {
 	r := resp.output()
 	if r.Error != "" {
-		return resp.marshalErr(resp.id, r.Error)
+		return resp.marshal(r)
 	}
-	body, err := ioutil.ReadAll(resp)
+	buf := getBuffer()
+	defer putBuffer(buf, resp.maxBodySize())
+	_, err := buf.ReadFrom(resp.jsonBodyReader())
+	resp.responseBytes += int64(buf.Len())
 	if err != nil {
+		resp.discard()
 		return resp.marshalErr(resp.id, err.Error())
 	}
-	r.Body = string(body)
-	b, err := json.Marshal(r)
+	resp.extractAggregated(buf.Bytes())
+	body := resp.truncateError(buf.Bytes())
+	// an empty body was read successfully, unlike an error which omits the body too.
+	r.BodyEmpty = len(body) == 0
+	if form, ok := resp.form(body); ok {
+		r.Form = form
+	} else if err := resp.setBody(&r, body); err != nil {
+		return resp.marshalErr(resp.id, err.Error())
+	}
+	resp.accountBytes(&r)
+	b, err := resp.marshal(r)
 	if err != nil {
 		return resp.marshalErr(resp.id, err.Error())
 	}
@@ -287,19 +1390,89 @@ func (resp *Response) MarshalJSON() ([]byte, error) {
 }
 
 func (resp *Response) marshalErr(id, err string) ([]byte, error) {
-	return json.Marshal(respOutput{Id: id, Error: err})
+	return resp.marshal(respOutput{Id: id, Chaos: resp.chaos, Error: err})
 }
 
 func (r *Response) durationStr() string {
 	return fmt.Sprintf("%vms", int64(r.duration)/1e6)
 }
 
+// durationOutput returns the duration of r as a string for output, empty if it is
+// output as a number.
+func (r *Response) durationOutput() string {
+	if r.opts != nil && r.opts.durationMs {
+		return ""
+	}
+	return r.durationStr()
+}
+
+// durationMs returns the milliseconds r took if durations are output as a number,
+// nil otherwise.
+func (r *Response) durationMs() *int64 {
+	if r.opts == nil || !r.opts.durationMs {
+		return nil
+	}
+	ms := int64(r.duration / time.Millisecond)
+	return &ms
+}
+
+// slaBreached reports if r took longer than the expected maximum duration of its
+// connection, if any.
+func (r *Response) slaBreached() bool {
+	return r.connReq != nil && r.connReq.sla > 0 && r.duration > r.connReq.sla
+}
+
+// queuedMs returns the milliseconds r waited for a worker slot, nil if the
+// concurrency is not limited.
+func (r *Response) queuedMs() *int64 {
+	if r.opts == nil || r.opts.concurrency <= 0 {
+		return nil
+	}
+	ms := int64(r.queued / time.Millisecond)
+	return &ms
+}
+
 // RespOutput is an output struct suited for Json marshal
 type respOutput struct {
-	Id         string `json:"id"`
-	StatusCode int    `json:"status_code,omitempty"`
-	Status     string `json:"status,omitempty"`
-	Duration   string `json:"duration,omitempty"`
-	Body       string `json:"body,omitempty"`
-	Error      string `json:"error,omitempty"`
+	Id            string                 `json:"id"`
+	Meta          map[string]string      `json:"meta,omitempty"`
+	Labels        map[string]string      `json:"labels,omitempty"`
+	StatusCode    int                    `json:"status_code,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	Duration      string                 `json:"duration,omitempty"`
+	DurationMs    *int64                 `json:"duration_ms,omitempty"`
+	QueuedMs      *int64                 `json:"queued_ms,omitempty"`
+	StartMs       *int64                 `json:"start_ms,omitempty"`
+	WarmupMs      *int64                 `json:"warmup_ms,omitempty"`
+	Attempts      int                    `json:"attempts,omitempty"`
+	Stale         bool                   `json:"stale,omitempty"`
+	Cached        bool                   `json:"cached,omitempty"`
+	SLABreached   bool                   `json:"sla_breached,omitempty"`
+	OK            *bool                  `json:"ok,omitempty"`
+	Reason        string                 `json:"reason,omitempty"`
+	Failures      []string               `json:"failed_criteria,omitempty"`
+	FinalURL      string                 `json:"final_url,omitempty"`
+	ServedBy      string                 `json:"served_by,omitempty"`
+	File          string                 `json:"file,omitempty"`
+	TLS           *tlsOutput             `json:"tls,omitempty"`
+	Header        http.Header            `json:"headers,omitempty"`
+	RequestBytes  int64                  `json:"request_bytes,omitempty"`
+	ResponseBytes int64                  `json:"response_bytes,omitempty"`
+	Request       *reqOutput             `json:"request,omitempty"`
+	Schedule      *schedule              `json:"schedule,omitempty"`
+	Echo          *echoOutput            `json:"echo,omitempty"`
+	Chaos         string                 `json:"chaos,omitempty"`
+	BodyEncoding  string                 `json:"body_encoding,omitempty"`
+	Form          map[string]interface{} `json:"form,omitempty"`
+	Body          string                 `json:"body,omitempty"`
+	BodyEmpty     bool                   `json:"body_empty,omitempty"`
+	Timeout       string                 `json:"timeout,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+}
+
+// reqOutput is the output struct of the request sent for a connection.
+type reqOutput struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
 }
@@ -1,12 +1,34 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
-
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,14 +37,34 @@ var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK/" + r.URL.Path[1:]))
 })
 
+// checkLeaks fails t if goroutines started after the call, such as those of open
+// connections, are still running when the returned function is called. Deferred at
+// the start of a test, it runs after the test servers are closed.
+func checkLeaks(t *testing.T) func() {
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		// idle connections of the shared default transport outlive orchestrations.
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		deadline := time.Now().Add(2 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				n := runtime.Stack(buf, true)
+				t.Fatalf("goroutines grew from %d to %d\n%s", before, runtime.NumGoroutine(), buf[:n])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
 var tHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 	w.(http.Flusher).Flush()
 	time.Sleep(3 * time.Second)
 })
 
-var testResp = `{sample 200 200 OK %s  }`
-
 var orcRespJson = `[{"id":"request1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"request2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"},{"id":"request3","status_code":200,"status":"200 OK","duration":"%s","body":"OK/3"},{"id":"request4","status_code":200,"status":"200 OK","duration":"%s","body":"OK/4"},{"id":"request5","status_code":200,"status":"200 OK","duration":"%s","body":"OK/5"}]`
 
 var orcRespDelim = `Id: request1, Status: 200 OK, Duration: %s
@@ -56,7 +98,7 @@ OK/`,
 
 func TestConn(t *testing.T) {
 	testServer := httptest.NewServer(okHandler)
-	conn := NewConn(ConnRequest{"sample", testServer.URL})
+	conn := NewConn(ConnRequest{id: "sample", url: testServer.URL})
 	err := conn.Fetch()
 	if err != nil {
 		t.Fatal(err)
@@ -64,8 +106,8 @@ func TestConn(t *testing.T) {
 	if conn.Response == nil {
 		t.Fatal("conn.Response should not be nil")
 	}
-	testResp := insertDurations(testResp, conn)
-	if out := fmt.Sprint(conn.Response.output()); out != testResp {
+	testResp := respOutput{Id: "sample", StatusCode: 200, Status: "200 OK", Duration: conn.Response.durationStr()}
+	if out := conn.Response.output(); !reflect.DeepEqual(out, testResp) {
 		t.Fatalf("Expected %v found %v", testResp, out)
 	}
 	testServer.Close()
@@ -75,7 +117,7 @@ func TestOrchestra(t *testing.T) {
 	testServer := httptest.NewServer(okHandler)
 	rs := make([]ConnRequest, 5)
 	for i := 0; i < 5; i++ {
-		rs[i] = ConnRequest{fmt.Sprint("request", i+1), fmt.Sprintf("%s/%d", testServer.URL, i+1)}
+		rs[i] = ConnRequest{id: fmt.Sprint("request", i+1), url: fmt.Sprintf("%s/%d", testServer.URL, i+1)}
 	}
 	orchestra := NewOrchestra(rs...)
 	w := httptest.NewRecorder()
@@ -95,14 +137,81 @@ func TestOrchestra(t *testing.T) {
 	testServer.Close()
 }
 
+func TestEmptyOrchestra(t *testing.T) {
+	tests := []struct {
+		use      func(*Orchestra)
+		expected string
+	}{
+		{(*Orchestra).UseJson, "[]\n"},
+		{(*Orchestra).UseJSON, "[]\n"},
+		{(*Orchestra).UseDelimeter, ""},
+		{(*Orchestra).UseDelimiter, ""},
+		{(*Orchestra).UseStream, ""},
+		{func(o *Orchestra) { o.UseJson(); o.SetSummary(true) }, `{"results":[],"summary":{"count":0,"failed":0,"filtered":0,"status":"ok","request_bytes":0,"response_bytes":0}}` + "\n"},
+	}
+	for i, test := range tests {
+		orchestra := NewOrchestra()
+		test.use(orchestra)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		if w.Code != http.StatusOK || w.Body.String() != test.expected {
+			t.Fatalf("%d: expected %q found %v %q", i, test.expected, w.Code, w.Body.String())
+		}
+	}
+
+	orchestra := NewOrchestra()
+	orchestra.UseZip()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != zipManifest {
+		t.Fatalf("expected only the manifest found %v", zr.File)
+	}
+}
+
+func TestDeprecatedUseAliases(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	tests := []struct {
+		name         string
+		deprecated   func(*Orchestra)
+		use          func(*Orchestra)
+		expectedType uint8
+	}{
+		{"json", (*Orchestra).UseJson, (*Orchestra).UseJSON, typeJson},
+		{"delimiter", (*Orchestra).UseDelimeter, (*Orchestra).UseDelimiter, typeDelimiter},
+	}
+	for _, test := range tests {
+		var outputs [2]string
+		for i, use := range []func(*Orchestra){test.deprecated, test.use} {
+			orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+			orchestra.UseZip()
+			use(orchestra)
+			if orchestra.responseType != test.expectedType {
+				t.Fatalf("%v: expected type %v found %v", test.name, test.expectedType, orchestra.responseType)
+			}
+			w := httptest.NewRecorder()
+			orchestra.Process(w)
+			outputs[i] = w.Body.String()
+			outputs[i] = strings.Replace(outputs[i], orchestra.conns[0].Response.durationStr(), "", -1)
+		}
+		if outputs[0] != outputs[1] {
+			t.Fatalf("%v: expected identical outputs found %q and %q", test.name, outputs[0], outputs[1])
+		}
+	}
+}
+
 func TestOrchestraAdd(t *testing.T) {
 	testServer := httptest.NewServer(okHandler)
 	rs := make([]ConnRequest, 4)
 	for i := 0; i < 4; i++ {
-		rs[i] = ConnRequest{fmt.Sprint("request", i+1), fmt.Sprintf("%s/%d", testServer.URL, i+1)}
+		rs[i] = ConnRequest{id: fmt.Sprint("request", i+1), url: fmt.Sprintf("%s/%d", testServer.URL, i+1)}
 	}
 	orchestra := NewOrchestra(rs...)
-	orchestra.Add(ConnRequest{fmt.Sprint("request", 5), fmt.Sprintf("%s/%d", testServer.URL, 5)})
+	orchestra.Add(ConnRequest{id: fmt.Sprint("request", 5), url: fmt.Sprintf("%s/%d", testServer.URL, 5)})
 	w := httptest.NewRecorder()
 	orchestra.Process(w)
 	orcRespJson := insertDurations(orcRespJson, orchestra.conns...)
@@ -115,7 +224,7 @@ func TestTimeout(t *testing.T) {
 	tServer := httptest.NewServer(tHandler)
 	rs := make([]ConnRequest, 5)
 	for i := 0; i < 5; i++ {
-		rs[i] = ConnRequest{fmt.Sprint("request", i+1), fmt.Sprintf("%s/%d", tServer.URL, i+1)}
+		rs[i] = ConnRequest{id: fmt.Sprint("request", i+1), url: fmt.Sprintf("%s/%d", tServer.URL, i+1)}
 	}
 	orchestra := NewOrchestra(rs...)
 	orchestra.SetTimeout(2 * time.Second)
@@ -124,141 +233,4169 @@ func TestTimeout(t *testing.T) {
 	checkErrResp(t, w)
 }
 
-func TestHandler(t *testing.T) {
-	oServer := httptest.NewServer(okHandler)
-	req, err := http.NewRequest("GET", "/?requests=id1:"+oServer.URL+",id2:"+oServer.URL, nil)
-	if err != nil {
+func TestTTFB(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("OK"))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("/streamed"))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/slow", ttfb: 100 * time.Millisecond},
+		ConnRequest{id: "id2", url: testServer.URL + "/stream", ttfb: 100 * time.Millisecond},
+		ConnRequest{id: "id3", url: testServer.URL + "/stream"},
+	)
+	orchestra.SetTimeout(200 * time.Millisecond)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
 		t.Fatal(err)
 	}
-	w := httptest.NewRecorder()
-	testHandler := http.HandlerFunc(handler)
-	testHandler.ServeHTTP(w, req)
-	compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t)
+	if m[0]["timeout"] != timeoutTTFB {
+		t.Fatalf("expected ttfb timeout found %v", m[0])
+	}
+	if m[1]["body"] != "OK/streamed" {
+		t.Fatalf("expected streamed body found %v", m[1])
+	}
+	if m[2]["error"] == nil {
+		t.Fatalf("expected total timeout found %v", m[2])
+	}
 }
 
-func TestHandlerTimeout(t *testing.T) {
-	tServer := httptest.NewServer(tHandler)
-	req, err := http.NewRequest("GET", "/?timeout=2000&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
-	if err != nil {
+func TestDeadline(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("OK"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stream" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer testServer.Close()
+	deadline := time.Now().Add(150 * time.Millisecond)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/slow"},
+		ConnRequest{id: "id2", url: testServer.URL + "/stream"},
+		ConnRequest{id: "id3", url: testServer.URL + "/slow", deadline: time.Now().Add(time.Second)},
+		ConnRequest{id: "id4", url: testServer.URL + "/fast"},
+	)
+	orchestra.SetTimeout(100 * time.Millisecond)
+	orchestra.SetDeadline(deadline)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
 		t.Fatal(err)
 	}
+	if m[0]["timeout"] != timeoutDeadline {
+		t.Fatalf("expected deadline timeout found %v", m[0])
+	}
+	if expected := errDeadline(deadline).Error(); m[1]["error"] != expected {
+		t.Fatalf("expected %v found %v", expected, m[1])
+	}
+	if m[2]["body"] != "OK/slow" {
+		t.Fatalf("expected own deadline to replace the timeout found %v", m[2])
+	}
+	if m[3]["body"] != "OK/fast" {
+		t.Fatalf("expected body found %v", m[3])
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for query, code := range map[string]int{
+		"deadline=" + past:                     http.StatusOK,
+		"deadlines=a:" + past:                  http.StatusOK,
+		"deadline=tomorrow":                    http.StatusBadRequest,
+		"deadlines=a:2006-01-02":               http.StatusBadRequest,
+		"deadline=" + past + "&deadlines=a:-1": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("GET", "/?requests=a:"+testServer.URL+"/fast&"+query, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != code {
+			t.Fatalf("%v: expected %v found %v %v", query, code, w.Code, w.Body.String())
+		}
+		if code == http.StatusOK && !strings.Contains(w.Body.String(), `"timeout":"deadline"`) {
+			t.Fatalf("%v: expected deadline timeout found %v", query, w.Body.String())
+		}
+	}
+}
+
+func TestFetchPanic(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/2"})
+	orchestra.conns[0].Client = nil
 	w := httptest.NewRecorder()
-	testHandler := http.HandlerFunc(handler)
-	testHandler.ServeHTTP(w, req)
-	checkErrResp(t, w)
+	orchestra.Process(w)
+	expected := `[{"id":"id1","error":"panic: runtime error: invalid memory address or nil pointer dereference"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[1].Response.durationStr())
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
 }
 
-func TestHandlerRespJson(t *testing.T) {
-	tServer := httptest.NewServer(okHandler)
-	req, err := http.NewRequest("GET", "/?type=json&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
-	if err != nil {
+func TestBaseURL(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: "/1"})
+	orchestra.Add(ConnRequest{id: "id2", url: "/2"})
+	if err := orchestra.SetBaseURL("/relative"); err != errInvalidBaseURL {
+		t.Fatalf("expected %v found %v", errInvalidBaseURL, err)
+	}
+	if err := orchestra.SetBaseURL(testServer.URL); err != nil {
 		t.Fatal(err)
 	}
 	w := httptest.NewRecorder()
-	testHandler := http.HandlerFunc(handler)
-	testHandler.ServeHTTP(w, req)
-	if !compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t) {
-		t.Fatalf("expected %v found %v", handRespJson, w.Body.String())
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
 	}
 }
 
-func TestHandlerRespDelim(t *testing.T) {
-	tServer := httptest.NewServer(okHandler)
-	req, err := http.NewRequest("GET", "/?type=delimiter&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
-	if err != nil {
+func TestSummary(t *testing.T) {
+	defer checkLeaks(t)()
+	var mu sync.Mutex
+	sizes := make(map[string]int)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request as received is the request as sent.
+		b, _ := httputil.DumpRequest(r, false)
+		mu.Lock()
+		sizes[r.URL.Path] = len(b)
+		mu.Unlock()
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/22"})
+	orchestra.SetSummary(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `{"results":[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","request_bytes":%d,"response_bytes":4,"body":"OK/1"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","request_bytes":%d,"response_bytes":5,"body":"OK/22"}],"summary":{"count":2,"failed":0,"filtered":0,"status":"ok","request_bytes":%d,"response_bytes":9}}`
+	expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr(), sizes["/1"], orchestra.conns[1].Response.durationStr(), sizes["/22"], sizes["/1"]+sizes["/22"])
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+}
+
+func TestRequired(t *testing.T) {
+	testServer := httptest.NewServer(failHandler(1000, http.StatusInternalServerError))
+	defer testServer.Close()
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	tests := []struct {
+		required []bool
+		status   string
+	}{
+		{[]bool{false, false}, statusFailed},
+		{[]bool{true, false}, statusOK},
+		{[]bool{false, true}, statusFailed},
+	}
+	for _, test := range tests {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "ok", url: oServer.URL, required: test.required[0]},
+			ConnRequest{id: "failed", url: testServer.URL, required: test.required[1]},
+		)
+		orchestra.SetSummary(true)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var out struct{ Summary summary }
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Summary.Status != test.status || out.Summary.Failed != 1 {
+			t.Fatalf("%v: expected status %v found %v", test.required, test.status, out.Summary)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PROXY/" + r.URL.Path[1:]))
+	}))
+	defer proxyServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2", proxy: proxyDirect},
+	)
+	if err := orchestra.SetProxy("proxy"); err != errInvalidProxy {
+		t.Fatalf("expected %v found %v", errInvalidProxy, err)
+	}
+	if err := orchestra.SetProxy(proxyServer.URL); err != nil {
 		t.Fatal(err)
 	}
 	w := httptest.NewRecorder()
-	testHandler := http.HandlerFunc(handler)
-	testHandler.ServeHTTP(w, req)
-	if !compareDelimsMinusDurations(strings.TrimSpace(w.Body.String()), handRespDelim[0], defaultDelimiter, t) {
-		t.Fatalf("expected %v found %v", handRespDelim[0], w.Body.String())
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"PROXY/1"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
 	}
-	req, err = http.NewRequest("GET", "/?type=delimiter&delimiter=000000&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
-	if err != nil {
-		t.Fatal(err)
+}
+
+func TestDebug(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.conns[0].Header.Set("Authorization", "Bearer secret")
+	orchestra.conns[0].Header.Set("Accept", "text/plain")
+	orchestra.conns[0].Params["q"] = "v"
+	orchestra.SetDebug(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","request":{"method":"GET","url":"%s/1?q=v","header":{"Accept":["text/plain"],"Authorization":["REDACTED"]}},"body":"OK/1"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr(), testServer.URL)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
 	}
-	w.Body.Reset()
-	testHandler.ServeHTTP(w, req)
-	if !compareDelimsMinusDurations(strings.TrimSpace(w.Body.String()), handRespDelim[1], "\n000000\n", t) {
-		t.Fatalf("expected %v found %v", handRespDelim[1], w.Body.String())
+	if orchestra.conns[0].Header.Get("Authorization") != "Bearer secret" {
+		t.Fatal("request headers should not be modified")
 	}
 }
 
-func checkErrResp(t *testing.T, w *httptest.ResponseRecorder) {
-	var m []interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &m)
+// failHandler fails the first n requests to each path with the status code.
+func failHandler(n int, code int) http.HandlerFunc {
+	var mu sync.Mutex
+	count := make(map[string]int)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count[r.URL.Path]++
+		c := count[r.URL.Path]
+		mu.Unlock()
+		if c <= n {
+			w.WriteHeader(code)
+			w.Write([]byte("FAIL"))
+			return
+		}
+		okHandler(w, r)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(failHandler(2, http.StatusServiceUnavailable))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetRetries(1)
+	orchestra.SetRetryBackoff(time.Millisecond)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if code := orchestra.conns[0].Response.StatusCode; code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %v found %v", http.StatusServiceUnavailable, code)
+	}
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","attempts":1,"body":"OK/1"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+
+	// requests that could not be created are not retried.
+	orchestra = NewOrchestra(ConnRequest{id: "id1", url: ":invalid"})
+	orchestra.SetRetries(2)
+	orchestra.SetRetryBackoff(time.Second)
+	start := time.Now()
+	orchestra.Process(httptest.NewRecorder())
+	if r := orchestra.conns[0].Response; r.err == nil || r.attempts != 1 || time.Since(start) >= time.Second {
+		t.Fatalf("expected a single attempt found %v %v", r.attempts, r.err)
+	}
+}
+
+func TestFallbacks(t *testing.T) {
+	defer checkLeaks(t)()
+	var mu sync.Mutex
+	var requests []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path != "/secondary" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	req, err := http.NewRequest("GET", "/?requests=id1:"+testServer.URL+"/primary&fallbacks=id1:"+testServer.URL+"/standby,id1:"+testServer.URL+"/secondary", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for _, v := range m {
-		if v.(map[string]interface{})["error"] == nil {
-			t.Fatal("error expected", v)
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["status_code"] != float64(http.StatusOK) || m[0]["served_by"] != testServer.URL+"/secondary" {
+		t.Fatalf("expected response served by secondary found %v", m[0])
+	}
+	if found := strings.Join(requests, ","); found != "/primary,/standby,/secondary" {
+		t.Fatalf("expected urls tried in order found %v", found)
+	}
+
+	requests = nil
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/primary", fallbacks: []string{testServer.URL + "/secondary"}})
+	orchestra.SetRetries(1)
+	orchestra.SetRetryBackoff(0)
+	orchestra.Process(httptest.NewRecorder())
+	if r := orchestra.conns[0].Response; r.StatusCode != http.StatusOK || r.attempts != 3 {
+		t.Fatalf("expected success after 3 attempts found %v %v", r.StatusCode, r.attempts)
+	}
+	if found := strings.Join(requests, ","); found != "/primary,/primary,/secondary" {
+		t.Fatalf("expected primary retried before falling back found %v", found)
+	}
+}
+
+func TestMaxRetryDuration(t *testing.T) {
+	testServer := httptest.NewServer(failHandler(5, http.StatusServiceUnavailable))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetRetries(4)
+	orchestra.SetRetryBackoff(20 * time.Millisecond)
+	orchestra.SetMaxRetryDuration(50 * time.Millisecond)
+	start := time.Now()
+	orchestra.Process(httptest.NewRecorder())
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("expected retries within %v found %v", 50*time.Millisecond, d)
+	}
+	// waits of 20ms and 40ms exceed 50ms before the third attempt.
+	if r := orchestra.conns[0].Response; r.StatusCode != http.StatusServiceUnavailable || r.output().Attempts != 2 {
+		t.Fatalf("expected %v after 2 attempts found %v after %v", http.StatusServiceUnavailable, r.StatusCode, r.output().Attempts)
+	}
+}
+
+func TestRetryPredicate(t *testing.T) {
+	testServer := httptest.NewServer(failHandler(1, http.StatusTooManyRequests))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetRetries(1)
+	orchestra.SetRetryBackoff(time.Millisecond)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if code := orchestra.conns[0].Response.StatusCode; code != http.StatusTooManyRequests {
+		t.Fatalf("expected %v found %v", http.StatusTooManyRequests, code)
+	}
+	orchestra.SetRetryPredicate(func(r *Response) bool {
+		if r.err != nil {
+			return false
 		}
+		b, err := r.ReadAll()
+		return err == nil && string(b) == "FAIL"
+	})
+	testServer.Config.Handler = failHandler(1, http.StatusTooManyRequests)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","attempts":2,"body":"OK/1"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
 	}
 }
 
-func insertDurations(s string, conns ...*Conn) string {
-	durs := make([]interface{}, len(conns))
-	for i := range conns {
-		durs[i] = conns[i].Response.durationStr()
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, time.March, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"Sun, 01 Mar 2015 10:00:30 GMT", 30 * time.Second, true},
+		{"Sun, 01 Mar 2015 09:59:00 GMT", 0, true},
+		{"tomorrow", 0, false},
+	}
+	for _, test := range tests {
+		wait, ok := parseRetryAfter(test.value, now)
+		if wait != test.wait || ok != test.ok {
+			t.Fatalf("%v: expected %v %v found %v %v", test.value, test.wait, test.ok, wait, ok)
+		}
 	}
-	return fmt.Sprintf(s, durs...)
 }
 
-func compareJsonsMinusDuration(s, s1 []byte, t *testing.T) bool {
-	var m []interface{}
-	var m1 []interface{}
-	err := json.Unmarshal(s, &m)
-	if err != nil {
-		t.Fatal(err)
+func TestRetryAfter(t *testing.T) {
+	fail := failHandler(1, http.StatusServiceUnavailable)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		fail(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetRetries(1)
+	orchestra.SetRetryBackoff(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		orchestra.Process(httptest.NewRecorder())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retry-After should be used instead of backoff")
 	}
-	err = json.Unmarshal(s1, &m1)
+	if code := orchestra.conns[0].Response.StatusCode; code != http.StatusOK {
+		t.Fatalf("expected %v found %v", http.StatusOK, code)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/2"})
+	orchestra.SetCache(NewCache(1))
+	orchestra.SetStaleIfError(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	testServer.Config.Handler = failHandler(1, http.StatusInternalServerError)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	// only the most recent response fits in the cache
+	var stale, failed *Response
+	for _, c := range orchestra.conns {
+		if c.Response.stale {
+			stale = c.Response
+		} else {
+			failed = c.Response
+		}
+	}
+	if stale == nil || failed == nil || failed.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected one stale and one failed response found %v", w.Body.String())
+	}
+	expected := fmt.Sprintf(`{"id":"%s","status_code":200,"status":"200 OK","duration":"%s","stale":true,"body":"OK/%s"}`, stale.id, stale.durationStr(), stale.id[2:])
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Fatalf("expected %v in %v", expected, w.Body.String())
+	}
+
+	testServer.Close()
+	orchestra.SetStaleIfError(false)
+	orchestra.Process(httptest.NewRecorder())
+	if orchestra.conns[0].Response.stale || orchestra.conns[1].Response.stale {
+		t.Fatal("stale response not expected")
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	cache := NewCache(10)
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/2", noCache: true})
+	orchestra.SetCache(cache)
+	orchestra.SetStaleIfError(true)
+	orchestra.Process(httptest.NewRecorder())
+	if _, ok := cache.get(testServer.URL + "/2"); ok {
+		t.Fatal("expected no cache response cached")
+	}
+	testServer.Config.Handler = failHandler(1, http.StatusInternalServerError)
+	orchestra.Process(httptest.NewRecorder())
+	if !orchestra.conns[0].Response.stale || orchestra.conns[1].Response.stale {
+		t.Fatalf("expected only cached connection stale found %v %v", orchestra.conns[0].Response.stale, orchestra.conns[1].Response.stale)
+	}
+	testServer.Close()
+
+	req, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(m) != len(m1) {
-		t.Fatal("different json sizes")
+	req.Header.Set("Cache-Control", "max-age=0, No-Cache")
+	if !hasNoCache(req) {
+		t.Fatal("expected no-cache request")
 	}
-	keys := []string{"id", "status_code", "status", "body"}
-	for i := 0; i < len(m); i++ {
-		for _, k := range keys {
-			if m[i].(map[string]interface{})[k] != m1[i].(map[string]interface{})[k] {
-				return false
-			}
+}
+
+func TestCacheLimits(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	cache := NewCache(10)
+	cache.SetMaxBodySize(4)
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/22"})
+	orchestra.SetCache(cache)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), `"body":"OK/22"`) {
+		t.Fatalf("expected full body of uncached response found %v", w.Body.String())
+	}
+	key := cacheKey(orchestra.conns[0].Response.req)
+	if _, ok := cache.get(cacheKey(orchestra.conns[1].Response.req)); ok {
+		t.Fatal("expected body larger than the maximum not cached")
+	}
+	e, ok := cache.get(key)
+	if !ok || string(e.body) != "OK/1" {
+		t.Fatalf("expected cached body found %v", e)
+	}
+	e.header.Set("X-Path", "/changed")
+	if e, _ := cache.get(key); e.header.Get("X-Path") != "/1" {
+		t.Fatalf("expected cached header unchanged found %v", e.header)
+	}
+
+	cache.SetTTL(50 * time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := cache.get(key); ok {
+		t.Fatal("expected expired response not served")
+	}
+}
+
+func TestCacheCredentials(t *testing.T) {
+	var failing int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer testServer.Close()
+	cache := NewCache(10)
+	fetch := func(auth string) *Response {
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL})
+		orchestra.conns[0].Header.Set("Authorization", auth)
+		orchestra.SetCache(cache)
+		orchestra.SetStaleIfError(true)
+		orchestra.Process(httptest.NewRecorder())
+		return orchestra.conns[0].Response
+	}
+	fetch("Bearer a")
+	atomic.StoreInt32(&failing, 1)
+	if r := fetch("Bearer b"); r.stale || r.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the response of other credentials not served found %v %v", r.stale, r.StatusCode)
+	}
+	if r := fetch("Bearer a"); !r.stale || r.StatusCode != http.StatusOK {
+		t.Fatalf("expected the stale response of the same credentials found %v %v", r.stale, r.StatusCode)
 	}
-	return true
 }
 
-func compareDelimsMinusDurations(s, s1, delim string, t *testing.T) bool {
-	str := strings.Split(s, delim)
-	str1 := strings.Split(s1, delim)
-	equal := true
-	if len(str) != len(str1) {
-		t.Fatal("different output sizes")
+func TestMaxURLLength(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/22"})
+	orchestra.SetMaxURLLength(len(testServer.URL + "/1"))
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"id2","error":"url length %d exceeds the maximum of %d"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr(), len(testServer.URL+"/22"), len(testServer.URL+"/1"))
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
 	}
-	for i := 0; i < len(str); i++ {
-		st := strings.Split(str[i], "\n")
-		st1 := strings.Split(str1[i], "\n")
-		if len(st) != len(st1) {
-			equal = false
-			break
+}
+
+func TestKeepAlive(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"}, ConnRequest{id: "id2", url: testServer.URL + "/2", proxy: proxyDirect})
+	orchestra.SetKeepAlive(time.Second)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if orchestra.conns[0].Transport != orchestra.opts.transport {
+		t.Fatal("expected the orchestra transport")
+	}
+	orcRespJson := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"}]`
+	orcRespJson = insertDurations(orcRespJson, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != orcRespJson {
+		t.Fatalf("expected %v found %v", orcRespJson, w.Body.String())
+	}
+}
+
+func TestZip(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "../id2", url: testServer.URL + "/2"},
+		ConnRequest{id: "id3", url: "invalid"},
+		ConnRequest{id: ".._ID2", url: testServer.URL + "/4"},
+		ConnRequest{id: "manifest.json", url: testServer.URL + "/5"},
+	)
+	orchestra.UseZip()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if ct := w.Header().Get("Content-type"); ct != "application/zip" {
+		t.Fatalf("expected application/zip found %v", ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
 		}
-		for k, v := range st {
-			if k == 0 {
-				j := strings.Index(v, "Duration")
-				if st1[k][:j+1] != v[:j+1] {
-					equal = false
-					break
-				}
-				continue
-			}
-			if v != st1[k] {
-				equal = false
-				break
-			}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	if len(files) != 5 || files["id1"] != "OK/1" || files[".._id2"] != "OK/2" || files[".._ID2-2"] != "OK/4" || files["manifest-2.json"] != "OK/5" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","file":"id1"},{"id":"../id2","status_code":200,"status":"200 OK","duration":"%s","file":".._id2"},{"id":"id3","error":"Get \"invalid\": unsupported protocol scheme \"\""},{"id":".._ID2","status_code":200,"status":"200 OK","duration":"%s","file":".._ID2-2"},{"id":"manifest.json","status_code":200,"status":"200 OK","duration":"%s","file":"manifest-2.json"}]`
+	expected = insertDurations(expected, orchestra.conns[0], orchestra.conns[1], orchestra.conns[3], orchestra.conns[4])
+	if strings.TrimSpace(files[zipManifest]) != expected {
+		t.Fatalf("expected %v found %v", expected, files[zipManifest])
+	}
+
+	// bodies failing partway have no entry.
+	orchestra = NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1", maxBodySize: 2})
+	orchestra.UseZip()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	zr, err = zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != zipManifest {
+		t.Fatalf("expected only the manifest found %v", zr.File)
+	}
+	r, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"id":"id1","error":"response body exceeds the maximum size of 2 bytes"}]`; strings.TrimSpace(string(b)) != expected {
+		t.Fatalf("expected %v found %s", expected, b)
+	}
+}
+
+func TestOutputLabel(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: ":invalid"},
+	)
+	orchestra.SetOutputLabel("tenant", "acme")
+	orchestra.SetOutputLabel("env", "prod")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"tenant": "acme", "env": "prod"}
+	for _, r := range m {
+		if !reflect.DeepEqual(r["labels"], expected) {
+			t.Fatalf("expected labels %v found %v", expected, r)
+		}
+	}
+}
+
+func TestFinalURL(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new?"+r.URL.RawQuery, http.StatusFound)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/old"})
+	orchestra.conns[0].Params["q"] = "1"
+	orchestra.Process(httptest.NewRecorder())
+	if u := orchestra.conns[0].Response.output().FinalURL; u != "" {
+		t.Fatalf("final url not expected found %v", u)
+	}
+	orchestra.SetFinalURL(true)
+	orchestra.Process(httptest.NewRecorder())
+	if u := orchestra.conns[0].Response.output().FinalURL; u != testServer.URL+"/new?q=1" {
+		t.Fatalf("expected %v found %v", testServer.URL+"/new?q=1", u)
+	}
+}
+
+func TestMaxRedirectBodySize(t *testing.T) {
+	tests := []struct {
+		size   int64
+		length int64
+		read   int64
+	}{
+		{512, -1, 512},
+		{512, 512, 512},
+		{4096, -1, 1025},
+		{4096, 4096, 0},
+	}
+	for _, test := range tests {
+		body := &countingBody{r: bytes.NewReader(make([]byte, test.size))}
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: "http://example.com/redirect"})
+		orchestra.SetMaxRedirectBodySize(1024)
+		orchestra.SetRoundTripper(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path != "/redirect" {
+				return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("OK")), Request: r}, nil
+			}
+			header := http.Header{"Location": {"/final"}}
+			return &http.Response{StatusCode: http.StatusFound, Header: header, Body: body, ContentLength: test.length, Request: r}, nil
+		}))
+		orchestra.Process(httptest.NewRecorder())
+		if r := orchestra.conns[0].Response; r.err != nil || r.StatusCode != http.StatusOK {
+			t.Fatalf("%v: expected redirect followed found %v %v", test, r.StatusCode, r.err)
+		}
+		if body.n != test.read || !body.closed {
+			t.Fatalf("%v: expected %d bytes read and closed found %d %v", test, test.read, body.n, body.closed)
+		}
+	}
+}
+
+// countingBody is a response body counting the bytes read.
+type countingBody struct {
+	r      io.Reader
+	n      int64
+	closed bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestMaxBodySize(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/long"},
+	)
+	orchestra.SetMaxBodySize(4)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"id2","error":"response body exceeds the maximum size of 4 bytes"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr())
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+
+	orchestra.UseDelimeter()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.HasSuffix(w.Body.String(), "OK/l\nresponse body exceeds the maximum size of 4 bytes") {
+		t.Fatalf("expected body size error found %v", w.Body.String())
+	}
+
+	orchestra.conns[0].maxBodySize = 2
+	orchestra.conns[1].maxBodySize = 100
+	orchestra.UseJson()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	expected = `[{"id":"id1","error":"response body exceeds the maximum size of 2 bytes"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/long"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[1].Response.durationStr())
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+}
+
+func TestMaxJSONBodySize(t *testing.T) {
+	defer func(n int64) { maxJSONBodySize = n }(maxJSONBodySize)
+	maxJSONBodySize = 4
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/long"})
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), errBodyTooLarge(4).Error()) {
+		t.Fatalf("expected body size error found %v", w.Body.String())
+	}
+
+	orchestra.SetMaxBodySize(100)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), errBodyTooLarge(4).Error()) {
+		t.Fatalf("expected body size error found %v", w.Body.String())
+	}
+
+	orchestra.UseDelimeter()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.HasSuffix(w.Body.String(), "\nOK/long") || !w.Flushed {
+		t.Fatalf("expected streamed body found %v", w.Body.String())
+	}
+}
+
+func TestBodyTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("end"))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "slow", url: testServer.URL + "/slow", bodyTimeout: 50 * time.Millisecond},
+		ConnRequest{id: "fast", url: testServer.URL + "/fast", bodyTimeout: 50 * time.Millisecond},
+	)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["error"] != "body read timeout after 50ms" {
+		t.Fatalf("expected body read timeout found %v", m[0])
+	}
+	if m[1]["body"] != "startend" {
+		t.Fatalf("expected body found %v", m[1])
+	}
+}
+
+func TestBodyDeadline(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stream forever
+		for {
+			if _, err := w.Write([]byte("data")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "ttfb", url: testServer.URL, ttfb: time.Second},
+	)
+	orchestra.SetBodyDeadline(200 * time.Millisecond)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		orchestra.Process(w)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected never ending body to time out")
+	}
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["error"] != "body read timeout after 200ms" {
+		t.Fatalf("expected body read timeout found %v", m[0])
+	}
+}
+
+func TestIdleConnectionsClosed(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	// the server is left open so connections can only be closed by the client.
+	leaks := checkLeaks(t)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2", ttfb: time.Second},
+	)
+	orchestra.SetKeepAlive(time.Second)
+	orchestra.Process(httptest.NewRecorder())
+	leaks()
+}
+
+func TestSLA(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	req, err := http.NewRequest("GET", "/?sla=slow:50ms,fast:1s&requests=slow:"+testServer.URL+"/slow,fast:"+testServer.URL+"/fast", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["sla_breached"] != true || m[0]["status_code"] != float64(http.StatusOK) {
+		t.Fatalf("expected breached successful response found %v", m[0])
+	}
+	if _, ok := m[1]["sla_breached"]; ok {
+		t.Fatalf("expected sla met found %v", m[1])
+	}
+
+	req, err = http.NewRequest("GET", "/?sla=slow:50&requests=slow:"+testServer.URL+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request for sla without unit found %v", w.Code)
+	}
+}
+
+func TestErrorBodySize(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("abcdé"))
+	}))
+	defer testServer.Close()
+	tests := []struct {
+		size     int
+		expected string
+	}{
+		{0, "abcdé"},
+		{3, "abc..."},
+		{5, "abcd..."},
+		{6, "abcdé"},
+	}
+	for _, test := range tests {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "error", url: testServer.URL + "/error"},
+			ConnRequest{id: "ok", url: testServer.URL + "/ok"},
+		)
+		orchestra.SetErrorBodySize(test.size)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m[0]["body"] != test.expected || m[1]["body"] != "abcdé" {
+			t.Fatalf("%v: expected %v found %v", test.size, test.expected, m)
+		}
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 32<<10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp := &Response{
+			Response: &http.Response{StatusCode: 200, Status: "200 OK", Body: ioutil.NopCloser(bytes.NewReader(body))},
+			id:       "id",
+			opts:     &options{},
+		}
+		if _, err := resp.MarshalJSON(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCLIOutDir(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	dir := filepath.Join(t.TempDir(), "out")
+	in := "id/1:" + testServer.URL + "/1\n\nid2:" + testServer.URL + "/2,id3:invalid,id_1:" + testServer.URL + "/4\n"
+	var out bytes.Buffer
+	if err := runCLI(strings.NewReader(in), &out, dir); err != nil {
+		t.Fatal(err)
+	}
+	var manifest []respOutput
+	if err := json.Unmarshal(out.Bytes(), &manifest); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if len(manifest) != 4 || manifest[2].Error == "" || manifest[0].File != "id_1" || manifest[3].File != "id_1-2" {
+		t.Fatalf("unexpected output %v", out.String())
+	}
+	for name, body := range map[string]string{"id_1": "OK/1", "id2": "OK/2", "id_1-2": "OK/4"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Fatalf("expected %v found %s", body, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "id3")); !os.IsNotExist(err) {
+		t.Fatal("file not expected for failed request")
+	}
+}
+
+func TestTokenProvider(t *testing.T) {
+	var fetches int
+	var mu sync.Mutex
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer testServer.Close()
+
+	var requests []ConnRequest
+	for i := 0; i < 5; i++ {
+		requests = append(requests, ConnRequest{id: fmt.Sprint(i), url: testServer.URL})
+	}
+	orchestra := NewOrchestra(requests...)
+	orchestra.SetTokenProvider(NewTokenProvider(tokenServer.URL, "id", "secret"))
+	orchestra.Process(httptest.NewRecorder())
+	orchestra.UseDelimeter()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if n := strings.Count(w.Body.String(), "Bearer token"); n != 5 {
+		t.Fatalf("expected 5 bearer tokens found %d in %v", n, w.Body.String())
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 token fetch found %d", fetches)
+	}
+	if orchestra.conns[0].Header.Get("Authorization") != "" {
+		t.Fatal("connection header not expected to change")
+	}
+
+	orchestra.SetTokenProvider(NewTokenProvider(tokenServer.URL, "id", "wrong"))
+	orchestra.UseJson()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	checkErrResp(t, w)
+
+	// tokens are only sent to the hosts of the provider.
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer otherServer.Close()
+	provider := NewTokenProvider(tokenServer.URL, "id", "secret")
+	provider.SetHosts(strings.ToUpper(strings.TrimPrefix(testServer.URL, "http://")))
+	orchestra = NewOrchestra(ConnRequest{id: "id1", url: testServer.URL}, ConnRequest{id: "id2", url: otherServer.URL})
+	orchestra.SetTokenProvider(provider)
+	orchestra.UseDelimeter()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if found := w.Body.String(); !strings.Contains(found, "Bearer token") || strings.Count(found, "Bearer") != 1 {
+		t.Fatalf("expected a token for the allowed host only found %v", found)
+	}
+	if found := orchestra.conns[1].Response.req.Header.Get("Authorization"); found != "" {
+		t.Fatalf("expected no token for other hosts found %v", found)
+	}
+}
+
+func TestTokenExpiryMargin(t *testing.T) {
+	tests := []struct {
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{time.Hour, tokenExpiryMargin},
+		{20 * time.Second, tokenExpiryMargin},
+		{10 * time.Second, 5 * time.Second},
+		{time.Second, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if found := expiryMargin(test.ttl); found != test.expected {
+			t.Fatalf("%v: expected %v found %v", test.ttl, test.expected, found)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/slow"},
+		ConnRequest{id: "id2", url: testServer.URL + "/fast"},
+		ConnRequest{id: "id3", url: ":invalid"},
+	)
+	orchestra.UseStream()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], `"id":"id1"`) {
+		t.Fatalf("expected slow response last found %v", w.Body.String())
+	}
+	trailer := w.Result().Trailer
+	if trailer.Get(trailerCount) != "3" || trailer.Get(trailerFailed) != "1" || trailer.Get(trailerStatus) != statusFailed {
+		t.Fatalf("unexpected trailers %v", trailer)
+	}
+	if trailer.Get(trailerDuration) == "" {
+		t.Fatal("expected duration trailer")
+	}
+}
+
+func TestStreamInputOrder(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/slow"},
+		ConnRequest{id: "id2", url: testServer.URL + "/fast"},
+		ConnRequest{id: "id3", url: ":invalid"},
+	)
+	orchestra.UseStream()
+	orchestra.SetStreamInputOrder(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 responses found %v", w.Body.String())
+	}
+	for i, line := range lines {
+		if id := fmt.Sprintf(`"id":"id%d"`, i+1); !strings.Contains(line, id) {
+			t.Fatalf("expected %v at %d found %v", id, i, line)
+		}
+	}
+	if trailer := w.Result().Trailer; trailer.Get(trailerCount) != "3" {
+		t.Fatalf("unexpected trailers %v", trailer)
+	}
+
+	for query, code := range map[string]int{"input": http.StatusOK, "completion": http.StatusOK, "fastest": http.StatusBadRequest} {
+		req := httptest.NewRequest("GET", "/?type=stream&stream_order="+query+"&requests=a:"+testServer.URL+"/slow,b:"+testServer.URL+"/fast", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != code {
+			t.Fatalf("%v: expected %v found %v", query, code, w.Code)
+		}
+		if code != http.StatusOK {
+			if body := strings.TrimSpace(w.Body.String()); body != badRequestOrderMsg {
+				t.Fatalf("%v: expected %v found %v", query, badRequestOrderMsg, body)
+			}
+			continue
+		}
+		first := `"id":"b"`
+		if query == "input" {
+			first = `"id":"a"`
+		}
+		if !strings.HasPrefix(w.Body.String(), "{"+first) {
+			t.Fatalf("%v: expected %v first found %v", query, first, w.Body.String())
+		}
+	}
+
+	conns := []*Conn{{}, {}, {}, {}}
+	buf := newReorderBuffer(conns)
+	if released := buf.add(conns[1]); len(released) != 0 {
+		t.Fatalf("expected none released found %v", released)
+	}
+	if released := buf.add(conns[0]); len(released) != 2 || released[0] != conns[0] || released[1] != conns[1] {
+		t.Fatalf("expected first two released found %v", released)
+	}
+	buf.add(conns[3])
+	if released := buf.flush(); len(released) != 1 || released[0] != conns[3] {
+		t.Fatalf("expected last released found %v", released)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/ok"},
+		ConnRequest{id: "id2", url: testServer.URL + "/fail"},
+		ConnRequest{id: "id3", url: ":invalid"},
+	)
+	orchestra.UseSplit()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if ct := w.Header().Get("Content-type"); ct != "application/json" {
+		t.Fatalf("expected json content type found %v", ct)
+	}
+	var out struct {
+		Results map[string]respOutput `json:"results"`
+		Errors  map[string]respOutput `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Results) != 1 || out.Results["id1"].StatusCode != http.StatusOK {
+		t.Fatalf("expected id1 in results found %v", w.Body.String())
+	}
+	if len(out.Errors) != 2 || out.Errors["id2"].StatusCode != http.StatusInternalServerError || out.Errors["id3"].Error == "" {
+		t.Fatalf("expected id2 and id3 in errors found %v", w.Body.String())
+	}
+
+	orchestra = NewOrchestra()
+	orchestra.UseSplit()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if found := strings.TrimSpace(w.Body.String()); found != `{"results":{},"errors":{}}` {
+		t.Fatalf("expected empty results and errors found %v", found)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	tests := []struct {
+		conns   []ConnRequest
+		code    int
+		healthy bool
+	}{
+		{[]ConnRequest{{id: "id1", url: testServer.URL + "/ok"}, {id: "id2", url: testServer.URL + "/ok"}}, http.StatusOK, true},
+		{[]ConnRequest{{id: "id1", url: testServer.URL + "/ok"}, {id: "id2", url: testServer.URL + "/fail"}}, http.StatusServiceUnavailable, false},
+		{[]ConnRequest{{id: "id1", url: testServer.URL + "/ok", required: true}, {id: "id2", url: testServer.URL + "/fail"}}, http.StatusOK, true},
+		{[]ConnRequest{{id: "id1", url: testServer.URL + "/ok", criteria: &Criteria{BodyContains: "healthy"}}}, http.StatusServiceUnavailable, false},
+	}
+	for i, test := range tests {
+		orchestra := NewOrchestra(test.conns...)
+		orchestra.UseHealth()
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		expected := fmt.Sprintf(`{"healthy":%v}`, test.healthy)
+		if w.Code != test.code || strings.TrimSpace(w.Body.String()) != expected {
+			t.Fatalf("%d: expected %v %v found %v %v", i, test.code, expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.Organization[0]))
+	}))
+	testServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	testServer.StartTLS()
+	defer testServer.Close()
+	roots := testServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	orchestra := NewOrchestra(
+		ConnRequest{id: "ip", url: testServer.URL},
+		ConnRequest{id: "example", url: strings.Replace(testServer.URL, "127.0.0.1", "example.com", 1)},
+	)
+	orchestra.transport().TLSClientConfig = &tls.Config{RootCAs: roots}
+	// example.com resolves to the test server, its certificate is valid for it.
+	orchestra.transport().DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, testServer.Listener.Addr().String())
+	}
+	orchestra.SetClientCertificate(testCertificate(t, "orchestra"))
+	orchestra.SetHostClientCertificate("example.com", testCertificate(t, "host"))
+	orchestra.UseDelimeter()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := "Id: ip, Status: 200 OK, Duration: %s\norchestra" + defaultDelimiter + "Id: example, Status: 200 OK, Duration: %s\nhost"
+	expected = insertDurations(expected, orchestra.conns...)
+	if w.Body.String() != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+}
+
+func TestServerNameClientCertificates(t *testing.T) {
+	var testServer *httptest.Server
+	testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, strings.Replace(testServer.URL, "127.0.0.1", "api.example.org", 1), http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.Organization[0]))
+	}))
+	testServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	orchestra := NewOrchestra(
+		ConnRequest{id: "ip", url: testServer.URL},
+		ConnRequest{id: "example", url: strings.Replace(testServer.URL, "127.0.0.1", "example.com", 1)},
+		ConnRequest{id: "wildcard", url: strings.Replace(testServer.URL, "127.0.0.1", "api.example.org", 1)},
+		ConnRequest{id: "redirect", url: strings.Replace(testServer.URL, "127.0.0.1", "EXAMPLE.com", 1) + "/redirect"},
+	)
+	// the names resolve to the test server, its certificate is not valid for all.
+	orchestra.transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	orchestra.transport().DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, testServer.Listener.Addr().String())
+	}
+	orchestra.SetClientCertificate(testCertificate(t, "orchestra"))
+	orchestra.SetServerNameClientCertificates(map[string]tls.Certificate{
+		"example.com":   testCertificate(t, "sni"),
+		"*.example.org": testCertificate(t, "wildcard"),
+	})
+	orchestra.UseDelimiter()
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := "Id: ip, Status: 200 OK, Duration: %s\norchestra" + defaultDelimiter +
+		"Id: example, Status: 200 OK, Duration: %s\nsni" + defaultDelimiter +
+		"Id: wildcard, Status: 200 OK, Duration: %s\nwildcard" + defaultDelimiter +
+		"Id: redirect, Status: 200 OK, Duration: %s\nwildcard"
+	expected = insertDurations(expected, orchestra.conns...)
+	if w.Body.String() != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+	if n := len(orchestra.opts.transports); n != 0 {
+		t.Fatalf("expected the transport to be shared found %v copies", n)
+	}
+}
+
+func TestTLSInfo(t *testing.T) {
+	defer checkLeaks(t)()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer plainServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "https", url: tlsServer.URL}, ConnRequest{id: "http", url: plainServer.URL})
+	orchestra.transport().TLSClientConfig = tlsServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	orchestra.SetTLSInfo(true)
+	orchestra.Process(httptest.NewRecorder())
+	cert := tlsServer.Certificate()
+	expected := &tlsOutput{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		NotAfter: cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+	if found := orchestra.conns[0].Response.output().TLS; !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected %+v found %+v", expected, found)
+	}
+	if found := orchestra.conns[1].Response.output().TLS; found != nil {
+		t.Fatalf("expected no tls for http found %+v", found)
+	}
+
+	orchestra.SetTLSInfo(false)
+	orchestra.Process(httptest.NewRecorder())
+	if found := orchestra.conns[0].Response.output().TLS; found != nil {
+		t.Fatalf("expected no tls when disabled found %+v", found)
+	}
+}
+
+// testCertificate creates a self signed certificate for organization.
+func testCertificate(t *testing.T, organization string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{organization}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAudit(t *testing.T) {
+	testServer := httptest.NewServer(failHandler(1, http.StatusInternalServerError))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1?api_key=secret&q=1"})
+	orchestra.SetRetries(1)
+	orchestra.SetRetryBackoff(time.Millisecond)
+	orchestra.SetName("run1")
+	var buf bytes.Buffer
+	orchestra.SetAudit(NewAuditWriter(&buf))
+	orchestra.Process(httptest.NewRecorder())
+	var records []AuditRecord
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var r AuditRecord
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].Status != http.StatusInternalServerError || records[1].Status != http.StatusOK {
+		t.Fatalf("expected a record per attempt found %v", records)
+	}
+	if u := testServer.URL + "/1?api_key=REDACTED&q=1"; records[0].URL != u || records[0].Method != "GET" || records[0].Id != "id1" || records[0].Name != "run1" {
+		t.Fatalf("expected %v found %v", u, records[0])
+	}
+}
+
+func TestAuditBodies(t *testing.T) {
+	body := `{"error":"denied","api_key":"s3cr\"et","token":12345}`
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		w.Write([]byte(body))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "fail", url: testServer.URL + "/fail"},
+		ConnRequest{id: "ok", url: testServer.URL + "/ok"},
+	)
+	var mu sync.Mutex
+	records := make(map[string]AuditRecord)
+	orchestra.SetAudit(func(r AuditRecord) {
+		mu.Lock()
+		records[r.Id] = r
+		mu.Unlock()
+	})
+	orchestra.SetAuditBodies(auditBodyFilter("failed"), 40)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `{"error":"denied","api_key":"REDACTED","`
+	if records["fail"].Body != expected {
+		t.Fatalf("expected %v found %v", expected, records["fail"].Body)
+	}
+	if records["ok"].Body != "" {
+		t.Fatalf("expected no body found %v", records["ok"].Body)
+	}
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["body"] != body {
+		t.Fatalf("expected output body %v found %v", body, m[0]["body"])
+	}
+
+	expected = `{"error":"denied","api_key":"REDACTED","token":REDACTED}`
+	if found := redactBody([]byte(body)); found != expected {
+		t.Fatalf("expected %v found %v", expected, found)
+	}
+	if found := redactBody([]byte("a=1&secret=2&b=3")); found != "a=1&secret=REDACTED&b=3" {
+		t.Fatalf("expected form redacted found %v", found)
+	}
+}
+
+func TestCaptureHeaders(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("X-Custom", "custom")
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetCaptureHeaders("etag", "last-modified")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","headers":{"Etag":["\"abc\""]},"body":"OK/1"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+
+	orchestra.SetCaptureHeaders("*")
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	for _, h := range []string{"Etag", "X-Custom", "Content-Type", "Date"} {
+		if !strings.Contains(w.Body.String(), `"`+h+`":`) {
+			t.Fatalf("expected %v header in %v", h, w.Body.String())
+		}
+	}
+}
+
+func TestCapturedHeadersStable(t *testing.T) {
+	resp := &Response{
+		Response: &http.Response{Header: http.Header{
+			"x-b":    {"1"},
+			"X-A":    {"2"},
+			"X-B":    {"3"},
+			"Etag":   {"4"},
+			"x-c":    {"5", "6"},
+			"Date":   {"7"},
+			"Server": {"8"},
+		}},
+		opts: &options{captureHeaders: []string{"*"}},
+	}
+	expected := `{"Date":["7"],"Etag":["4"],"Server":["8"],"X-A":["2"],"X-B":["3","1"],"X-C":["5","6"]}`
+	for i := 0; i < 10; i++ {
+		b, err := json.Marshal(resp.capturedHeaders())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("expected %v found %s", expected, b)
+		}
+	}
+	resp.opts.captureHeaders = []string{"X-C"}
+	if v := resp.capturedHeaders()["X-C"]; !reflect.DeepEqual(v, []string{"5", "6"}) {
+		t.Fatalf("expected non canonical header found %v", v)
+	}
+}
+
+func TestStrippedHeaders(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Custom", "custom")
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetCaptureHeaders("*")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	for _, h := range []string{"Connection", "X-Hop", "Keep-Alive", "Set-Cookie"} {
+		if strings.Contains(w.Body.String(), `"`+h+`":`) {
+			t.Fatalf("unexpected %v header in %v", h, w.Body.String())
+		}
+	}
+	if !strings.Contains(w.Body.String(), `"X-Custom":`) {
+		t.Fatalf("expected X-Custom header in %v", w.Body.String())
+	}
+
+	orchestra.SetCaptureHeaders("*", "set-cookie")
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), `"Set-Cookie":["session=secret"]`) {
+		t.Fatalf("expected Set-Cookie header in %v", w.Body.String())
+	}
+}
+
+// concurrencyHandler records the maximum number of concurrent requests.
+type concurrencyHandler struct {
+	mu      sync.Mutex
+	active  int
+	maximum int
+}
+
+func (h *concurrencyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.active++
+	if h.active > h.maximum {
+		h.maximum = h.active
+	}
+	h.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	h.mu.Lock()
+	h.active--
+	h.mu.Unlock()
+	okHandler(w, r)
+}
+
+func TestConcurrency(t *testing.T) {
+	h := &concurrencyHandler{}
+	testServer := httptest.NewServer(h)
+	defer testServer.Close()
+	rs := make([]ConnRequest, 10)
+	for i := range rs {
+		rs[i] = ConnRequest{id: fmt.Sprint("request", i+1), url: fmt.Sprintf("%s/%d", testServer.URL, i+1)}
+	}
+	orchestra := NewOrchestra(rs...)
+	orchestra.SetConcurrency(2)
+	orchestra.Process(httptest.NewRecorder())
+	if h.maximum != 2 {
+		t.Fatalf("expected maximum concurrency %v found %v", 2, h.maximum)
+	}
+	queued := 0
+	for _, c := range orchestra.conns {
+		if c.Response.StatusCode != http.StatusOK {
+			t.Fatalf("expected %v found %v", http.StatusOK, c.Response.StatusCode)
+		}
+		if *c.Response.output().QueuedMs >= 20 {
+			queued++
+		}
+	}
+	if queued != 8 {
+		t.Fatalf("expected %v queued requests found %v", 8, queued)
+	}
+
+	orchestra = NewOrchestra(rs[0])
+	orchestra.Process(httptest.NewRecorder())
+	if q := orchestra.conns[0].Response.output().QueuedMs; q != nil {
+		t.Fatalf("expected no queued_ms found %v", *q)
+	}
+}
+
+func TestMaxFetches(t *testing.T) {
+	SetMaxFetches(3)
+	defer SetMaxFetches(0)
+	h := &concurrencyHandler{}
+	testServer := httptest.NewServer(h)
+	defer testServer.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		rs := make([]ConnRequest, 4)
+		for j := range rs {
+			rs[j] = ConnRequest{id: fmt.Sprint("request", j+1), url: fmt.Sprintf("%s/%d", testServer.URL, j+1)}
+		}
+		orchestra := NewOrchestra(rs...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			orchestra.Process(httptest.NewRecorder())
+		}()
+	}
+	wg.Wait()
+	if h.maximum != 3 {
+		t.Fatalf("expected maximum concurrency %v found %v", 3, h.maximum)
+	}
+}
+
+func TestOverload(t *testing.T) {
+	setMaxOrchestrations(1)
+	defer setMaxOrchestrations(0)
+	defer func(status int, body string) {
+		*overloadStatus, *overloadBody = status, body
+	}(*overloadStatus, *overloadBody)
+	*overloadStatus = http.StatusTooManyRequests
+	*overloadBody = `{"error":"overloaded"}`
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := limitOrchestrations(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	go h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected overload response found %v %v", w.Code, w.Header())
+	}
+	if w.Body.String() != `{"error":"overloaded"}` {
+		t.Fatalf("expected overload body found %s", w.Body.String())
+	}
+	close(release)
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	l := &limiter{limit: 4, adaptive: true, max: 6}
+	ok := func(d time.Duration) *Response {
+		return &Response{Response: &http.Response{StatusCode: 200}, duration: d}
+	}
+	steps := []struct {
+		resp  *Response
+		limit int
+	}{
+		{ok(10 * time.Millisecond), 5},
+		{ok(15 * time.Millisecond), 6},
+		{ok(10 * time.Millisecond), 6},
+		{ok(30 * time.Millisecond), 3},
+		{&Response{err: errTimeout}, 1},
+		{&Response{Response: &http.Response{StatusCode: 503}}, 1},
+		{ok(5 * time.Millisecond), 2},
+	}
+	for i, step := range steps {
+		l.adjust(step.resp)
+		if l.limit != step.limit {
+			t.Fatalf("step %d: expected limit %v found %v", i, step.limit, l.limit)
+		}
+	}
+}
+
+func TestRamp(t *testing.T) {
+	l := &limiter{limit: 4, rampStart: 1, ramp: 300 * time.Millisecond, rampFrom: time.Now().Add(-150 * time.Millisecond)}
+	if n, next := l.current(); n != 2 || next <= 0 || next > 50*time.Millisecond {
+		t.Fatalf("expected limit 2 increasing within 50ms found %v in %v", n, next)
+	}
+	l.rampFrom = time.Now().Add(-time.Second)
+	if n, next := l.current(); n != 4 || next != 0 {
+		t.Fatalf("expected limit 4 found %v in %v", n, next)
+	}
+
+	defer checkLeaks(t)()
+	h := &concurrencyHandler{}
+	testServer := httptest.NewServer(h)
+	defer testServer.Close()
+	rs := make([]ConnRequest, 6)
+	for i := range rs {
+		rs[i] = ConnRequest{id: fmt.Sprint("request", i+1), url: fmt.Sprintf("%s/%d", testServer.URL, i+1)}
+	}
+	orchestra := NewOrchestra(rs...)
+	orchestra.SetConcurrency(4)
+	orchestra.SetRamp(1, 300*time.Millisecond)
+	orchestra.SetSummary(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if h.maximum > 4 {
+		t.Fatalf("expected maximum concurrency %v found %v", 4, h.maximum)
+	}
+	// only one request is allowed until the first completes or the ramp increases.
+	early := 0
+	for _, c := range orchestra.conns {
+		if c.Response.started < 20*time.Millisecond {
+			early++
+		}
+	}
+	if early != 1 {
+		t.Fatalf("expected %v request started before 20ms found %v", 1, early)
+	}
+	var out struct {
+		Summary summary `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := []rampStep{{0, 1}, {100, 2}, {200, 3}, {300, 4}}
+	if !reflect.DeepEqual(out.Summary.Ramp, expected) {
+		t.Fatalf("expected ramp %v found %v", expected, out.Summary.Ramp)
+	}
+
+	orchestra.SetAdaptiveConcurrency(1, 4)
+	if s := orchestra.rampSchedule(); s != nil {
+		t.Fatalf("expected no ramp with adaptive concurrency found %v", s)
+	}
+}
+
+func TestDeferFailingHosts(t *testing.T) {
+	defer checkLeaks(t)()
+	failing := httptest.NewServer(failHandler(10, http.StatusServiceUnavailable))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer healthy.Close()
+	hostStats.record(failing.URL, true)
+	hostStats.record(healthy.URL, false)
+	defer func() {
+		hostStats.mu.Lock()
+		delete(hostStats.hosts, failing.URL)
+		delete(hostStats.hosts, healthy.URL)
+		hostStats.mu.Unlock()
+	}()
+
+	rs := []ConnRequest{{id: "bad", url: failing.URL}}
+	for i := 1; i <= 3; i++ {
+		rs = append(rs, ConnRequest{id: fmt.Sprint("good", i), url: fmt.Sprintf("%s/%d", healthy.URL, i)})
+	}
+	orchestra := NewOrchestra(rs...)
+	orchestra.SetConcurrency(1)
+	orchestra.SetDeferFailingHosts(true)
+	orchestra.SetDebug(true)
+	orchestra.Process(httptest.NewRecorder())
+	bad := orchestra.conns[0].Response
+	for _, c := range orchestra.conns[1:] {
+		if c.Response.started > bad.started {
+			t.Fatalf("expected %v to start before the failing host", c.id)
+		}
+		if s := c.Response.output().Schedule; s == nil || s.Deferred || s.HostRequests != 1 {
+			t.Fatalf("expected %v not deferred found %+v", c.id, s)
+		}
+	}
+	expected := &schedule{Host: failing.URL, Deferred: true, HostFailures: 1, HostRequests: 1}
+	if s := bad.output().Schedule; !reflect.DeepEqual(s, expected) {
+		t.Fatalf("expected schedule %+v found %+v", expected, s)
+	}
+	if f, n := hostStats.stats(failing.URL); f != 2 || n != 2 {
+		t.Fatalf("expected 2 of 2 failures found %v of %v", f, n)
+	}
+	if f, n := hostStats.stats(healthy.URL); f != 0 || n != 4 {
+		t.Fatalf("expected 0 of 4 failures found %v of %v", f, n)
+	}
+
+	orchestra.SetDebug(false)
+	orchestra.Process(httptest.NewRecorder())
+	if s := orchestra.conns[0].Response.output().Schedule; s != nil {
+		t.Fatalf("expected no schedule without debug found %+v", s)
+	}
+}
+
+func TestHostHealthPrune(t *testing.T) {
+	h := &hostHealth{hosts: make(map[string][]hostOutcome)}
+	h.hosts["http://old"] = []hostOutcome{{at: time.Now().Add(-2 * hostFailureWindow), failed: true}}
+	h.hosts["http://recent"] = []hostOutcome{{at: time.Now(), failed: true}}
+	h.record("http://new", false)
+	if _, ok := h.hosts["http://old"]; ok || len(h.hosts) != 2 {
+		t.Fatalf("expected hosts without recent requests removed found %v", h.hosts)
+	}
+	// pruned at most once per window.
+	h.hosts["http://old"] = []hostOutcome{{at: time.Now().Add(-2 * hostFailureWindow), failed: true}}
+	h.record("http://new", false)
+	if _, ok := h.hosts["http://old"]; !ok {
+		t.Fatal("expected hosts kept until the next window")
+	}
+}
+
+func TestStagger(t *testing.T) {
+	var starts []time.Time
+	var mu sync.Mutex
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL},
+		ConnRequest{id: "id2", url: testServer.URL},
+		ConnRequest{id: "id3", url: testServer.URL, delay: 100 * time.Millisecond},
+	)
+	orchestra.SetStagger(50 * time.Millisecond)
+	start := time.Now()
+	orchestra.Process(httptest.NewRecorder())
+	if len(starts) != 3 {
+		t.Fatalf("expected 3 requests found %d", len(starts))
+	}
+	if d := starts[1].Sub(starts[0]); d < 40*time.Millisecond {
+		t.Fatalf("expected staggered requests found %v apart", d)
+	}
+	if d := starts[2].Sub(start); d < 200*time.Millisecond {
+		t.Fatalf("expected delayed request found %v after start", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	defer func(f func(int64) int64) { jitterInt63n = f }(jitterInt63n)
+	var mu sync.Mutex
+	var calls int64
+	jitterInt63n = func(n int64) int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return n / 2 * (calls - 1)
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL},
+		ConnRequest{id: "id2", url: testServer.URL},
+	)
+	orchestra.SetJitter(100 * time.Millisecond)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := m[0]["start_ms"].(float64); !ok || s >= 40 {
+		t.Fatalf("expected unjittered start found %v", m[0])
+	}
+	if s, ok := m[1]["start_ms"].(float64); !ok || s < 50 {
+		t.Fatalf("expected jittered start found %v", m[1])
+	}
+}
+
+func TestChaos(t *testing.T) {
+	defer checkLeaks(t)()
+	defer func(f func(int) int) { chaosIntn = f }(chaosIntn)
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	tests := []struct {
+		fault    int
+		expected string
+	}{
+		{0, `"status_code":200,"status":"200 OK","duration":"%s","chaos":"delay","body":"OK/id1"`},
+		{1, `"chaos":"error","error":"Get \"%s/id1\": chaos: injected failure"`},
+		{2, `"chaos":"truncate","error":"unexpected EOF"`},
+	}
+	for _, test := range tests {
+		fault := test.fault
+		chaosIntn = func(n int) int {
+			if n == 100 {
+				return 0
+			}
+			return fault
+		}
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/id1"})
+		if err := orchestra.SetChaos(100, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		expected := test.expected
+		switch test.fault {
+		case 0:
+			if d := orchestra.conns[0].Response.duration; d < 50*time.Millisecond {
+				t.Fatalf("expected delayed request found %v", d)
+			}
+			expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr())
+		case 1:
+			expected = fmt.Sprintf(expected, testServer.URL)
+		}
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("%d: expected %v found %v", test.fault, expected, w.Body.String())
+		}
+	}
+
+	chaosIntn = func(n int) int { return n - 1 }
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/id1"})
+	orchestra.SetChaos(99, 0)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if strings.Contains(w.Body.String(), "chaos") {
+		t.Fatalf("expected no chaos found %v", w.Body.String())
+	}
+	for _, percent := range []int{-1, 101} {
+		if err := orchestra.SetChaos(percent, 0); err == nil {
+			t.Fatalf("%d: expected an error", percent)
+		}
+	}
+
+	chaosIntn = func(n int) int { return 1 % n }
+	for _, test := range []struct {
+		enabled bool
+		query   string
+		code    int
+	}{
+		{false, "chaos=100", http.StatusBadRequest},
+		{true, "chaos=100", http.StatusOK},
+		{true, "chaos=101", http.StatusBadRequest},
+		{true, "chaos=x", http.StatusBadRequest},
+	} {
+		*chaosEnabled = test.enabled
+		req := httptest.NewRequest("GET", "/?requests=a:"+testServer.URL+"/a&"+test.query, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v %v: expected %v found %v", test.enabled, test.query, test.code, w.Code)
+		}
+		if test.code == http.StatusOK && !strings.Contains(w.Body.String(), `"chaos":"error"`) {
+			t.Fatalf("%v: expected injected error found %v", test.query, w.Body.String())
+		}
+	}
+	*chaosEnabled = false
+}
+
+func TestHeartbeat(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/1"})
+	orchestra.SetHeartbeat(20 * time.Millisecond)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.HasPrefix(w.Body.String(), "\n\n") {
+		t.Fatalf("expected heartbeats found %q", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-type"); ct != "application/json" {
+		t.Fatalf("expected application/json found %v", ct)
+	}
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+}
+
+func TestOnlyFailed(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2"},
+		ConnRequest{id: "id3", url: "invalid"},
+	)
+	orchestra.SetOnlyFailed(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id2","status_code":404,"status":"404 Not Found","duration":"%s","body":"OK/2"},{"id":"id3","error":"Get \"invalid\": unsupported protocol scheme \"\""}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[1].Response.durationStr())
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+}
+
+func TestAllFiltered(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	newOrchestra := func() *Orchestra {
+		o := NewOrchestra(
+			ConnRequest{id: "id1", url: testServer.URL + "/1"},
+			ConnRequest{id: "id2", url: testServer.URL + "/2"},
+		)
+		o.SetOnlyFailed(true)
+		return o
+	}
+
+	orchestra := newOrchestra()
+	orchestra.SetSummary(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `{"results":[],"summary":{"count":0,"failed":0,"filtered":2,"status":"ok","request_bytes":0,"response_bytes":0}}`
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v %v", expected, w.Code, w.Body.String())
+	}
+
+	orchestra = newOrchestra()
+	orchestra.SetNoContentIfFiltered(true)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("expected %v found %v %v", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	orchestra = NewOrchestra()
+	orchestra.SetOnlyFailed(true)
+	orchestra.SetNoContentIfFiltered(true)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected empty output found %v %v", w.Code, w.Body.String())
+	}
+}
+
+// countingStore is a BodyStore counting the bodies stored.
+type countingStore struct {
+	BodyStore
+	n int32
+}
+
+func (s *countingStore) Store(body io.Reader) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.n, 1)
+	return s.BodyStore.Store(body)
+}
+
+func TestBodyStore(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	defer testServer.Close()
+	dir, err := ioutil.TempDir("", "orchestra-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "small", url: testServer.URL + "/1"},
+		ConnRequest{id: "large", url: testServer.URL + "/12345678"},
+		ConnRequest{id: "limited", url: testServer.URL + "/123456789012", maxBodySize: 10},
+	)
+	store := &countingStore{BodyStore: TempFileStore{Dir: dir}}
+	orchestra.SetBodyStore(store, 4)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["body"] != "xx" || m[1]["body"] != "xxxxxxxxx" {
+		t.Fatalf("unexpected response %v", w.Body.String())
+	}
+	if m[2]["error"] != errBodyTooLarge(10).Error() {
+		t.Fatalf("expected error %v found %v", errBodyTooLarge(10), m[2])
+	}
+	if n := atomic.LoadInt32(&store.n); n != 2 {
+		t.Fatalf("expected 2 bodies stored found %v", n)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected stored bodies removed found %v", files)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/invalid" {
+			w.Write([]byte{'a', 0xff})
+			return
+		}
+		w.Write([]byte("é"))
+	}))
+	defer testServer.Close()
+	tests := []struct {
+		h        InvalidUTF8
+		expected string
+	}{
+		{UTF8Replace, "\"body\":\"a\uFFFD\""},
+		{UTF8Base64, `"body_encoding":"base64","body":"Yf8="`},
+		{UTF8Error, `"error":"` + errInvalidUTF8.Error() + `"`},
+	}
+	for _, test := range tests {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "valid", url: testServer.URL + "/valid"},
+			ConnRequest{id: "invalid", url: testServer.URL + "/invalid"},
+		)
+		orchestra.SetInvalidUTF8(test.h)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(m[0]), `"body":"é"`) || strings.Contains(string(m[0]), "body_encoding") {
+			t.Fatalf("%v: unexpected valid response %s", test.h, m[0])
+		}
+		if !strings.Contains(string(m[1]), test.expected) {
+			t.Fatalf("%v: expected %v found %s", test.h, test.expected, m[1])
+		}
+	}
+}
+
+func TestHeadFirst(t *testing.T) {
+	defer checkLeaks(t)()
+	var mu sync.Mutex
+	var requests []string
+	etag := `"v1"`
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("ETag", etag)
+		mu.Unlock()
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+		if r.Method == http.MethodGet {
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer testServer.Close()
+	cache := NewCache(10)
+	process := func() []map[string]interface{} {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "small", url: testServer.URL + "/1"},
+			ConnRequest{id: "large", url: testServer.URL + "/123456789"},
+		)
+		orchestra.SetCache(cache)
+		orchestra.SetHeadFirst(true)
+		orchestra.SetHeadMaxLength(5)
+		orchestra.SetConcurrency(1)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := process()
+	if m[0]["body"] != "/1" || m[0]["cached"] != nil {
+		t.Fatalf("expected small fetched found %v", m[0])
+	}
+	if m[1]["ok"] != false || m[1]["body"] != nil || m[1]["status_code"] != 200.0 {
+		t.Fatalf("expected large not fetched found %v", m[1])
+	}
+	m = process()
+	if m[0]["body"] != "/1" || m[0]["cached"] != true {
+		t.Fatalf("expected small cached found %v", m[0])
+	}
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	m = process()
+	if m[0]["body"] != "/1" || m[0]["cached"] != nil {
+		t.Fatalf("expected small fetched found %v", m[0])
+	}
+	// connections are fetched in any order, so requests are compared per path.
+	paths := make(map[string][]string)
+	for _, r := range requests {
+		str := strings.SplitN(r, " ", 2)
+		paths[str[1]] = append(paths[str[1]], str[0])
+	}
+	expected := map[string]string{"/1": "HEAD,GET,HEAD,HEAD,GET", "/123456789": "HEAD,HEAD,HEAD"}
+	for path, methods := range expected {
+		if found := strings.Join(paths[path], ","); found != methods {
+			t.Fatalf("%v: expected %v found %v", path, methods, found)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	defer checkLeaks(t)()
+	var mu sync.Mutex
+	var requests []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("OK"))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "a", url: testServer.URL + "/a"},
+		ConnRequest{id: "b", url: testServer.URL + "/b"},
+	)
+	orchestra.SetWarmup(true)
+	orchestra.SetWarmupTiming(true)
+	orchestra.SetConcurrency(1)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+
+	if len(requests) != 3 || requests[0] != "HEAD /a" {
+		t.Fatalf("expected a single warmup request first found %v", requests)
+	}
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range m {
+		if _, ok := r["warmup_ms"]; !ok || r["body"] != "OK" {
+			t.Fatalf("expected warmup_ms and body found %v", r)
+		}
+	}
+
+	orchestra = NewOrchestra(ConnRequest{id: "a", url: testServer.URL + "/a"})
+	orchestra.SetWarmup(true)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if strings.Contains(w.Body.String(), "warmup_ms") {
+		t.Fatalf("expected no warmup_ms without warmup timing found %s", w.Body.String())
+	}
+}
+
+func TestAccept(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Accept")))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL},
+		ConnRequest{id: "id2", url: testServer.URL, accept: "text/csv"},
+		ConnRequest{id: "id3", url: testServer.URL, accept: "text/csv"},
+	)
+	orchestra.conns[2].Header.Set("Accept", "text/plain")
+	orchestra.SetAccept("application/json")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"application/json", "text/csv", "text/plain"} {
+		if m[i]["body"] != expected {
+			t.Fatalf("%v: expected %v found %v", m[i]["id"], expected, m[i]["body"])
+		}
+	}
+}
+
+func TestHostHeaders(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Key") + "," + r.Header.Get("X-Env")))
+	}))
+	defer testServer.Close()
+	localhost := strings.Replace(testServer.URL, "127.0.0.1", "localhost", 1)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "global", url: testServer.URL},
+		ConnRequest{id: "host", url: localhost},
+		ConnRequest{id: "conn", url: localhost},
+	)
+	orchestra.SetHeader("X-Key", "global")
+	orchestra.SetHeader("X-Env", "prod")
+	orchestra.SetHostHeader("localhost", "x-key", "host")
+	orchestra.conns[2].Header.Set("X-Key", "conn")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"global,prod", "host,prod", "conn,prod"} {
+		if m[i]["body"] != expected {
+			t.Fatalf("%v: expected %v found %v", m[i]["id"], expected, m[i])
+		}
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization") + "," + r.Header.Get("X-Tenant") + "," + r.Header.Get("Cookie")))
+	}))
+	defer testServer.Close()
+	localhost := strings.Replace(testServer.URL, "127.0.0.1", "localhost", 1)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "other", url: testServer.URL},
+		ConnRequest{id: "host", url: localhost},
+	)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("X-Tenant", "acme")
+	r.Header.Set("Cookie", "session=secret")
+	forward(orchestra, r, "X-Tenant, Authorization@localhost, X-Missing")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{",acme,", "Bearer token,acme,"} {
+		if m[i]["body"] != expected {
+			t.Fatalf("%v: expected %v found %v", m[i]["id"], expected, m[i])
+		}
+	}
+}
+
+func TestMaxHeaders(t *testing.T) {
+	var count int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	tests := []struct {
+		headers int
+		size    int
+		err     string
+	}{
+		{3, 0, ""},
+		{2, 0, "3 request headers exceed the maximum of 2"},
+		{0, 10, "request headers of 12 bytes exceed the maximum of 10"},
+	}
+	for _, test := range tests {
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL})
+		orchestra.SetHeader("X-A", "1")
+		orchestra.SetHeader("X-B", "2")
+		orchestra.SetHeader("X-C", "3")
+		orchestra.SetMaxHeaders(test.headers, test.size)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if test.err == "" && m[0]["error"] != nil || test.err != "" && m[0]["error"] != test.err {
+			t.Fatalf("expected error %q found %v", test.err, m[0])
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 request sent found %v", count)
+	}
+}
+
+func TestDecodeForm(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/text" {
+			w.Header().Set("Content-Type", formContentType+"; charset=utf-8")
+		}
+		w.Write([]byte("a=1&b=2&b=3&c=%20"))
+	}))
+	defer testServer.Close()
+	form := map[string]interface{}{"a": "1", "b": []interface{}{"2", "3"}, "c": " "}
+	for _, global := range []bool{false, true} {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "form", url: testServer.URL + "/form", decodeForm: true},
+			ConnRequest{id: "text", url: testServer.URL + "/text", decodeForm: true},
+			ConnRequest{id: "raw", url: testServer.URL + "/raw"},
+		)
+		orchestra.SetDecodeForm(global)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		for i, decoded := range []bool{true, false, global} {
+			if decoded && (!reflect.DeepEqual(m[i]["form"], form) || m[i]["body"] != nil) {
+				t.Fatalf("%v: expected form %v found %v", m[i]["id"], form, m[i])
+			}
+			if !decoded && (m[i]["body"] != "a=1&b=2&b=3&c=%20" || m[i]["form"] != nil) {
+				t.Fatalf("%v: expected body found %v", m[i]["id"], m[i])
+			}
+		}
+	}
+}
+
+// testBatcher batches connections to /item/<name> into /bulk?items=<names>.
+type testBatcher struct {
+	url string
+}
+
+func (b testBatcher) Key(c *Conn) (string, bool) {
+	return "bulk", strings.HasPrefix(c.url, b.url+"/item/")
+}
+
+func (b testBatcher) Request(conns []*Conn) (*http.Request, error) {
+	items := make([]string, len(conns))
+	for i, c := range conns {
+		items[i] = strings.TrimPrefix(c.url, b.url+"/item/")
+	}
+	return http.NewRequest("GET", b.url+"/bulk?items="+strings.Join(items, ","), nil)
+}
+
+func (b testBatcher) Split(resp *http.Response, conns []*Conn) ([]*http.Response, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resps := make([]*http.Response, len(conns))
+	for i, item := range strings.Split(string(body), ",") {
+		resps[i] = &http.Response{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+			Body:       ioutil.NopCloser(strings.NewReader(item)),
+		}
+	}
+	return resps, nil
+}
+
+func TestBatcher(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path != "/bulk" {
+			okHandler(w, r)
+			return
+		}
+		items := strings.Split(r.URL.Query().Get("items"), ",")
+		for i := range items {
+			items[i] = "OK/" + items[i]
+		}
+		w.Write([]byte(strings.Join(items, ",")))
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/item/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2"},
+		ConnRequest{id: "id3", url: testServer.URL + "/item/3"},
+	)
+	orchestra.SetBatcher(testBatcher{testServer.URL})
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id1","status_code":200,"status":"200 OK","duration":"%s","body":"OK/1"},{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","body":"OK/2"},{"id":"id3","status_code":200,"status":"200 OK","duration":"%s","body":"OK/3"}]`
+	expected = insertDurations(expected, orchestra.conns...)
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 requests found %v", paths)
+	}
+
+	// combined responses are checked.
+	orchestra.conns[0].criteria = &Criteria{BodyContains: "OK/9"}
+	orchestra.conns[2].checksum = "md5:" + fmt.Sprintf("%x", md5.Sum([]byte("OK/3")))
+	orchestra.Process(httptest.NewRecorder())
+	if r := orchestra.conns[0].Response; r.isSuccess() || !reflect.DeepEqual(r.failures, []string{`expected body containing "OK/9"`}) {
+		t.Fatalf("expected criteria not met found %v", r.failures)
+	}
+	if r := orchestra.conns[2].Response; !r.checked || !r.isSuccess() {
+		t.Fatalf("expected checksum met found %v", r.reason)
+	}
+
+	// connections needing retries are not combined.
+	paths = nil
+	orchestra.SetRetries(1)
+	orchestra.Process(httptest.NewRecorder())
+	if len(paths) != 3 {
+		t.Fatalf("expected 3 requests found %v", paths)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	var hits []string
+	var mu sync.Mutex
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, r.URL.Path)
+		mu.Unlock()
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	defer func(f func(int) int) { mirrorIntn = f }(mirrorIntn)
+	orchestra := NewOrchestra(
+		ConnRequest{id: "m1", url: testServer.URL + "/m1", mirror: "m", weight: 1},
+		ConnRequest{id: "id2", url: testServer.URL + "/2"},
+		ConnRequest{id: "m2", url: testServer.URL + "/m2", mirror: "m", weight: 3},
+	)
+	tests := []struct {
+		n        int
+		expected string
+	}{
+		{0, "m1"},
+		{1, "m2"},
+		{3, "m2"},
+	}
+	for _, test := range tests {
+		hits = nil
+		mirrorIntn = func(n int) int {
+			if n != 4 {
+				t.Fatalf("expected total weight 4 found %d", n)
+			}
+			return test.n
+		}
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || len(hits) != 2 || m[0]["id"] != test.expected && m[1]["id"] != test.expected {
+			t.Fatalf("%d: expected mirror %v found %v %v", test.n, test.expected, w.Body.String(), hits)
+		}
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "details", url: testServer.URL + "/details", dependsOn: "list"},
+		ConnRequest{id: "list", url: testServer.URL + "/list"},
+		ConnRequest{id: "more", url: testServer.URL + "/more", dependsOn: "missing"},
+		ConnRequest{id: "missing", url: testServer.URL + "/missing"},
+		ConnRequest{id: "fallback", url: testServer.URL + "/fallback", dependsOn: "missing", condition: "404"},
+		ConnRequest{id: "cycle1", url: testServer.URL, dependsOn: "cycle2"},
+		ConnRequest{id: "cycle2", url: testServer.URL, dependsOn: "cycle1"},
+		ConnRequest{id: "unknown", url: testServer.URL, dependsOn: "none"},
+	)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"200 OK", "200 OK", statusSkipped, "404 Not Found", "200 OK", "", "", ""}
+	for i, r := range m {
+		if status, _ := r["status"].(string); status != expected[i] {
+			t.Fatalf("%v: expected status %v found %v", r["id"], expected[i], r)
+		}
+	}
+	for i, err := range []string{errDependencyCycle.Error(), errDependencyCycle.Error(), "unknown dependency 'none'"} {
+		if m[5+i]["error"] != err {
+			t.Fatalf("expected error %v found %v", err, m[5+i])
+		}
+	}
+
+	// a skipped connection has not failed.
+	skipped := func() *Orchestra {
+		return NewOrchestra(
+			ConnRequest{id: "list", url: testServer.URL + "/list"},
+			ConnRequest{id: "details", url: testServer.URL + "/details", dependsOn: "list", condition: "404"},
+		)
+	}
+	orchestra = skipped()
+	orchestra.SetSummary(true)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	var out struct {
+		Results []respOutput `json:"results"`
+		Summary summary      `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Results[1].Status != statusSkipped || out.Summary.Failed != 0 || out.Summary.Status != statusOK {
+		t.Fatalf("expected skipped connection not failed found %v", w.Body.String())
+	}
+	orchestra = skipped()
+	orchestra.SetOnlyFailed(true)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Fatalf("expected no failed connections found %v", body)
+	}
+	orchestra = skipped()
+	orchestra.UseSplit()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), `"errors":{}`) {
+		t.Fatalf("expected no errors found %v", w.Body.String())
+	}
+}
+
+func TestGroups(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/b") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "a3", url: testServer.URL + "/a3", group: "a", order: 3},
+		ConnRequest{id: "a1", url: testServer.URL + "/a1", group: "a", order: 1},
+		ConnRequest{id: "b1", url: testServer.URL + "/b1", group: "b"},
+		ConnRequest{id: "a2", url: testServer.URL + "/a2", group: "a", order: 2},
+		ConnRequest{id: "b2", url: testServer.URL + "/b2", group: "b", order: 1},
+		ConnRequest{id: "cycle1", url: testServer.URL, group: "c", order: 1},
+		ConnRequest{id: "cycle2", url: testServer.URL, group: "c", order: 2, dependsOn: "cycle1"},
+		ConnRequest{id: "cycle3", url: testServer.URL, group: "d", order: 1, dependsOn: "cycle4"},
+		ConnRequest{id: "cycle4", url: testServer.URL, group: "d", order: 2},
+	)
+	orchestra.Process(httptest.NewRecorder())
+	var a []string
+	for _, p := range paths {
+		if strings.HasPrefix(p, "/a") {
+			a = append(a, p)
+		}
+	}
+	if strings.Join(a, ",") != "/a1,/a2,/a3" {
+		t.Fatalf("expected group a in order found %v", paths)
+	}
+	if paths[len(paths)-1] != "/b2" || paths[len(paths)-2] != "/b1" {
+		t.Fatalf("expected group b in order and concurrent with group a found %v", paths)
+	}
+	for _, c := range orchestra.conns {
+		if c.id == "cycle2" && c.Response.err != nil {
+			t.Fatalf("%v: expected no error found %v", c.id, c.Response.err)
+		}
+		if c.id == "cycle3" && c.Response.err != errDependencyCycle {
+			t.Fatalf("%v: expected %v found %v", c.id, errDependencyCycle, c.Response.err)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	testServer := httptest.NewServer(failHandler(1, http.StatusInternalServerError))
+	defer testServer.Close()
+	hooks := make(chan string, 2)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		hooks <- r.Method + " " + string(b)
+	}))
+	defer hookServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1", webhook: hookServer.URL},
+		ConnRequest{id: "id2", url: testServer.URL + "/1", webhook: hookServer.URL},
+	)
+	orchestra.SetConcurrency(1)
+	orchestra.Process(httptest.NewRecorder())
+	var hook string
+	select {
+	case hook = <-hooks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	var succeeded *Response
+	for _, c := range orchestra.conns {
+		if c.Response.isSuccess() {
+			succeeded = c.Response
+		}
+	}
+	expected := fmt.Sprintf(`POST {"id":"%s","status_code":200,"status":"200 OK","duration":"%s","queued_ms":%d}`, succeeded.id, succeeded.durationStr(), *succeeded.queuedMs())
+	if hook != expected {
+		t.Fatalf("expected %v found %v", expected, hook)
+	}
+	select {
+	case hook = <-hooks:
+		t.Fatal("webhook not expected for failed connection", hook)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestContentType(t *testing.T) {
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1", contentType: "text/plain"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2", contentType: "application/json"},
+		ConnRequest{id: "id3", url: testServer.URL + "/3"},
+	)
+	orchestra.SetOnlyFailed(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	expected := `[{"id":"id2","status_code":200,"status":"200 OK","duration":"%s","ok":false,"reason":"expected content type application/json found text/plain; charset=utf-8","body":"OK/2"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[1].Response.durationStr())
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("expected %v found %v", expected, w.Body.String())
+	}
+	if ok := orchestra.conns[0].Response.ok(); ok == nil || !*ok {
+		t.Fatal("expected ok for matching content type")
+	}
+	if orchestra.conns[2].Response.ok() != nil {
+		t.Fatal("ok not expected without a content type")
+	}
+}
+
+func TestCriteria(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("service down"))
+			return
+		}
+		w.Write([]byte("healthy"))
+	}))
+	defer testServer.Close()
+	conns, err := parseConnConfigs(strings.NewReader(`[
+		{"id":"up","url":"` + testServer.URL + `/up","criteria":{"status":[200],"body_contains":"healthy","max_latency":5000}},
+		{"id":"down","url":"` + testServer.URL + `/down","criteria":{"status":[200,204],"body_contains":"healthy","content_type":"application/json"}},
+		{"id":"either","url":"` + testServer.URL + `/down","criteria":{"any":[{"status":[200]},{"body_contains":"down"}]}},
+		{"id":"neither","url":"` + testServer.URL + `/up","criteria":{"all":[{"status":[200]}],"any":[{"status":[500]},{"body_contains":"down"}]}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orchestra := NewOrchestra(conns...)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var out []respOutput
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out[0].OK == nil || !*out[0].OK || out[0].Failures != nil || out[0].Body != "healthy" {
+		t.Fatalf("expected up to meet its criteria found %+v", out[0])
+	}
+	expected := []string{`expected status 200 or 204 found 503`, `expected body containing "healthy"`, `expected content type application/json found text/plain; charset=utf-8`}
+	if out[1].OK == nil || *out[1].OK || out[1].Reason != "criteria not met" || !reflect.DeepEqual(out[1].Failures, expected) {
+		t.Fatalf("expected %v found %+v", expected, out[1])
+	}
+	if out[2].OK == nil || !*out[2].OK {
+		t.Fatalf("expected either to meet one of its criteria found %+v", out[2])
+	}
+	expected = []string{`any of: expected status 500 found 200; expected body containing "down"`}
+	if !reflect.DeepEqual(out[3].Failures, expected) {
+		t.Fatalf("expected %v found %+v", expected, out[3])
+	}
+
+	// bodies are matched as they are read, across reads.
+	contains := (&Criteria{BodyContains: "heal", Any: []Criteria{{BodyContains: "lthy"}, {BodyContains: "down"}}}).bodyMatcher()
+	for _, b := range []string{"he", "a", "lt", "hy"} {
+		contains.Write([]byte(b))
+	}
+	if found := contains.found; !found["heal"] || !found["lthy"] || found["down"] {
+		t.Fatalf("unexpected strings found %v", found)
+	}
+
+	// bodies are not read beyond the maximum body size.
+	orchestra = NewOrchestra(ConnRequest{id: "up", url: testServer.URL + "/up", criteria: &Criteria{BodyContains: "healthy"}})
+	orchestra.SetMaxBodySize(4)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if r := orchestra.conns[0].Response; r.reason != errBodyTooLarge(4).Error() {
+		t.Fatalf("expected %v found %v", errBodyTooLarge(4), r.reason)
+	}
+	if !strings.Contains(w.Body.String(), `"error":"`+errBodyTooLarge(4).Error()) {
+		t.Fatalf("expected body size error found %v", w.Body.String())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test"))
+	}))
+	defer testServer.Close()
+	const sha = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		checksums string
+		code      int
+		expected  string
+	}{
+		{"a:" + sha + ",b:md5:098F6BCD4621D373CADE4E832627B4F6", http.StatusOK, `"id":"a","status_code":200,"status":"200 OK"`},
+		{"a:sha256:" + sha, http.StatusOK, `"ok":true,"body":"test"`},
+		{"b:md5:098f6bcd4621d373cade4e832627b4f6", http.StatusOK, `"ok":true`},
+		{"a:sha1:" + strings.Repeat("0", 40), http.StatusOK, `"ok":false,"reason":"expected sha1 checksum ` + strings.Repeat("0", 40) + ` found a94a8fe5ccb19ba61c4c0873d391e987982fbbd3","body":"test"`},
+		{"a:sha3:" + sha, http.StatusBadRequest, `unsupported checksum algorithm "sha3"`},
+		{"a:sha256:abc", http.StatusBadRequest, `invalid sha256 checksum "abc"`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/?requests=a:"+testServer.URL+",b:"+testServer.URL+"&checksums="+test.checksums, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v: expected %v found %v %v", test.checksums, test.code, w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), test.expected) {
+			t.Fatalf("%v: expected %v found %v", test.checksums, test.expected, w.Body.String())
+		}
+	}
+
+	conns, err := parseConnConfigs(strings.NewReader(`[{"url": "http://url.com", "checksum": "SHA256:` + strings.ToUpper(sha) + `"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conns[0].checksum != "sha256:"+sha {
+		t.Fatalf("expected checksum %v found %v", "sha256:"+sha, conns[0].checksum)
+	}
+	if _, err := parseConnConfigs(strings.NewReader(`[{"url": "http://url.com", "checksum": "md5:00"}]`)); err == nil {
+		t.Fatal("expected an error for an invalid checksum")
+	}
+
+	// bodies are hashed as they are stored.
+	dir, err := ioutil.TempDir("", "orchestra-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orchestra := NewOrchestra(ConnRequest{id: "a", url: testServer.URL, checksum: "sha256:" + sha}, ConnRequest{id: "b", url: testServer.URL, checksum: "sha256:" + sha, maxBodySize: 2})
+	store := &countingStore{BodyStore: TempFileStore{Dir: dir}}
+	orchestra.SetBodyStore(store, 2)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if n := atomic.LoadInt32(&store.n); n != 1 {
+		t.Fatalf("expected 1 body stored found %v", n)
+	}
+	expected := `[{"id":"a","status_code":200,"status":"200 OK","duration":"%s","ok":true,"body":"test"},{"id":"b","error":"response body exceeds the maximum size of 2 bytes"}]`
+	expected = fmt.Sprintf(expected, orchestra.conns[0].Response.durationStr())
+	if found := strings.TrimSpace(w.Body.String()); found != expected {
+		t.Fatalf("expected %v found %v", expected, found)
+	}
+}
+
+func TestRawEncoding(t *testing.T) {
+	defer checkLeaks(t)()
+	body := strings.Repeat("orchestra", 100)
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write([]byte(body))
+	zw.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/invalid" {
+			w.Write([]byte("not gzip encoded"))
+			return
+		}
+		w.Write(encoded.Bytes())
+	}))
+	defer testServer.Close()
+
+	orchestra := NewOrchestra(
+		ConnRequest{id: "transparent", url: testServer.URL},
+		ConnRequest{id: "raw", url: testServer.URL, rawEncoding: true},
+		ConnRequest{id: "invalid", url: testServer.URL + "/invalid", rawEncoding: true},
+	)
+	orchestra.SetSummary(true)
+	orchestra.SetCaptureHeaders("Content-Encoding")
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var out struct {
+		Results []respOutput `json:"results"`
+		Summary summary      `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	transparent, raw, invalid := out.Results[0], out.Results[1], out.Results[2]
+	if transparent.Body != body || transparent.Header.Get("Content-Encoding") != "" || transparent.ResponseBytes != int64(len(body)) {
+		t.Fatalf("expected the decompressed body of %v bytes found %+v", len(body), transparent)
+	}
+	if raw.Body != body || raw.Header.Get("Content-Encoding") != "gzip" || raw.ResponseBytes != int64(encoded.Len()) {
+		t.Fatalf("expected the body with %v gzip encoded bytes found %+v", encoded.Len(), raw)
+	}
+	if invalid.Error != gzip.ErrHeader.Error() {
+		t.Fatalf("expected error %v found %+v", gzip.ErrHeader, invalid)
+	}
+	// the encoded bytes of the invalid body are counted too.
+	if expected := int64(len(body) + encoded.Len() + len("not gzip encoded")); out.Summary.ResponseBytes != expected {
+		t.Fatalf("expected %v response bytes found %v", expected, out.Summary.ResponseBytes)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer checkLeaks(t)()
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	req, err := http.NewRequest("GET", "/?requests=id1:"+oServer.URL+",id2:"+oServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(handler)
+	testHandler.ServeHTTP(w, req)
+	compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	tServer := httptest.NewServer(tHandler)
+	req, err := http.NewRequest("GET", "/?timeout=2000&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(handler)
+	testHandler.ServeHTTP(w, req)
+	checkErrResp(t, w)
+}
+
+func TestHandlerRespJson(t *testing.T) {
+	tServer := httptest.NewServer(okHandler)
+	req, err := http.NewRequest("GET", "/?type=json&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(handler)
+	testHandler.ServeHTTP(w, req)
+	if !compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t) {
+		t.Fatalf("expected %v found %v", handRespJson, w.Body.String())
+	}
+}
+
+func TestHandlerRespDelim(t *testing.T) {
+	tServer := httptest.NewServer(okHandler)
+	req, err := http.NewRequest("GET", "/?type=delimiter&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(handler)
+	testHandler.ServeHTTP(w, req)
+	if !compareDelimsMinusDurations(strings.TrimSpace(w.Body.String()), handRespDelim[0], defaultDelimiter, t) {
+		t.Fatalf("expected %v found %v", handRespDelim[0], w.Body.String())
+	}
+	req, err = http.NewRequest("GET", "/?type=delimiter&delimiter=000000&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Body.Reset()
+	testHandler.ServeHTTP(w, req)
+	if !compareDelimsMinusDurations(strings.TrimSpace(w.Body.String()), handRespDelim[1], "\n000000\n", t) {
+		t.Fatalf("expected %v found %v", handRespDelim[1], w.Body.String())
+	}
+}
+
+func TestHandlerDelimiterParams(t *testing.T) {
+	tServer := httptest.NewServer(okHandler)
+	defer tServer.Close()
+	tests := []struct {
+		query     string
+		json      bool
+		delimiter string
+	}{
+		{"type=json&delimiter=000000", true, ""},
+		{"delimiter=000000", true, ""},
+		{"type=delimiter", false, defaultDelimiter},
+		{"type=delimiter&delimiter=000000", false, "\n000000\n"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/?"+test.query+"&requests=id1:"+tServer.URL+",id2:"+tServer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if test.json {
+			if !compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t) {
+				t.Fatalf("%v: expected json found %v", test.query, w.Body.String())
+			}
+			continue
+		}
+		if !strings.Contains(w.Body.String(), test.delimiter) {
+			t.Fatalf("%v: expected delimiter %q found %v", test.query, test.delimiter, w.Body.String())
+		}
+	}
+
+	orchestra := NewOrchestra()
+	orchestra.SetDelimiterString("000000")
+	if orchestra.responseType != typeJson || orchestra.delimiter != "\n000000\n" {
+		t.Fatalf("expected delimiter set without changing the type found %v %q", orchestra.responseType, orchestra.delimiter)
+	}
+	orchestra.SetDelimiter("111111")
+	if orchestra.responseType != typeDelimiter || orchestra.delimiter != "\n111111\n" {
+		t.Fatalf("expected delimiter output found %v %q", orchestra.responseType, orchestra.delimiter)
+	}
+}
+
+func TestDelimiterTrailingNewline(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/newline" {
+			w.Write([]byte("b\n"))
+			return
+		}
+		w.Write([]byte("a"))
+	}))
+	defer testServer.Close()
+	plain := ConnRequest{id: "plain", url: testServer.URL}
+	newline := ConnRequest{id: "newline", url: testServer.URL + "/newline"}
+	invalid := ConnRequest{id: "invalid", url: "/invalid"}
+	tests := []struct {
+		conns    []ConnRequest
+		trailing bool
+		expected string
+	}{
+		{nil, true, ""},
+		{[]ConnRequest{plain}, false, "Id: plain, Status: 200 OK, Duration: %s\na"},
+		{[]ConnRequest{plain}, true, "Id: plain, Status: 200 OK, Duration: %s\na\n"},
+		{[]ConnRequest{newline}, false, "Id: newline, Status: 200 OK, Duration: %s\nb\n"},
+		{[]ConnRequest{newline}, true, "Id: newline, Status: 200 OK, Duration: %s\nb\n"},
+		{[]ConnRequest{newline, plain}, true, "Id: newline, Status: 200 OK, Duration: %s\nb\n" + defaultDelimiter + "Id: plain, Status: 200 OK, Duration: %s\na\n"},
+		{[]ConnRequest{plain, invalid}, true, "Id: plain, Status: 200 OK, Duration: %s\na" + defaultDelimiter + "Id: invalid, Status: error\nGet \"/invalid\": unsupported protocol scheme \"\"\n"},
+	}
+	for i, test := range tests {
+		orchestra := NewOrchestra(test.conns...)
+		orchestra.UseDelimiter()
+		orchestra.SetTrailingNewline(test.trailing)
+		w := httptest.NewRecorder()
+		orchestra.Process(w)
+		var fetched []*Conn
+		for _, c := range orchestra.conns {
+			if c.Response.err == nil {
+				fetched = append(fetched, c)
+			}
+		}
+		if expected := insertDurations(test.expected, fetched...); w.Body.String() != expected {
+			t.Fatalf("%d: expected %q found %q", i, expected, w.Body.String())
+		}
+	}
+}
+
+func TestHandlerBaseURL(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	req, err := http.NewRequest("GET", "/?base="+oServer.URL+"&requests=id1:/,id2:/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(handler)
+	testHandler.ServeHTTP(w, req)
+	if !compareJsonsMinusDuration([]byte(handRespJson), w.Body.Bytes(), t) {
+		t.Fatalf("expected %v found %v", handRespJson, w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", "/?base=/relative&requests=id1:/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	testHandler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %v found %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandlerProxies(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"proxies=id1:direct", http.StatusOK},
+		{"proxy=" + oServer.URL + "&proxies=id1:" + oServer.URL + ",id2:direct", http.StatusOK},
+		{"proxy=invalid", http.StatusBadRequest},
+		{"proxies=id1:invalid", http.StatusBadRequest},
+		{"proxies=id3:direct", http.StatusBadRequest},
+		{"proxies=id1", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/?requests=id1:"+oServer.URL+",id2:"+oServer.URL+"&"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v: expected %v found %v", test.query, test.code, w.Code)
+		}
+	}
+}
+
+func TestHandlerMethodOverride(t *testing.T) {
+	oServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	}))
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	tests := []struct {
+		override string
+		query    string
+		code     int
+		expected string
+	}{
+		{"", "", http.StatusOK, "GET,GET"},
+		{"delete", "", http.StatusOK, "DELETE,DELETE"},
+		{"DELETE", "&methods=id2:put", http.StatusOK, "DELETE,PUT"},
+		{"", "&methods=id1:head", http.StatusOK, "<nil>,GET"},
+		{"POST", "", http.StatusOK, "POST,POST"},
+		{"", "&methods=id1:patch", http.StatusOK, "PATCH,GET"},
+		{"TRACE", "", http.StatusBadRequest, ""},
+		{"", "&methods=id1:connect", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "/?requests=id1:"+oServer.URL+",id2:"+oServer.URL+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.override != "" {
+			req.Header.Set(methodOverrideHeader, test.override)
+		}
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v %v: expected %v found %v", test.override, test.query, test.code, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if found := fmt.Sprintf("%v,%v", m[0]["body"], m[1]["body"]); found != test.expected {
+			t.Fatalf("%v %v: expected %v found %v", test.override, test.query, test.expected, found)
+		}
+	}
+}
+
+func TestHandlerBody(t *testing.T) {
+	oServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method + " " + r.Header.Get("Content-Type") + " " + string(b)))
+	}))
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	tests := []struct {
+		config   string
+		code     int
+		expected string
+	}{
+		{`"method": "POST", "body": {"a": 1}`, http.StatusOK, `POST application/json {"a": 1}`},
+		{`"method": "PATCH", "body": "a=1", "body_type": "application/x-www-form-urlencoded"`, http.StatusOK, "PATCH application/x-www-form-urlencoded a=1"},
+		{`"method": "PUT", "body": "text"`, http.StatusOK, "PUT text/plain; charset=utf-8 text"},
+		{`"method": "HEAD", "body": "text"`, http.StatusOK, "<nil>"},
+		{`"method": "POST"`, http.StatusOK, "POST  "},
+		{`"method": "TRACE"`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		config := `[{"id": "id1", "url": "` + oServer.URL + `", ` + test.config + `}]`
+		req, err := http.NewRequest("POST", "/", strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v: expected %v found %v", test.config, test.code, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if found := fmt.Sprint(m[0]["body"]); found != test.expected {
+			t.Fatalf("%v: expected %q found %q", test.config, test.expected, found)
+		}
+	}
+
+	// POST requests are not retried
+	for method, expected := range map[string]int{http.MethodPost: 1, http.MethodPut: 3} {
+		fServer := httptest.NewServer(failHandler(3, http.StatusInternalServerError))
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: fServer.URL, method: method, body: []byte("{}")})
+		orchestra.SetRetries(2)
+		orchestra.SetRetryBackoff(0)
+		orchestra.Process(httptest.NewRecorder())
+		fServer.Close()
+		if found := orchestra.conns[0].Response.attempts; found != expected {
+			t.Fatalf("%v: expected %v attempts found %v", method, expected, found)
+		}
+	}
+}
+
+func TestHandlerName(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	for _, name := range []string{"run1", ""} {
+		req, err := http.NewRequest("GET", "/?summary=true&requests=id1:"+oServer.URL+"&name="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		var out struct {
+			Summary summary `json:"summary"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		found := w.Header().Get(nameHeader)
+		if out.Summary.Name != found {
+			t.Fatalf("expected summary name %v found %v", found, out.Summary.Name)
+		}
+		if name != "" && found != name {
+			t.Fatalf("expected name %v found %v", name, found)
+		}
+		if name == "" && len(found) != 16 {
+			t.Fatalf("expected generated name found %v", found)
+		}
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	configHandler(w, req)
+	var config map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["default_timeout_ms"] != 10000.0 || config["max_url_length"] != float64(*maxURLLength) || config["token"] != false {
+		t.Fatalf("unexpected config %v", w.Body.String())
+	}
+	if types, _ := json.Marshal(config["types"]); string(types) != `["json","delimiter","zip","stream","split","health"]` {
+		t.Fatalf("unexpected types %s", types)
+	}
+
+	req, err = http.NewRequest("POST", "/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	configHandler(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %v found %v", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// csvFormat is a custom output format of the id and status code of each response,
+// named csv unless name is set.
+type csvFormat struct {
+	name string
+}
+
+func (f csvFormat) Name() string {
+	if f.name == "" {
+		return "csv"
+	}
+	return f.name
+}
+
+func (csvFormat) ContentType() string { return "text/csv" }
+
+func (csvFormat) Write(w io.Writer, resps []*Response) error {
+	for _, r := range resps {
+		r.discard()
+		if _, err := fmt.Fprintf(w, "%s,%d\n", r.id, r.StatusCode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestOutputFormat(t *testing.T) {
+	defer checkLeaks(t)()
+	RegisterOutputFormat(csvFormat{name: "CSV"})
+	RegisterOutputFormat(csvFormat{name: "json"})
+	defer UnregisterOutputFormat("csv")
+	defer UnregisterOutputFormat("JSON")
+	testServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer testServer.Close()
+
+	req := httptest.NewRequest("GET", "/?type=csv&requests=id1:"+testServer.URL+",id2:"+testServer.URL, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("expected content type %v found %v", "text/csv", ct)
+	}
+	if expected := "id1,200\nid2,200\n"; w.Body.String() != expected {
+		t.Fatalf("expected %q found %q", expected, w.Body.String())
+	}
+
+	// built-in types take precedence.
+	req = httptest.NewRequest("GET", "/?type=json&requests=id1:"+testServer.URL, nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if !strings.HasPrefix(w.Body.String(), `[{"id":"id1"`) {
+		t.Fatalf("expected json found %v", w.Body.String())
+	}
+
+	// every built-in type but stream is written by a format.
+	orchestra := NewOrchestra()
+	formats := []struct {
+		use      func()
+		expected OutputFormat
+	}{
+		{orchestra.UseJSON, jsonFormat{orchestra}},
+		{orchestra.UseDelimiter, delimiterFormat{orchestra}},
+		{orchestra.UseZip, zipFormat{orchestra}},
+		{func() { orchestra.UseDir("dir") }, dirFormat{orchestra}},
+		{orchestra.UseSplit, splitFormat{orchestra}},
+		{orchestra.UseHealth, healthFormat{orchestra}},
+		{orchestra.UseStream, nil},
+	}
+	for _, f := range formats {
+		f.use()
+		found := orchestra.outputFormat()
+		if found != f.expected {
+			t.Fatalf("expected output format %T found %T", f.expected, found)
+		}
+		if found != nil && !containsString(append(serverTypes, "dir"), found.Name()) {
+			t.Fatalf("unexpected name %v of %T", found.Name(), found)
+		}
+	}
+	expected := "Invalid Response Type specified. Must be one of json, delimiter, zip, stream, split, health, csv"
+	if err := processConns(orchestra, httptest.NewRecorder()); err == nil || err.Error() != expected {
+		t.Fatalf("expected %v found %v", expected, err)
+	}
+
+	w = httptest.NewRecorder()
+	configHandler(w, httptest.NewRequest("GET", "/config", nil))
+	if !strings.Contains(w.Body.String(), `"types":["json","delimiter","zip","stream","split","health","csv"]`) {
+		t.Fatalf("expected registered formats in types found %v", w.Body.String())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	defer func(ttl time.Duration) { *replayTTL = ttl }(*replayTTL)
+	*replayTTL = time.Minute
+	var count int32
+	oServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		okHandler(w, r)
+	}))
+	defer oServer.Close()
+	req, err := http.NewRequest("GET", "/?name=run1&type=delimiter&requests=id1:"+oServer.URL+"/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	id := w.Header().Get(replayIDHeader)
+	if id == "" || id == "run1" {
+		t.Fatalf("expected a generated replay id found %q", id)
+	}
+	serverReplays.set("expired", params{}, -time.Minute)
+
+	tests := []struct {
+		name  string
+		code  int
+		count int32
+	}{
+		{id, http.StatusOK, 2},
+		{"run1", http.StatusNotFound, 2},
+		{"unknown", http.StatusNotFound, 2},
+		{"expired", http.StatusNotFound, 2},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", replayPath+test.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		replayHandler(w, req)
+		if w.Code != test.code || atomic.LoadInt32(&count) != test.count {
+			t.Fatalf("%v: expected %v after %v requests found %v after %v", test.name, test.code, test.count, w.Code, count)
+		}
+		if w.Code == http.StatusOK && (!strings.HasSuffix(w.Body.String(), "OK/1") || w.Header().Get(nameHeader) == "run1") {
+			t.Fatalf("%v: expected replay under a new name found %v %v", test.name, w.Header(), w.Body.String())
+		}
+	}
+}
+
+func TestRetryHandler(t *testing.T) {
+	defer func(ttl time.Duration) { *replayTTL = ttl }(*replayTTL)
+	*replayTTL = time.Minute
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	oServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		if r.URL.Path == "/2" && n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer oServer.Close()
+	req, err := http.NewRequest("GET", "/?name=run2&requests=id1:"+oServer.URL+"/1,id2:"+oServer.URL+"/2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	id := w.Header().Get(replayIDHeader)
+
+	for i := 0; i < 2; i++ {
+		req, err = http.NewRequest("GET", retryPath+"?id="+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		retryHandler(w, req)
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || m[0]["id"] != "id1" || m[1]["id"] != "id2" || m[1]["status_code"] != 200.0 {
+			t.Fatalf("expected merged results found %s", w.Body.String())
+		}
+		if requests["/1"] != 1 || requests["/2"] != 2 {
+			t.Fatalf("expected only failed connection retried found %v", requests)
+		}
+	}
+
+	req, err = http.NewRequest("GET", retryPath+"?id=run2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	retryHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %v found %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestPolling(t *testing.T) {
+	defer checkLeaks(t)()
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	w := httptest.NewRecorder()
+	startHandler(w, httptest.NewRequest("GET", "/start?name=poll1&requests=slow:"+testServer.URL+"/slow,fast:"+testServer.URL+"/fast", nil))
+	var started struct{ ID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusAccepted || started.ID == "" || started.ID == "poll1" || w.Header().Get("Location") != "/status?id="+started.ID {
+		t.Fatalf("expected accepted with a generated id found %v %v %v", w.Code, started.ID, w.Header())
+	}
+
+	// the name does not select the results of another orchestration.
+	w = httptest.NewRecorder()
+	startHandler(w, httptest.NewRequest("GET", "/start?name=poll1&requests=fast:"+testServer.URL+"/fast", nil))
+	if w.Body.String() == "" || strings.Contains(w.Body.String(), started.ID) {
+		t.Fatalf("expected a new id found %v", w.Body.String())
+	}
+
+	status := func() pollOutput {
+		w := httptest.NewRecorder()
+		statusHandler(w, httptest.NewRequest("GET", "/status?id="+started.ID, nil))
+		var out pollOutput
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	var out pollOutput
+	for i := 0; i < 100; i++ {
+		if out = status(); len(out.Results) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out.Done || len(out.Results) != 1 || !strings.Contains(string(out.Results[0]), `"id":"fast"`) {
+		t.Fatalf("expected fast result only found %+v", out)
+	}
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		if out = status(); out.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !out.Done || out.Status != statusOK || len(out.Results) != 2 {
+		t.Fatalf("expected both results when done found %+v", out)
+	}
+
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status?id=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected not found found %v", w.Code)
+	}
+}
+
+func TestHandlerJsonConfig(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	config := `[{"id":"id1","url":"%s/1","meta":{"region":"eu","tier":"1"}},{"id":"id2","url":"%s/2","proxy":"direct"}]`
+	req, err := http.NewRequest("POST", "/", strings.NewReader(fmt.Sprintf(config, oServer.URL, oServer.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testHandler.ServeHTTP(w, req)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0]["body"] != "OK/1" || m[1]["body"] != "OK/2" {
+		t.Fatalf("unexpected response %v", w.Body.String())
+	}
+	if meta, _ := json.Marshal(m[0]["meta"]); string(meta) != `{"region":"eu","tier":"1"}` {
+		t.Fatalf("expected meta found %s", meta)
+	}
+	if _, ok := m[1]["meta"]; ok {
+		t.Fatal("meta not expected")
+	}
+
+	for _, body := range []string{`[]`, `{}`, `[{"id":"id1"}]`, `[{"id":"id1","url":"/","proxy":"invalid"}]`} {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expected %v found %v", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestHandlerRequestsURL(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	var fetches int
+	config := `[{"id":"id1","url":"%s/1"}]`
+	dServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, config, oServer.URL)
+	}))
+	defer dServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	serve := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/?requests_url="+dServer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(); w.Code != http.StatusBadRequest || fetches != 0 {
+		t.Fatalf("expected private address to be refused found %v %v", w.Code, w.Body.String())
+	}
+	// a proxy would be dialed instead of the requested host, bypassing the check.
+	if definitionsClient.Transport.(*http.Transport).Proxy != nil {
+		t.Fatal("expected requests_url requests not to be proxied")
+	}
+
+	*allowPrivate = true
+	defer func() { *allowPrivate = false }()
+	for i := 0; i < 2; i++ {
+		w := serve()
+		var m []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+		if len(m) != 1 || m[0]["id"] != "id1" || m[0]["body"] != "OK/1" {
+			t.Fatalf("unexpected response %v", w.Body.String())
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected definitions to be cached, fetched %d times", fetches)
+	}
+}
+
+func TestParseRequests(t *testing.T) {
+	conns, err := parseRequests("id1:http://url1.xyz,http://url2.xyz, /path,id4:/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConnRequest{
+		{id: "id1", url: "http://url1.xyz"},
+		{id: "1", url: "http://url2.xyz"},
+		{id: "2", url: "/path"},
+		{id: "id4", url: "/path"},
+	}
+	if !reflect.DeepEqual(conns, expected) {
+		t.Fatalf("expected %v found %v", expected, conns)
+	}
+	if _, err := parseRequests("id1:http://url1.xyz,,"); err == nil {
+		t.Fatal("error expected for empty entries")
+	}
+
+	conns, err = parseConnConfigs(strings.NewReader(`[{"url":"http://url1.xyz"},{"id":"id2","url":"/path"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conns[0].id != "0" || conns[1].id != "id2" {
+		t.Fatalf("unexpected ids %v", conns)
+	}
+}
+
+func TestHandlerAllErrors(t *testing.T) {
+	long := "http://url.com/" + strings.Repeat("x", *maxURLLength)
+	req, err := http.NewRequest("GET", "/?all_errors=true&requests=id1:http://url.com,,id3:"+long+",", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %v found %v", http.StatusBadRequest, w.Code)
+	}
+	var resp struct{ Errors []parseError }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []parseError{
+		{Index: 1, Value: "", Error: badRequestInvalidMsg},
+		{Index: 2, Value: long, Error: fmt.Sprintf(badRequestURLLengthMsg, "id3", *maxURLLength)},
+		{Index: 3, Value: "", Error: badRequestInvalidMsg},
+	}
+	if !reflect.DeepEqual(resp.Errors, expected) {
+		t.Fatalf("expected %v found %v", expected, resp.Errors)
+	}
+
+	req, err = http.NewRequest("GET", "/?requests=id1:http://url.com,,id3:"+long+",", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || w.Body.String() != badRequestInvalidMsg {
+		t.Fatalf("expected %v found %v", badRequestInvalidMsg, w.Body.String())
+	}
+
+	// 0 is no limit.
+	defer func(n int) { *maxURLLength = n }(*maxURLLength)
+	*maxURLLength = 0
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	req, err = http.NewRequest("GET", "/?requests=id3:"+testServer.URL+"/"+strings.Repeat("x", 10000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status_code":200`) {
+		t.Fatalf("expected no url length limit found %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerFields(t *testing.T) {
+	oServer := httptest.NewServer(okHandler)
+	defer oServer.Close()
+	testHandler := http.HandlerFunc(handler)
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"fields=id,status_code", http.StatusOK, `[{"id":"id1","status_code":200},{"id":"id2"}]`},
+		{"fields=body,error", http.StatusOK, `[{"body":"OK/1"},{"error":"Get \"/invalid\": unsupported protocol scheme \"\""}]`},
+		{"fields=id,unknown", http.StatusBadRequest, fmt.Sprintf(badRequestFieldsMsg, "unknown")},
+		{"fields=id,status_code&camel_case=true", http.StatusOK, `[{"id":"id1","statusCode":200},{"id":"id2"}]`},
+		{"camel_case=true&concurrency=1", http.StatusOK, `{"id":"id1","statusCode":200,"status":"200 OK","duration":`},
+		{"camel_case=true&concurrency=1", http.StatusOK, `"queuedMs":`},
+		{"duration_ms=true", http.StatusOK, `{"id":"id1","status_code":200,"status":"200 OK","duration_ms":`},
+		{"duration_ms=true&camel_case=true", http.StatusOK, `"statusCode":200,"status":"200 OK","durationMs":`},
+		{"fields=id,duration_ms", http.StatusOK, `[{"id":"id1"},{"id":"id2"}]`},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/?requests=id1:"+oServer.URL+"/1,id2:/invalid&"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v: expected %v found %v", test.query, test.code, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); !strings.Contains(body, test.expected) {
+			t.Fatalf("%v: expected %v found %v", test.query, test.expected, body)
+		}
+	}
+}
+
+func TestHandlerMaxURLLength(t *testing.T) {
+	req, err := http.NewRequest("GET", "/?requests=id1:http://url.com/"+strings.Repeat("x", *maxURLLength), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	http.HandlerFunc(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %v found %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func checkErrResp(t *testing.T, w *httptest.ResponseRecorder) {
+	var m []interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range m {
+		if v.(map[string]interface{})["error"] == nil {
+			t.Fatal("error expected", v)
+		}
+	}
+}
+
+func insertDurations(s string, conns ...*Conn) string {
+	durs := make([]interface{}, len(conns))
+	for i := range conns {
+		durs[i] = conns[i].Response.durationStr()
+	}
+	return fmt.Sprintf(s, durs...)
+}
+
+func compareJsonsMinusDuration(s, s1 []byte, t *testing.T) bool {
+	var m []interface{}
+	var m1 []interface{}
+	err := json.Unmarshal(s, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(s1, &m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(m1) {
+		t.Fatal("different json sizes")
+	}
+	keys := []string{"id", "status_code", "status", "body"}
+	for i := 0; i < len(m); i++ {
+		for _, k := range keys {
+			if m[i].(map[string]interface{})[k] != m1[i].(map[string]interface{})[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compareDelimsMinusDurations(s, s1, delim string, t *testing.T) bool {
+	str := strings.Split(s, delim)
+	str1 := strings.Split(s1, delim)
+	equal := true
+	if len(str) != len(str1) {
+		t.Fatal("different output sizes")
+	}
+	for i := 0; i < len(str); i++ {
+		st := strings.Split(str[i], "\n")
+		st1 := strings.Split(str1[i], "\n")
+		if len(st) != len(st1) {
+			equal = false
+			break
+		}
+		for k, v := range st {
+			if k == 0 {
+				j := strings.Index(v, "Duration")
+				if st1[k][:j+1] != v[:j+1] {
+					equal = false
+					break
+				}
+				continue
+			}
+			if v != st1[k] {
+				equal = false
+				break
+			}
 		}
 	}
 	return equal
 }
+
+func TestResolver(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer testServer.Close()
+	RegisterResolver("svc", StaticResolver{"payments": testServer.URL + "/api/"})
+	defer RegisterResolver("svc", nil)
+
+	req, err := http.NewRequest("GET", "/?requests=id1:svc://payments/status,id2:"+testServer.URL+"/direct", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["body"] != "/api/status" || m[1]["body"] != "/direct" {
+		t.Fatalf("expected resolved urls found %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", "/?requests=id1:svc://unknown/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown service unknown") {
+		t.Fatalf("expected unknown service error found %v %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	port := testServer.URL[strings.LastIndex(testServer.URL, ":")+1:]
+	var lookups int32
+	cache := NewDNSCache(100 * time.Millisecond)
+	cache.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		if host != "service.test" {
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	fetch := func() *Response {
+		orchestra := NewOrchestra(ConnRequest{id: "id1", url: "http://service.test:" + port + "/1"})
+		orchestra.SetDNSCache(cache)
+		orchestra.Process(httptest.NewRecorder())
+		return orchestra.conns[0].Response
+	}
+	for i := 0; i < 3; i++ {
+		if r := fetch(); r.err != nil || r.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok found %v %v", r.StatusCode, r.err)
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected 1 lookup found %d", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	fetch()
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Fatalf("expected lookup after ttl found %d", n)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer testServer.Close()
+	orchestra := NewOrchestra(ConnRequest{id: "id1", url: testServer.URL + "/status?token=secret", rawURL: "svc://payments/status?token=secret", method: http.MethodPut})
+	orchestra.conns[0].Header.Set("Authorization", "Bearer secret")
+	orchestra.SetEcho(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []struct {
+		Echo echoOutput `json:"echo"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	echo := m[0].Echo
+	if echo.Id != "id1" || echo.Method != http.MethodPut || echo.URL != "svc://payments/status?token=REDACTED" {
+		t.Fatalf("unexpected echo %+v", echo)
+	}
+	if echo.Target != testServer.URL+"/status?token=REDACTED" || echo.Header.Get("Authorization") != "REDACTED" {
+		t.Fatalf("unexpected echo target %+v", echo)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("expected secrets redacted found %s", w.Body.String())
+	}
+}
+
+func TestBodyEmpty(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		okHandler(w, r)
+	}))
+	defer testServer.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "empty", url: testServer.URL + "/empty"},
+		ConnRequest{id: "body", url: testServer.URL + "/body"},
+		ConnRequest{id: "error", url: "http://invalid.invalid"},
+	)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[0]["body_empty"] != true || m[0]["body"] != nil {
+		t.Fatalf("expected empty body found %v", m[0])
+	}
+	if m[1]["body_empty"] != nil || m[2]["body_empty"] != nil {
+		t.Fatalf("expected body_empty only for empty bodies found %v", m)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	defer checkLeaks(t)()
+	bodies := map[string]string{
+		"/primary": `{"name":"a","items":[1,2],"old":true,"nested":{"v":1}}`,
+		"/replica": `{"name":"a","items":[1],"new":"x","nested":{"v":2}}`,
+		"/same":    `{"name":"a","items":[1,2],"old":true,"nested":{"v":1}}`,
+		"/text":    `not json`,
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer testServer.Close()
+	u := testServer.URL
+	tests := []struct {
+		compare  string
+		expected string
+	}{
+		{"p,r", `{"ids":["p","r"],"status_codes":[200,200],"status_match":true,"equal":false,"diff":[` +
+			`{"path":"/items/1","change":"removed","a":2},{"path":"/nested/v","change":"changed","a":1,"b":2},` +
+			`{"path":"/new","change":"added","b":"x"},{"path":"/old","change":"removed","a":true}]}`},
+		{"p,s", `{"ids":["p","s"],"status_codes":[200,200],"status_match":true,"equal":true}`},
+		{"p,t", `{"ids":["p","t"],"status_codes":[200,202],"status_match":false,"equal":false}`},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/?compare="+test.compare+"&requests=p:"+u+"/primary,r:"+u+"/replica,s:"+u+"/same,t:"+u+"/text", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if strings.TrimSpace(w.Body.String()) != test.expected {
+			t.Fatalf("%v: expected %v found %v", test.compare, test.expected, w.Body.String())
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/?compare=p,x&requests=p:"+u+"/primary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %v found %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"stats":{"count":100}}`))
+		case "/none":
+			w.Write([]byte(`{"stats":{}}`))
+		default:
+			w.Write([]byte(`{"stats":{"count":` + r.URL.Path[1:] + `}}`))
+		}
+	}))
+	defer testServer.Close()
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"aggregate=sum:$.stats.count", http.StatusOK, `"aggregate":{"function":"sum","path":"$.stats.count","value":6,"count":3}`},
+		{"aggregate=avg:$.stats.count", http.StatusOK, `"aggregate":{"function":"avg","path":"$.stats.count","value":2,"count":3}`},
+		{"aggregate=min:$['stats'].count", http.StatusOK, `"aggregate":{"function":"min","path":"$['stats'].count","value":1,"count":3}`},
+		{"aggregate=max:$.stats.count", http.StatusOK, `"aggregate":{"function":"max","path":"$.stats.count","value":3,"count":3}`},
+		{"aggregate=sum:$.stats.missing", http.StatusOK, `"aggregate":{"function":"sum","path":"$.stats.missing","value":null,"count":0}`},
+		{"aggregate=median:$.stats.count", http.StatusBadRequest, badRequestAggregateMsg},
+		{"aggregate=sum:stats.count", http.StatusBadRequest, badRequestAggregateMsg},
+		{"aggregate=sum", http.StatusBadRequest, badRequestAggregateMsg},
+	}
+	for _, test := range tests {
+		requests := fmt.Sprintf("a:%[1]s/1,b:%[1]s/2,c:%[1]s/3,d:%[1]s/fail,e:%[1]s/none", testServer.URL)
+		req := httptest.NewRequest("GET", "/?summary=true&requests="+requests+"&"+strings.Replace(test.query, "$", "%24", -1), nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.code {
+			t.Fatalf("%v: expected %v found %v", test.query, test.code, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.expected) {
+			t.Fatalf("%v: expected %v found %v", test.query, test.expected, w.Body.String())
+		}
+	}
+
+	tokens, err := parseJSONPath("$.items[1]['a key'].price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []interface{}{"items", 1, "a key", "price"}; !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("expected %v found %v", expected, tokens)
+	}
+	for _, path := range []string{"items", "$..a", "$[x]", "$[1", "$['a'", "$a"} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Fatalf("%v: expected an error", path)
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRoundTripper(t *testing.T) {
+	var wrapped int32
+	wrap := func(next http.RoundTripper) http.RoundTripper {
+		return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&wrapped, 1)
+			return next.RoundTrip(r)
+		})
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer testServer.Close()
+
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: testServer.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2", ttfb: time.Second},
+	)
+	orchestra.WrapRoundTripper(wrap)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	if wrapped != 2 || !strings.Contains(w.Body.String(), "OK/2") {
+		t.Fatalf("expected 2 wrapped requests found %v %s", wrapped, w.Body.String())
+	}
+
+	orchestra = NewOrchestra(ConnRequest{id: "id1", url: "http://mock.invalid/1"})
+	orchestra.SetRoundTripper(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(strings.NewReader("mocked " + r.URL.Path)),
+			Request:    r,
+		}, nil
+	}))
+	orchestra.WrapRoundTripper(wrap)
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if wrapped != 3 || !strings.Contains(w.Body.String(), `"body":"mocked /1"`) {
+		t.Fatalf("expected wrapped mocked response found %v %s", wrapped, w.Body.String())
+	}
+}
+
+func TestProblemErrors(t *testing.T) {
+	defer func(format string) { *errorFormat = format }(*errorFormat)
+	*errorFormat = "problem"
+	tests := []struct {
+		url    string
+		status int
+		detail string
+		errors int
+	}{
+		{"/", http.StatusBadRequest, badRequestRequiredMsg, 0},
+		{"/?all_errors=true&requests=id1:http://a.xyz,,", http.StatusBadRequest, badRequestInvalidMsg, 2},
+		{"/?requests=id1:http://a.xyz,,", http.StatusBadRequest, badRequestInvalidMsg, 0},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var p problem
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != test.status || w.Header().Get("Content-Type") != problemContentType {
+			t.Fatalf("%v: expected %v problem found %v %v", test.url, test.status, w.Code, w.Header())
+		}
+		if p.Type != "about:blank" || p.Title != "Bad Request" || p.Status != test.status || p.Detail != test.detail || len(p.Errors) != test.errors {
+			t.Fatalf("%v: unexpected problem %+v", test.url, p)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	retryHandler(w, httptest.NewRequest("GET", retryPath+"?id=unknown", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != problemContentType {
+		t.Fatalf("expected not found problem found %v %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	writeOverload(w)
+	if w.Code != *overloadStatus || w.Header().Get("Content-Type") != problemContentType || !strings.Contains(w.Body.String(), `"detail":"server overloaded, retry later"`) {
+		t.Fatalf("expected overload problem found %v %v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestCollapseErrors(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(okHandler)
+	defer testServer.Close()
+	down := httptest.NewServer(okHandler)
+	down.Close()
+	orchestra := NewOrchestra(
+		ConnRequest{id: "id1", url: down.URL + "/1"},
+		ConnRequest{id: "id2", url: testServer.URL + "/2"},
+		ConnRequest{id: "id3", url: down.URL + "/3"},
+		ConnRequest{id: "id4", url: ":invalid"},
+	)
+	orchestra.SetCollapseErrors(true)
+	orchestra.SetSummary(true)
+	w := httptest.NewRecorder()
+	orchestra.Process(w)
+	var out struct {
+		Results []map[string]interface{} `json:"results"`
+		Summary summary                  `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Results) != 3 {
+		t.Fatalf("expected 3 entries found %v", w.Body.String())
+	}
+	if ids, _ := json.Marshal(out.Results[0]["ids"]); string(ids) != `["id1","id3"]` || out.Results[0]["error"] != collapsedError(orchestra.conns[0].Response.err) {
+		t.Fatalf("expected collapsed error found %v", out.Results[0])
+	}
+	if out.Results[1]["id"] != "id2" || out.Results[2]["id"] != "id4" || out.Results[2]["error"] == nil {
+		t.Fatalf("expected responses as is found %v", w.Body.String())
+	}
+	if out.Summary.Count != 4 || out.Summary.Failed != 3 {
+		t.Fatalf("expected every connection in the summary found %+v", out.Summary)
+	}
+
+	req := httptest.NewRequest("GET", "/?collapse_errors=true&requests=a:"+down.URL+"/a,b:"+down.URL+"/b", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	var m []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0]["ids"] == nil {
+		t.Fatalf("expected collapsed error found %v", w.Body.String())
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+	testServer := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer testServer.Close()
+	newOrchestra := func() *Orchestra {
+		orchestra := NewOrchestra(
+			ConnRequest{id: "fast", url: testServer.URL + "/fast"},
+			ConnRequest{id: "slow", url: testServer.URL + "/slow", delay: 300 * time.Millisecond},
+		)
+		orchestra.SetTotalTimeout(100 * time.Millisecond)
+		return orchestra
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	newOrchestra().Process(w)
+	if w.Code != http.StatusGatewayTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected %v within the total timeout found %v after %v", http.StatusGatewayTimeout, w.Code, time.Since(start))
+	}
+
+	orchestra := newOrchestra()
+	orchestra.UseStream()
+	w = httptest.NewRecorder()
+	orchestra.Process(w)
+	if !strings.Contains(w.Body.String(), `"id":"fast"`) || strings.Contains(w.Body.String(), `"id":"slow"`) {
+		t.Fatalf("expected only the fast response found %s", w.Body.String())
+	}
+	if w.Header().Get(trailerStatus) != "failed" || w.Header().Get(trailerCount) != "1" {
+		t.Fatalf("expected failed status of 1 response found %v", w.Header())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// orchestrationSlots limits the in-flight orchestrations of the server, nil for no
+// limit.
+var orchestrationSlots chan struct{}
+
+// setMaxOrchestrations sets the maximum number of in-flight orchestrations of the
+// server. 0 means no limit.
+func setMaxOrchestrations(n int) {
+	if n <= 0 {
+		orchestrationSlots = nil
+		return
+	}
+	orchestrationSlots = make(chan struct{}, n)
+}
+
+// limitOrchestrations returns h limited to the maximum in-flight orchestrations of
+// the server. Requests beyond the limit are not queued but shed with the overload
+// response.
+func limitOrchestrations(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := acquireOrchestration()
+		if !ok {
+			writeOverload(w)
+			return
+		}
+		defer release()
+		h(w, r)
+	}
+}
+
+// acquireOrchestration takes a slot of the in-flight orchestrations of the server
+// without waiting. It returns the function releasing the slot, or false if none is
+// free.
+func acquireOrchestration() (func(), bool) {
+	slots := orchestrationSlots
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// writeOverload writes the overload response of the server to w, with a Retry-After
+// header in whole seconds if set. The body is served as json if valid json, or as the
+// detail of problem details if enabled.
+func writeOverload(w http.ResponseWriter) {
+	if d := *overloadRetryAfter; d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	}
+	if useProblems() {
+		writeProblem(w, *overloadStatus, *overloadBody, nil)
+		return
+	}
+	if json.Valid([]byte(*overloadBody)) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(*overloadStatus)
+	io.WriteString(w, *overloadBody)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// startPath is the path of requests starting an orchestration in the background,
+// polled by its id at statusPath.
+const startPath = "/start"
+
+// statusPath is the path of requests polling the results of an orchestration
+// started at startPath, named by the id parameter.
+const statusPath = "/status"
+
+// pollsSize is the maximum number of orchestrations kept for polling.
+const pollsSize = 1000
+
+// serverPolls are the orchestrations of the server started for polling.
+var serverPolls = newPolls(pollsSize)
+
+// polls stores the results of orchestrations by id while they run and until they
+// expire once completed. It is safe for concurrent use.
+type polls struct {
+	mu         sync.Mutex
+	entries    map[string]*poll
+	maxEntries int
+}
+
+// poll is an orchestration started for polling.
+type poll struct {
+	results []json.RawMessage // json output of the completed connections, in order of completion
+	done    bool
+	status  string    // aggregate status once done
+	expires time.Time // zero while running
+}
+
+// pollOutput is the output struct of the status of a polled orchestration.
+type pollOutput struct {
+	ID      string            `json:"id"`
+	Done    bool              `json:"done"`
+	Status  string            `json:"status,omitempty"`
+	Results []json.RawMessage `json:"results"`
+}
+
+func newPolls(maxEntries int) *polls {
+	return &polls{
+		entries:    make(map[string]*poll),
+		maxEntries: maxEntries,
+	}
+}
+
+// add adds a running orchestration by id. Expired entries are evicted when full,
+// or an arbitrary completed entry if there are none. It reports false if all
+// entries are running.
+func (p *polls) add(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.entries[id]; !ok && len(p.entries) >= p.maxEntries {
+		now := time.Now()
+		for k, e := range p.entries {
+			if e.done && now.After(e.expires) {
+				delete(p.entries, k)
+			}
+		}
+		for k, e := range p.entries {
+			if len(p.entries) < p.maxEntries {
+				break
+			}
+			if e.done {
+				delete(p.entries, k)
+			}
+		}
+		if len(p.entries) >= p.maxEntries {
+			return false
+		}
+	}
+	p.entries[id] = &poll{results: []json.RawMessage{}}
+	return true
+}
+
+// get returns the output of the orchestration id, false if unknown or expired.
+func (p *polls) get(id string) (pollOutput, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[id]
+	if !ok || (e.done && time.Now().After(e.expires)) {
+		delete(p.entries, id)
+		return pollOutput{}, false
+	}
+	return pollOutput{ID: id, Done: e.done, Status: e.status, Results: e.results[:len(e.results):len(e.results)]}, true
+}
+
+// append adds the json output of a completed connection to the orchestration id.
+func (p *polls) append(id string, result json.RawMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		e.results = append(e.results, result)
+	}
+}
+
+// finish marks the orchestration id done with status, to expire after ttl.
+func (p *polls) finish(id, status string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		e.done = true
+		e.status = status
+		e.expires = time.Now().Add(ttl)
+	}
+}
+
+// startHandler starts the orchestration of the request in the background and
+// responds with 202 Accepted and its id to poll the results with at statusPath.
+// The id is generated by the server, never taken from the request, so clients
+// cannot read or replace the results of others. The orchestration counts towards
+// the maximum in-flight orchestrations until it completes.
+func startHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := digestRequest(r)
+	if err != nil {
+		writeParamsError(w, r, err)
+		return
+	}
+	release, ok := acquireOrchestration()
+	if !ok {
+		writeOverload(w)
+		return
+	}
+	id := newName()
+	if !serverPolls.add(id) {
+		release()
+		writeOverload(w)
+		return
+	}
+	params.respType = typeStream
+	orchestra := NewOrchestra(params.conns...)
+	initOrchestra(orchestra, params)
+	forward(orchestra, r, *forwardHeaders)
+	go func() {
+		defer release()
+		pw := &pollWriter{id: id, header: make(http.Header)}
+		orchestra.Process(pw)
+		serverPolls.finish(id, pw.header.Get(trailerStatus), *pollTTL)
+	}()
+
+	w.Header().Set("Location", statusPath+"?id="+url.QueryEscape(id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+// statusHandler responds with the results of the orchestration named by the id
+// parameter completed so far, and whether it is done. It responds with 404 for
+// unknown or expired orchestrations.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	out, ok := serverPolls.get(r.FormValue("id"))
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// pollWriter is an http.ResponseWriter adding each line of stream output written
+// to it to the results of the polled orchestration id.
+type pollWriter struct {
+	id     string
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (w *pollWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pollWriter) WriteHeader(int) {}
+
+func (w *pollWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(w.buf.Next(i + 1))
+		if len(line) > 0 {
+			serverPolls.append(w.id, json.RawMessage(append([]byte(nil), line...)))
+		}
+	}
+	return len(p), nil
+}
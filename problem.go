@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// problemContentType is the media type of RFC 7807 problem details.
+const problemContentType = "application/problem+json"
+
+// problem is the RFC 7807 problem details of a handler error, with the parse
+// errors of all connection requests as an extension member if requested.
+type problem struct {
+	Type   string      `json:"type"`
+	Title  string      `json:"title"`
+	Status int         `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Errors parseErrors `json:"errors,omitempty"`
+}
+
+// useProblems reports if handler errors are written as problem details.
+func useProblems() bool {
+	return *errorFormat == "problem"
+}
+
+// writeProblem writes the handler error with status and detail to w as problem
+// details, with errs if not nil.
+func writeProblem(w http.ResponseWriter, status int, detail string, errs parseErrors) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Errors: errs,
+	})
+}
+
+// notFound responds with 404 Not Found, as problem details if enabled.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if useProblems() {
+		writeProblem(w, http.StatusNotFound, "", nil)
+		return
+	}
+	http.NotFound(w, r)
+}
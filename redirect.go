@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// SetMaxRedirectBodySize sets the maximum size in bytes of the bodies of redirects
+// read before they are followed. Bodies up to the maximum are read in full so the
+// connection is reused for the redirected request. Larger bodies are discarded after
+// at most n bytes and their connection is closed. 0 leaves redirect bodies to the
+// http client, which reads at most 2KB. Defaults to 0.
+func (o *Orchestra) SetMaxRedirectBodySize(n int64) {
+	o.opts.maxRedirectBodySize = n
+}
+
+// isRedirect reports if resp is a redirect followed by the http client.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+// redirectTransport is a RoundTripper reading the bodies of the redirects of rt up
+// to max bytes, discarding larger ones.
+type redirectTransport struct {
+	rt  http.RoundTripper
+	max int64
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil || !isRedirect(resp) {
+		return resp, err
+	}
+	var b []byte
+	if resp.ContentLength <= t.max {
+		b, err = ioutil.ReadAll(io.LimitReader(resp.Body, t.max+1))
+		if err != nil || int64(len(b)) > t.max {
+			b = nil
+		}
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	return resp, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayPath is the path prefix of replay requests, followed by the id of the
+// orchestration to replay.
+const replayPath = "/replay/"
+
+// retryPath is the path of requests to retry the failed connections of a recorded
+// orchestration, named by the id parameter.
+const retryPath = "/retry"
+
+// replayIDHeader is the response header with the id an orchestration is recorded by
+// for replay.
+const replayIDHeader = "X-Orchestra-Replay-Id"
+
+// replaysSize is the maximum number of orchestrations recorded for replay.
+const replaysSize = 1000
+
+// serverReplays are the orchestrations of the server recorded for replay.
+var serverReplays = newReplays(replaysSize)
+
+// replays stores the params of orchestrations by id until they expire. Ids are
+// generated by the server so clients cannot replace or replay the orchestrations of
+// others. It is safe for concurrent use.
+type replays struct {
+	mu         sync.Mutex
+	entries    map[string]replay
+	maxEntries int
+}
+
+// replay is a recorded orchestration.
+type replay struct {
+	params    params
+	expires   time.Time
+	succeeded map[string]json.RawMessage // json output of connections that did not fail, by id
+}
+
+func newReplays(maxEntries int) *replays {
+	return &replays{
+		entries:    make(map[string]replay),
+		maxEntries: maxEntries,
+	}
+}
+
+func (r *replays) get(id string) (params, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		delete(r.entries, id)
+		return params{}, false
+	}
+	return e.params, true
+}
+
+// set records p by id for ttl. Expired entries are evicted when full, or an
+// arbitrary entry if there are none.
+func (r *replays) set(id string, p params, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[id]; !ok && len(r.entries) >= r.maxEntries {
+		now := time.Now()
+		for k, e := range r.entries {
+			if now.After(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		for k := range r.entries {
+			if len(r.entries) < r.maxEntries {
+				break
+			}
+			delete(r.entries, k)
+		}
+	}
+	r.entries[id] = replay{params: p, expires: time.Now().Add(ttl)}
+}
+
+// succeeded returns the json output of the connections of the orchestration id
+// that did not fail, nil if unknown or not recorded.
+func (r *replays) succeeded(id string) map[string]json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.entries[id].succeeded
+}
+
+// setSucceeded records the json output of the connections of the orchestration id
+// that did not fail. It does nothing if id is unknown.
+func (r *replays) setSucceeded(id string, succeeded map[string]json.RawMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[id]; ok {
+		e.succeeded = succeeded
+		r.entries[id] = e
+	}
+}
+
+// replayHandler runs the recorded orchestration with the id of the request path
+// again, under a new name. It responds with 404 for unknown or expired orchestrations.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := serverReplays.get(strings.TrimPrefix(r.URL.Path, replayPath))
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	p.name = newName()
+	orchestra := NewOrchestra(p.conns...)
+	initOrchestra(orchestra, p)
+	forward(orchestra, r, *forwardHeaders)
+	orchestra.Process(w)
+}
+
+// retryHandler runs the failed connections of the recorded orchestration with the
+// id parameter again and responds with their fresh results merged with the prior
+// successful results, as a json array in the order of the connections. Connections a
+// retried connection depends on are run again too. It responds with 404 for unknown
+// or expired orchestrations.
+func retryHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	p, ok := serverReplays.get(id)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	prior := serverReplays.succeeded(id)
+	all := p.conns
+	p.conns = retryConns(all, prior)
+	p.respType = typeJson
+	p.summary = false
+
+	orchestra := NewOrchestra(p.conns...)
+	initOrchestra(orchestra, p)
+	forward(orchestra, r, *forwardHeaders)
+	var out bytes.Buffer
+	cw := &cliWriter{Writer: &out, header: make(http.Header)}
+	orchestra.Process(cw)
+	fresh := succeeded(orchestra, out.Bytes())
+	for id, raw := range prior {
+		if _, ok := fresh[id]; !ok {
+			fresh[id] = raw
+		}
+	}
+	serverReplays.setSucceeded(id, fresh)
+
+	results := outputsByID(out.Bytes())
+	merged := make([]json.RawMessage, 0, len(all))
+	for _, c := range all {
+		if raw, ok := results[c.id]; ok {
+			merged = append(merged, raw)
+		} else if raw, ok := prior[c.id]; ok {
+			merged = append(merged, raw)
+		}
+	}
+	for k, v := range cw.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
+
+// retryConns returns the connections of conns to run again, those without a
+// successful result in succeeded and not mirrors of one, and the connections they
+// depend on.
+func retryConns(conns []ConnRequest, succeeded map[string]json.RawMessage) []ConnRequest {
+	mirrors := make(map[string]bool)
+	for _, c := range conns {
+		if _, ok := succeeded[c.id]; ok && c.mirror != "" {
+			mirrors[c.mirror] = true
+		}
+	}
+	retry := make(map[string]bool)
+	for _, c := range conns {
+		if _, ok := succeeded[c.id]; !ok && !mirrors[c.mirror] {
+			retry[c.id] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, c := range conns {
+			if retry[c.id] && c.dependsOn != "" && !retry[c.dependsOn] {
+				retry[c.dependsOn] = true
+				changed = true
+			}
+		}
+	}
+	var retried []ConnRequest
+	for _, c := range conns {
+		if retry[c.id] {
+			retried = append(retried, c)
+		}
+	}
+	return retried
+}
+
+// succeeded returns the json output of the connections of o that did not fail, by
+// id, given the json output of o.
+func succeeded(o *Orchestra, output []byte) map[string]json.RawMessage {
+	failed := make(map[string]bool)
+	for _, c := range o.conns {
+		if c.Response == nil || c.Response.failed() {
+			failed[c.id] = true
+		}
+	}
+	outputs := outputsByID(output)
+	for id := range outputs {
+		if failed[id] {
+			delete(outputs, id)
+		}
+	}
+	return outputs
+}
+
+// outputsByID returns the results of the json output of an orchestration, with or
+// without a summary, by id. Results without an id are skipped.
+func outputsByID(output []byte) map[string]json.RawMessage {
+	var results []json.RawMessage
+	if err := json.Unmarshal(output, &results); err != nil {
+		var s struct {
+			Results []json.RawMessage `json:"results"`
+		}
+		json.Unmarshal(output, &s)
+		results = s.Results
+	}
+	outputs := make(map[string]json.RawMessage, len(results))
+	for _, raw := range results {
+		var out struct {
+			Id string `json:"id"`
+		}
+		if json.Unmarshal(raw, &out) == nil && out.Id != "" {
+			outputs[out.Id] = raw
+		}
+	}
+	return outputs
+}
+
+// recordingWriter is an http.ResponseWriter keeping a copy of the body written.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Resolver resolves the url of a logical service, e.g. svc://payments/status, into
+// a concrete url, e.g. by Consul, DNS SRV records or a static map.
+type Resolver interface {
+	Resolve(u *url.URL) (*url.URL, error)
+}
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = make(map[string]Resolver)
+)
+
+// RegisterResolver registers r to resolve connection urls with scheme, before they
+// are fetched. Registering nil removes the resolver of scheme.
+func RegisterResolver(scheme string, r Resolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if r == nil {
+		delete(resolvers, scheme)
+		return
+	}
+	resolvers[scheme] = r
+}
+
+// StaticResolver resolves urls by a map of service name, the host of the url, to the
+// base url of the service. The path of the url is appended to the path of the base url.
+type StaticResolver map[string]string
+
+// Resolve resolves u by the base url of its host.
+func (s StaticResolver) Resolve(u *url.URL) (*url.URL, error) {
+	base, ok := s[u.Host]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", u.Host)
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *u
+	resolved.Scheme = b.Scheme
+	resolved.Host = b.Host
+	resolved.Path = strings.TrimSuffix(b.Path, "/") + u.Path
+	resolved.RawPath = ""
+	return &resolved, nil
+}
+
+// resolveURL resolves raw with the resolver registered for its scheme. raw is
+// returned as is if there is none.
+func resolveURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// leave it to http.NewRequest to report
+		return raw, nil
+	}
+	resolversMu.RLock()
+	r, ok := resolvers[strings.ToLower(u.Scheme)]
+	resolversMu.RUnlock()
+	if !ok {
+		return raw, nil
+	}
+	resolved, err := r.Resolve(u)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", raw, err)
+	}
+	return resolved.String(), nil
+}
+
+// resolveConns resolves the urls and fallback urls of conns with the registered
+// resolvers.
+func resolveConns(conns []ConnRequest) parseErrors {
+	var errs parseErrors
+	for i := range conns {
+		u, err := resolveURL(conns[i].url)
+		if err != nil {
+			errs = append(errs, parseError{Index: i, Value: conns[i].url, Error: err.Error()})
+			continue
+		}
+		if u != conns[i].url {
+			conns[i].rawURL = conns[i].url
+			conns[i].url = u
+		}
+		for j, f := range conns[i].fallbacks {
+			u, err := resolveURL(f)
+			if err != nil {
+				errs = append(errs, parseError{Index: i, Value: f, Error: err.Error()})
+				continue
+			}
+			conns[i].fallbacks[j] = u
+		}
+	}
+	return errs
+}
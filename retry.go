@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetRetries sets the maximum number of times a failed request is retried.
+// Defaults to 0.
+func (o *Orchestra) SetRetries(n int) {
+	o.opts.retries = n
+}
+
+// SetRetryBackoff sets the wait before the first retry. The wait is doubled
+// for each subsequent retry.
+func (o *Orchestra) SetRetryBackoff(d time.Duration) {
+	o.opts.retryBackoff = d
+}
+
+// SetMaxRetryDuration sets the maximum time spent fetching a request, including
+// retries and the waits between them. A request is not retried if the retry would
+// start after the maximum, regardless of the retries remaining. 0 means no limit.
+// Defaults to 0.
+func (o *Orchestra) SetMaxRetryDuration(d time.Duration) {
+	o.opts.maxRetryDuration = d
+}
+
+// SetRetryPredicate sets the function that reports if a Response should be retried.
+// The Response body can be read with ReadAll without affecting the output.
+// Defaults to retrying network errors and 5xx status codes, except for POST and
+// PATCH requests, which are not idempotent, and requests that could not be created.
+func (o *Orchestra) SetRetryPredicate(f func(*Response) bool) {
+	o.opts.retryPredicate = f
+}
+
+// attemptsMade returns the attempts made for r if retries are enabled, 0 otherwise.
+func (r *Response) attemptsMade() int {
+	if r.opts == nil || r.opts.retries <= 0 {
+		return 0
+	}
+	return r.attempts
+}
+
+// shouldRetry reports if r should be retried.
+func (c *Conn) shouldRetry(r *Response) bool {
+	if c.opts.retryPredicate != nil {
+		return c.opts.retryPredicate(r)
+	}
+	return defaultRetryPredicate(r)
+}
+
+// defaultRetryPredicate retries failed responses of idempotent requests. Requests
+// that could not be created, e.g. of invalid urls, are never retried.
+func defaultRetryPredicate(r *Response) bool {
+	if r.req == nil || !idempotent(r.req.Method) {
+		return false
+	}
+	return r.failed()
+}
+
+// retryWait returns the wait before retrying r after attempt. The Retry-After header
+// of 429 and 503 responses is honored, capped by the connection timeout. Otherwise,
+// it is the retry backoff for attempt.
+func (c *Conn) retryWait(r *Response, attempt int) time.Duration {
+	backoff := c.opts.retryBackoff << uint(attempt)
+	if r.Response == nil {
+		return backoff
+	}
+	if r.StatusCode != http.StatusTooManyRequests && r.StatusCode != http.StatusServiceUnavailable {
+		return backoff
+	}
+	wait, ok := parseRetryAfter(r.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return backoff
+	}
+	if c.Timeout > 0 && wait > c.Timeout {
+		wait = c.Timeout
+	}
+	return wait
+}
+
+// parseRetryAfter parses the value of a Retry-After header in either delay seconds
+// or HTTP-date format into the wait from now.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if wait := t.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
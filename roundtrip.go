@@ -0,0 +1,58 @@
+package main
+
+import "net/http"
+
+// SetRoundTripper replaces the transport of all connections with rt, e.g. for custom
+// caching, instrumentation or mocking. rt is used as is, so transport settings such as
+// the proxy, keep alive, client certificates and time to first byte timeouts have no
+// effect. Wrappers set with WrapRoundTripper wrap rt. nil restores the transport.
+func (o *Orchestra) SetRoundTripper(rt http.RoundTripper) {
+	o.opts.roundTripper = rt
+}
+
+// WrapRoundTripper wraps the transport of each connection with wrap, e.g. to record
+// metrics, while keeping the transport settings of the Orchestra and connection.
+// Wrappers apply in the order set, the last set being outermost.
+func (o *Orchestra) WrapRoundTripper(wrap func(http.RoundTripper) http.RoundTripper) {
+	o.opts.wrappers = append(o.opts.wrappers, wrap)
+}
+
+// wrapTransport returns t, or the round tripper set in opts if any, wrapped with the
+// wrappers of opts. A nil t is http.DefaultTransport.
+func wrapTransport(opts *options, t http.RoundTripper) http.RoundTripper {
+	if opts.roundTripper != nil {
+		t = opts.roundTripper
+	}
+	if len(opts.wrappers) == 0 {
+		return t
+	}
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	for _, wrap := range opts.wrappers {
+		t = wrap(t)
+	}
+	return t
+}
+
+// addTransport records t, a copy of the transport made for a connection, to close
+// its idle connections when done.
+func (opts *options) addTransport(t *http.Transport) {
+	opts.transportsMu.Lock()
+	defer opts.transportsMu.Unlock()
+	opts.transports = append(opts.transports, t)
+}
+
+// closeIdleConnections closes the idle connections of the transports of o, which are
+// not shared with other Orchestras. http.DefaultTransport and a round tripper set by
+// SetRoundTripper are left as is.
+func (o *Orchestra) closeIdleConnections() {
+	if o.opts.transport != nil {
+		o.opts.transport.CloseIdleConnections()
+	}
+	o.opts.transportsMu.Lock()
+	defer o.opts.transportsMu.Unlock()
+	for _, t := range o.opts.transports {
+		t.CloseIdleConnections()
+	}
+}
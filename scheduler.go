@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// adaptiveLatencyFactor is the multiple of the lowest latency observed beyond which
+// adaptive concurrency considers a response slow.
+const adaptiveLatencyFactor = 2
+
+// fetchSlots limits the concurrent fetches of all Orchestras of the process, nil
+// for no limit.
+var fetchSlots chan struct{}
+
+// SetMaxFetches sets the maximum number of concurrent fetches across all Orchestras
+// of the process, to keep concurrent orchestrations within the limits of the OS.
+// Fetches wait for the concurrency of their Orchestra first. 0 means no limit.
+// Defaults to 0.
+func SetMaxFetches(n int) {
+	if n <= 0 {
+		fetchSlots = nil
+		return
+	}
+	fetchSlots = make(chan struct{}, n)
+}
+
+// acquireFetch waits until a fetch can start within the maximum fetches of the
+// process. It returns the slots to release the fetch to.
+func acquireFetch() chan struct{} {
+	slots := fetchSlots
+	if slots != nil {
+		slots <- struct{}{}
+	}
+	return slots
+}
+
+// releaseFetch marks a fetch acquired from slots as complete.
+func releaseFetch(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// SetConcurrency sets the maximum number of concurrent fetches. 0 means no limit.
+// Defaults to 0.
+func (o *Orchestra) SetConcurrency(n int) {
+	o.opts.concurrency = n
+	o.opts.adaptive = false
+}
+
+// SetAdaptiveConcurrency instructs the Orchestra to start with base concurrent fetches
+// and adjust the concurrency between 1 and max as fetches complete. The concurrency is
+// increased by one for each fast successful fetch and halved for each failed fetch or
+// fetch slower than twice the lowest latency observed.
+func (o *Orchestra) SetAdaptiveConcurrency(base, max int) {
+	if base > max {
+		base = max
+	}
+	o.opts.concurrency = base
+	o.opts.maxConcurrency = max
+	o.opts.adaptive = true
+}
+
+// SetRamp instructs the Orchestra to increase the concurrency linearly from start to
+// the concurrency set by SetConcurrency over d, e.g. to warm a cache gradually. The
+// ramp schedule is included in the summary. Ramp has no effect without concurrency or
+// with adaptive concurrency. 0 means no ramp. Defaults to 0.
+func (o *Orchestra) SetRamp(start int, d time.Duration) {
+	if start < 1 {
+		start = 1
+	}
+	o.opts.rampStart = start
+	o.opts.ramp = d
+}
+
+// rampStep is a step of the ramp schedule, the concurrency allowed from At.
+type rampStep struct {
+	AtMs        int64 `json:"at_ms"`
+	Concurrency int   `json:"concurrency"`
+}
+
+// ramping reports if the concurrency of o ramps up.
+func (o *Orchestra) ramping() bool {
+	return o.opts.ramp > 0 && !o.opts.adaptive && o.opts.rampStart < o.opts.concurrency
+}
+
+// rampSchedule returns the ramp schedule of o, nil if the concurrency does not ramp up.
+func (o *Orchestra) rampSchedule() []rampStep {
+	if !o.ramping() {
+		return nil
+	}
+	var steps []rampStep
+	for n := o.opts.rampStart; n <= o.opts.concurrency; n++ {
+		at := rampAt(o.opts.rampStart, o.opts.concurrency, n, o.opts.ramp)
+		steps = append(steps, rampStep{AtMs: int64(at / time.Millisecond), Concurrency: n})
+	}
+	return steps
+}
+
+// rampAt returns the offset into a ramp from start to target over d at which the
+// concurrency reaches n.
+func rampAt(start, target, n int, d time.Duration) time.Duration {
+	return d * time.Duration(n-start) / time.Duration(target-start)
+}
+
+// newLimiter creates a limiter for the concurrency settings of o.
+// It returns nil if there is no limit.
+func (o *Orchestra) newLimiter() *limiter {
+	if o.opts.concurrency <= 0 {
+		return nil
+	}
+	l := &limiter{
+		limit:    o.opts.concurrency,
+		adaptive: o.opts.adaptive,
+		max:      o.opts.maxConcurrency,
+	}
+	if o.ramping() {
+		l.rampStart = o.opts.rampStart
+		l.ramp = o.opts.ramp
+		l.rampFrom = time.Now()
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// limiter limits the number of concurrent fetches. A nil limiter has no limit.
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+
+	adaptive   bool          // adjust limit as fetches complete
+	max        int           // maximum adaptive limit
+	minLatency time.Duration // lowest latency observed
+
+	rampStart int           // concurrency at the start of the ramp
+	ramp      time.Duration // duration of the ramp up to limit, 0 for none
+	rampFrom  time.Time     // start of the ramp
+
+	pending int // prioritized fetches deferred fetches wait for to start
+}
+
+// setPending sets the number of prioritized fetches deferred fetches wait for.
+func (l *limiter) setPending(n int) {
+	if l != nil {
+		l.pending = n
+	}
+}
+
+// acquire waits until a fetch with schedule s can start. Deferred fetches also wait
+// until the pending fetches started. It returns the time waited.
+func (l *limiter) acquire(s *schedule) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	for {
+		limit, next := l.current()
+		if l.active < limit && !(s.deferred() && l.pending > 0) {
+			break
+		}
+		if next <= 0 {
+			l.cond.Wait()
+			continue
+		}
+		// the limit increases without a fetch completing.
+		t := time.AfterFunc(next, l.cond.Broadcast)
+		l.cond.Wait()
+		t.Stop()
+	}
+	l.active++
+	if s != nil && s.pending {
+		if l.pending--; l.pending == 0 {
+			l.cond.Broadcast()
+		}
+	}
+	l.mu.Unlock()
+	return time.Since(now)
+}
+
+// current returns the concurrency limit and, while ramping up, the time until it
+// next increases.
+func (l *limiter) current() (int, time.Duration) {
+	if l.ramp <= 0 {
+		return l.limit, 0
+	}
+	elapsed := time.Since(l.rampFrom)
+	if elapsed >= l.ramp {
+		return l.limit, 0
+	}
+	n := l.rampStart + int(time.Duration(l.limit-l.rampStart)*elapsed/l.ramp)
+	return n, rampAt(l.rampStart, l.limit, n+1, l.ramp) - elapsed
+}
+
+// release marks a fetch with response r as complete.
+func (l *limiter) release(r *Response) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.active--
+	if l.adaptive && r != nil {
+		l.adjust(r)
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// adjust increases the limit additively for fast successful responses and
+// decreases it multiplicatively otherwise.
+func (l *limiter) adjust(r *Response) {
+	failed := r.failed()
+	if !failed && (l.minLatency == 0 || r.duration < l.minLatency) {
+		l.minLatency = r.duration
+	}
+	if failed || r.duration > adaptiveLatencyFactor*l.minLatency {
+		if l.limit /= 2; l.limit < 1 {
+			l.limit = 1
+		}
+		return
+	}
+	if l.limit < l.max {
+		l.limit++
+	}
+}
+
+// sequences returns the connection each grouped connection of conns is fetched after.
+// Connections of a group are fetched one after another by order, while groups and
+// connections without a group are fetched concurrently.
+func sequences(conns []*Conn) map[*Conn]*Conn {
+	var keys []string
+	groups := make(map[string][]*Conn)
+	for _, c := range conns {
+		if c.group == "" {
+			continue
+		}
+		if _, ok := groups[c.group]; !ok {
+			keys = append(keys, c.group)
+		}
+		groups[c.group] = append(groups[c.group], c)
+	}
+	after := make(map[*Conn]*Conn)
+	for _, key := range keys {
+		g := groups[key]
+		sort.SliceStable(g, func(i, j int) bool { return g[i].order < g[j].order })
+		for i := 1; i < len(g); i++ {
+			after[g[i]] = g[i-1]
+		}
+	}
+	return after
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,23 +24,175 @@ func init() {
 }
 
 const (
-	badRequestInvalidMsg  = "Bad Request: entries should be in comma separated multiple 'id:url' format e.g. 'sampleid:http://url.com,sampleid2:http://url2.com'"
-	badRequestRequiredMsg = "Bad Request: required parameter 'requests' missing."
+	badRequestInvalidMsg   = "Bad Request: entries should be in comma separated multiple 'id:url' format e.g. 'sampleid:http://url.com,sampleid2:http://url2.com'"
+	badRequestRequiredMsg  = "Bad Request: required parameter 'requests' missing."
+	badRequestJsonMsg      = "Bad Request: body should be a json array of requests with 'url' and optional 'id' e.g. [{\"id\": \"sampleid\", \"url\": \"http://url.com\"}]"
+	badRequestURLLengthMsg = "Bad Request: url of '%s' exceeds the maximum length of %d"
+	badRequestOnlyMsg      = "Bad Request: 'only' should be 'failed'"
+	badRequestOrderMsg     = "Bad Request: 'stream_order' should be one of 'completion' and 'input'"
+	badRequestChaosMsg     = "Bad Request: 'chaos' should be a percentage from 0 to 100"
+	badRequestNoChaosMsg   = "Bad Request: 'chaos' requires the server to be started with -chaos"
+	badRequestUTF8Msg      = "Bad Request: 'invalid_utf8' should be one of 'replace', 'base64' and 'error'"
+	badRequestLabelsMsg    = "Bad Request: 'labels' should be in comma separated multiple 'key:value' format e.g. 'tenant:acme,env:prod'"
+	badRequestFieldsMsg    = "Bad Request: unknown field '%s' in 'fields'"
+	badRequestCompareMsg   = "Bad Request: 'compare' should be two comma separated requested ids e.g. 'sampleid,sampleid2'"
+	badRequestAggregateMsg = "Bad Request: 'aggregate' should be a function, one of 'sum', 'avg', 'min' and 'max', and a JSONPath e.g. 'sum:$.count'"
+	badRequestConnMsg      = "Bad Request: '%s' should be in comma separated multiple 'id:value' format for requested ids e.g. 'sampleid:value,sampleid2:value2'"
+)
+
+// maxConfigSize is the maximum size of a Json request body.
+const maxConfigSize = 1 << 20
+
+// adaptiveConcurrencyBase is the initial concurrency of adaptive concurrency.
+const adaptiveConcurrencyBase = 4
+
+// handlerTimeoutGrace is the time the write timeout of the server exceeds the
+// handler timeout by, to write the response of timed out orchestrations.
+const handlerTimeoutGrace = 5 * time.Second
+
+// serverCacheSize is the maximum number of responses cached by the server.
+const serverCacheSize = 1000
+
+// serverCache is the cache shared by all orchestrations of the server.
+var serverCache = NewCache(serverCacheSize)
+
+// serverTokenProvider is the token provider shared by all orchestrations of the
+// server, nil if no token endpoint is set.
+var serverTokenProvider *TokenProvider
+
+// serverClientCert is the client certificate of all orchestrations of the server,
+// nil if none is set.
+var serverClientCert *tls.Certificate
+
+// serverDNSCache is the dns cache shared by all orchestrations of the server, nil if
+// dns caching is not enabled.
+var serverDNSCache *DNSCache
+
+// serverAudit is the audit function of all orchestrations of the server, nil if
+// there is no audit log.
+var serverAudit func(AuditRecord)
+
+// server flags
+var (
+	maxURLLength       = flag.Int("max-url-length", defaultMaxURLLength, "maximum length of request urls, 0 for no limit")
+	maxHeaders         = flag.Int("max-headers", defaultMaxHeaders, "maximum number of request headers, 0 for no limit")
+	maxHeaderSize      = flag.Int("max-header-size", defaultMaxHeaderSize, "maximum size in bytes of request headers, 0 for no limit")
+	maxBodySize        = flag.Int64("max-body-size", 0, "maximum size in bytes of response bodies, 0 for no limit")
+	maxRedirectBody    = flag.Int64("max-redirect-body-size", 0, "maximum size in bytes of redirect bodies read to reuse their connection, 0 for the client default")
+	cli                = flag.Bool("cli", false, "run the requests read from stdin and write the output to stdout instead of serving")
+	outDir             = flag.String("out-dir", "", "with -cli, directory to write each response body to, named by id")
+	tokenURL           = flag.String("token-url", "", "OAuth2 token endpoint to obtain bearer tokens for requests from")
+	tokenClientID      = flag.String("token-client-id", "", "client id for the token endpoint")
+	tokenClientSecret  = flag.String("token-client-secret", "", "client secret for the token endpoint")
+	tokenHosts         = flag.String("token-hosts", "", "comma separated hosts bearer tokens are sent to, required with -token-url")
+	clientCert         = flag.String("client-cert", "", "client certificate file presented to servers requesting one")
+	clientKey          = flag.String("client-key", "", "key file of the client certificate")
+	auditLog           = flag.String("audit-log", "", "file every request sent is recorded in as a line of json")
+	auditBodies        = flag.String("audit-bodies", "", "with -audit-log, record response bodies of failed requests, or of comma separated ids")
+	auditBodySize      = flag.Int("audit-body-size", 4096, "maximum size in bytes of response bodies recorded with -audit-bodies")
+	maxFetches         = flag.Int("max-fetches", 0, "maximum concurrent fetches of all orchestrations, 0 for no limit")
+	maxOrchestrations  = flag.Int("max-orchestrations", 0, "maximum in-flight orchestrations, further requests get the overload response, 0 for no limit")
+	overloadStatus     = flag.Int("overload-status", http.StatusServiceUnavailable, "status code of the overload response")
+	overloadRetryAfter = flag.Duration("overload-retry-after", time.Second, "Retry-After of the overload response, rounded up to seconds, 0 for none")
+	overloadBody       = flag.String("overload-body", "server overloaded, retry later", "body of the overload response, served as json if valid json")
+	pollTTL            = flag.Duration("poll-ttl", 10*time.Minute, "duration the results of orchestrations started at /start are kept for polling once completed")
+	replayTTL          = flag.Duration("replay-ttl", 0, "duration orchestrations are recorded for replay by name, 0 for none")
+	cacheTTL           = flag.Duration("cache-ttl", defaultCacheTTL, "duration responses are served from the cache of stale_if_error and head_first for")
+	cacheBodySize      = flag.Int64("cache-body-size", defaultCacheBodySize, "maximum size in bytes of the bodies of cached responses")
+	dnsCacheTTL        = flag.Duration("dns-cache-ttl", 0, "duration resolved host addresses are cached for across orchestrations, 0 for no cache")
+	services           = flag.String("services", "", "comma separated name=url base urls of services resolved in svc://name/path connection urls")
+	handlerTimeout     = flag.Duration("handler-timeout", 0, "maximum duration of an orchestration, after which streams end and other responses time out, 0 for no limit")
+	bodyDeadline       = flag.Duration("body-deadline", defaultBodyDeadline, "maximum duration of requests whose bodies the timeout does not limit, with ttfb or no timeout, 0 for no limit")
+	errorFormat        = flag.String("error-format", "text", "format of handler errors, text or problem for application/problem+json")
+	forwardHeaders     = flag.String("forward-headers", "", "comma separated headers of incoming requests forwarded to upstreams, each restricted to a host if given as name@host")
+	allowPrivate       = flag.Bool("allow-private", false, "allow requests_url to resolve to private and loopback addresses")
+	chaosEnabled       = flag.Bool("chaos", false, "allow the chaos parameter to inject synthetic failures for resilience testing, never in production")
+	spillSize          = flag.Int64("spill-size", 0, "size in bytes above which response bodies are stored in temporary files, 0 for none")
+	spillDir           = flag.String("spill-dir", "", "directory of the temporary files of -spill-size, the system default if empty")
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: orchestra [flags] [port]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	SetMaxFetches(*maxFetches)
+	serverCache.SetTTL(*cacheTTL)
+	serverCache.SetMaxBodySize(*cacheBodySize)
+	setMaxOrchestrations(*maxOrchestrations)
+	if *errorFormat != "text" && *errorFormat != "problem" {
+		log.Fatalf("invalid error format %q, expected text or problem", *errorFormat)
+	}
+	if *services != "" {
+		s, err := parseServices(*services)
+		if err != nil {
+			log.Fatal(err)
+		}
+		RegisterResolver("svc", s)
+	}
+	if *overloadStatus < 100 || *overloadStatus > 999 {
+		log.Fatalf("invalid overload status %d", *overloadStatus)
+	}
 
-	http.HandleFunc("/", handler)
+	if *dnsCacheTTL > 0 {
+		serverDNSCache = NewDNSCache(*dnsCacheTTL)
+	}
+
+	if *tokenURL != "" {
+		// the token must not reach hosts chosen by clients.
+		if strings.TrimSpace(*tokenHosts) == "" {
+			log.Fatal("-token-url requires -token-hosts")
+		}
+		serverTokenProvider = NewTokenProvider(*tokenURL, *tokenClientID, *tokenClientSecret)
+		serverTokenProvider.SetHosts(strings.Split(*tokenHosts, ",")...)
+	}
+
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverClientCert = &cert
+	}
+
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		serverAudit = NewAuditWriter(f)
+	}
+
+	if *cli {
+		if err := runCLI(os.Stdin, os.Stdout, *outDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	http.HandleFunc("/", limitOrchestrations(handler))
+	http.HandleFunc("/config", configHandler)
+	http.HandleFunc(replayPath, limitOrchestrations(replayHandler))
+	http.HandleFunc(retryPath, limitOrchestrations(retryHandler))
+	http.HandleFunc(startPath, startHandler)
+	http.HandleFunc(statusPath, statusHandler)
 
 	port := "8080"
 
-	if len(os.Args) > 1 {
-		port = os.Args[1]
+	if flag.NArg() > 0 {
+		port = flag.Arg(0)
 	}
 
 	log.Println("Orchestra listening on port " + port)
 
-	err := http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: ":" + port}
+	if *handlerTimeout > 0 {
+		// leave time to write the partial results or the timeout error.
+		server.WriteTimeout = *handlerTimeout + handlerTimeoutGrace
+	}
+	err := server.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,36 +203,150 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.URL.Path, r.URL.RawQuery)
 
 	params, err := digestRequest(r)
-
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		writeParamsError(w, r, err)
 		return
 	}
 
+	var replayID string
+	if *replayTTL > 0 {
+		replayID = newName()
+		serverReplays.set(replayID, params, *replayTTL)
+		w.Header().Set(replayIDHeader, replayID)
+	}
+
 	orchestra := NewOrchestra(params.conns...)
 	initOrchestra(orchestra, params)
+	forward(orchestra, r, *forwardHeaders)
 
-	orchestra.Process(w)
+	if *replayTTL <= 0 || (params.respType != -1 && params.respType != typeJson) {
+		orchestra.Process(w)
+		return
+	}
+	// keep the output to retry the failed connections with
+	rw := &recordingWriter{ResponseWriter: w}
+	orchestra.Process(rw)
+	serverReplays.setSucceeded(replayID, succeeded(orchestra, rw.body.Bytes()))
+}
+
+// writeParamsError responds with 400 Bad Request and err, the error digesting r.
+// With the all_errors parameter, every invalid value is listed as json.
+func writeParamsError(w http.ResponseWriter, r *http.Request, err error) {
+	if useProblems() {
+		errs, _ := err.(parseErrors)
+		if !boolParam(r, "all_errors") {
+			errs = nil
+		}
+		writeProblem(w, http.StatusBadRequest, err.Error(), errs)
+		return
+	}
+	if errs, ok := err.(parseErrors); ok && boolParam(r, "all_errors") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Errors parseErrors `json:"errors"`
+		}{errs})
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+}
+
+// forward copies the headers of r named in spec to the requests of orchestra. spec
+// is a comma separated list of header names, each optionally followed by @host to
+// only forward it to connections to host.
+func forward(orchestra *Orchestra, r *http.Request, spec string) {
+	for _, s := range strings.Split(spec, ",") {
+		name, host := strings.TrimSpace(s), ""
+		if i := strings.Index(name, "@"); i >= 0 {
+			name, host = name[:i], name[i+1:]
+		}
+		if name != "" {
+			orchestra.SetForwardHeaders(r, host, name)
+		}
+	}
 }
 
 // params is a used for digesting http request from client.
 type params struct {
-	timeout   time.Duration
-	respType  int
-	delimiter string
-	conns     []ConnRequest
+	timeout     time.Duration
+	deadline    time.Time
+	respType    int
+	format      OutputFormat // registered format of respType typeCustom
+	delimiter   string
+	newline     bool
+	inputOrder  bool
+	chaos       int
+	chaosDelay  time.Duration
+	tlsInfo     bool
+	base        string
+	summary     bool
+	noContent   bool
+	collapse    bool
+	invalidUTF8 InvalidUTF8
+	name        string
+	accept      string
+	decodeForm  bool
+	camelCase   bool
+	durationMs  bool
+	errorBody   int
+	proxy       string
+	debug       bool
+	echo        bool
+	finalURL    bool
+	retries     int
+	maxRetry    time.Duration
+	stale       bool
+	headFirst   bool
+	noCache     bool
+	warmup      bool
+	warmupMs    bool
+	headMaxLen  int64
+	headers     []string
+	concurrency int // 0 for no limit, -1 for adaptive
+	ramp        time.Duration
+	rampStart   int
+	deferHosts  bool
+	heartbeat   time.Duration
+	stagger     time.Duration
+	jitter      time.Duration
+	onlyFailed  bool
+	compare     []string
+	aggregate   []string
+	labels      map[string]string
+	fields      []string
+	conns       []ConnRequest
 }
 
 // digestRequest digests the http request into params. it returns error if any
 func digestRequest(r *http.Request) (params, error) {
-	rs := strings.TrimSpace(r.FormValue("requests"))
-	if rs == "" {
-		return params{}, errors.New(badRequestRequiredMsg)
+	var conns []ConnRequest
+	var err error
+	if isJsonRequest(r) {
+		conns, err = parseConnConfigs(io.LimitReader(r.Body, maxConfigSize))
+	} else if u := strings.TrimSpace(r.FormValue("requests_url")); u != "" {
+		conns, err = fetchConnConfigs(u)
+	} else {
+		conns, err = parseRequests(strings.TrimSpace(r.FormValue("requests")))
+	}
+	errs, _ := err.(parseErrors)
+	if err != nil && errs == nil {
+		return params{}, err
+	}
+	errs = append(errs, resolveConns(conns)...)
+	for i, c := range conns {
+		if *maxURLLength > 0 && len(c.url) > *maxURLLength {
+			errs = append(errs, parseError{Index: i, Value: c.url, Error: fmt.Sprintf(badRequestURLLengthMsg, c.id, *maxURLLength)})
+		}
+	}
+	if errs != nil {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+		return params{}, errs
 	}
 
 	rt := strings.ToLower(strings.TrimSpace(r.FormValue("type")))
 	respType := -1
+	var format OutputFormat
 	switch rt {
 	case "json":
 		respType = typeJson
@@ -80,9 +354,23 @@ func digestRequest(r *http.Request) (params, error) {
 	case "delimiter":
 		respType = typeDelimiter
 		break
-	}
-	if rt == "delimiter" {
-		respType = typeDelimiter
+	case "zip":
+		respType = typeZip
+		break
+	case "stream":
+		respType = typeStream
+		break
+	case "split":
+		respType = typeSplit
+		break
+	case "health":
+		respType = typeHealth
+		break
+	default:
+		if f, ok := registeredOutputFormat(rt); ok {
+			respType = typeCustom
+			format = f
+		}
 	}
 
 	var timeout time.Duration
@@ -91,41 +379,874 @@ func digestRequest(r *http.Request) (params, error) {
 		timeout = time.Duration(tms) * time.Millisecond
 	}
 
+	var deadline time.Time
+	if d := strings.TrimSpace(r.FormValue("deadline")); d != "" {
+		var err error
+		if deadline, err = parseDeadline(d); err != nil {
+			return params{}, errors.New("Bad Request: " + err.Error())
+		}
+	}
+
+	base := strings.TrimSpace(r.FormValue("base"))
+	if base != "" {
+		if _, err := parseBaseURL(base); err != nil {
+			return params{}, errors.New("Bad Request: " + err.Error())
+		}
+	}
+
+	var headers []string
+	if h := strings.TrimSpace(r.FormValue("capture_headers")); h != "" {
+		headers = strings.Split(h, ",")
+	} else if boolParam(r, "headers") {
+		headers = []string{"*"}
+	}
+
+	var concurrency int
+	if c := strings.TrimSpace(r.FormValue("concurrency")); c == "auto" {
+		concurrency = -1
+	} else if c != "" {
+		concurrency, _ = strconv.Atoi(c)
+	}
+
+	var ramp time.Duration
+	if rm := strings.TrimSpace(r.FormValue("ramp")); rm != "" {
+		rms, _ := strconv.ParseInt(rm, 10, 64)
+		ramp = time.Duration(rms) * time.Millisecond
+	}
+	rampStart, _ := strconv.Atoi(strings.TrimSpace(r.FormValue("ramp_start")))
+
+	var heartbeat time.Duration
+	if h := strings.TrimSpace(r.FormValue("heartbeat")); h != "" {
+		hms, _ := strconv.ParseInt(h, 10, 64)
+		heartbeat = time.Duration(hms) * time.Millisecond
+	}
+
+	var stagger time.Duration
+	if s := strings.TrimSpace(r.FormValue("stagger")); s != "" {
+		sms, _ := strconv.ParseInt(s, 10, 64)
+		stagger = time.Duration(sms) * time.Millisecond
+	}
+
+	var jitter time.Duration
+	if j := strings.TrimSpace(r.FormValue("jitter")); j != "" {
+		jms, _ := strconv.ParseInt(j, 10, 64)
+		jitter = time.Duration(jms) * time.Millisecond
+	}
+
+	var chaos int
+	var chaosDelay time.Duration
+	if c := strings.TrimSpace(r.FormValue("chaos")); c != "" {
+		if !*chaosEnabled {
+			return params{}, errors.New(badRequestNoChaosMsg)
+		}
+		var err error
+		if chaos, err = strconv.Atoi(c); err != nil || chaos < 0 || chaos > 100 {
+			return params{}, errors.New(badRequestChaosMsg)
+		}
+		if d := strings.TrimSpace(r.FormValue("chaos_delay")); d != "" {
+			dms, _ := strconv.ParseInt(d, 10, 64)
+			chaosDelay = time.Duration(dms) * time.Millisecond
+		}
+	}
+
+	var inputOrder bool
+	switch order := strings.TrimSpace(r.FormValue("stream_order")); order {
+	case "", "completion":
+	case "input":
+		inputOrder = true
+	default:
+		return params{}, errors.New(badRequestOrderMsg)
+	}
+
+	var onlyFailed bool
+	switch only := strings.TrimSpace(r.FormValue("only")); only {
+	case "":
+	case "failed":
+		onlyFailed = true
+	default:
+		return params{}, errors.New(badRequestOnlyMsg)
+	}
+
+	var compare []string
+	if c := strings.TrimSpace(r.FormValue("compare")); c != "" {
+		compare = strings.Split(c, ",")
+		if len(compare) != 2 {
+			return params{}, errors.New(badRequestCompareMsg)
+		}
+		for i := range compare {
+			compare[i] = strings.TrimSpace(compare[i])
+			if !hasConn(conns, compare[i]) {
+				return params{}, errors.New(badRequestCompareMsg)
+			}
+		}
+	}
+
+	headMaxLen, _ := strconv.ParseInt(strings.TrimSpace(r.FormValue("head_max_length")), 10, 64)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = newName()
+	}
+
+	var invalidUTF8 InvalidUTF8
+	switch v := strings.TrimSpace(r.FormValue("invalid_utf8")); v {
+	case "", "replace":
+	case "base64":
+		invalidUTF8 = UTF8Base64
+	case "error":
+		invalidUTF8 = UTF8Error
+	default:
+		return params{}, errors.New(badRequestUTF8Msg)
+	}
+
+	var labels map[string]string
+	if l := strings.TrimSpace(r.FormValue("labels")); l != "" {
+		labels = make(map[string]string)
+		for _, v := range strings.Split(l, ",") {
+			str := strings.SplitN(v, ":", 2)
+			if len(str) < 2 || strings.TrimSpace(str[0]) == "" {
+				return params{}, errors.New(badRequestLabelsMsg)
+			}
+			labels[strings.TrimSpace(str[0])] = strings.TrimSpace(str[1])
+		}
+	}
+
+	var aggregate []string
+	if a := strings.TrimSpace(r.FormValue("aggregate")); a != "" {
+		aggregate = strings.SplitN(a, ":", 2)
+		if len(aggregate) != 2 {
+			return params{}, errors.New(badRequestAggregateMsg)
+		}
+		if _, err := parseAggregate(aggregate[0], aggregate[1]); err != nil {
+			return params{}, errors.New(badRequestAggregateMsg)
+		}
+	}
+
+	var fields []string
+	if f := strings.TrimSpace(r.FormValue("fields")); f != "" {
+		for _, name := range strings.Split(f, ",") {
+			name = strings.TrimSpace(name)
+			if !isOutputField(name) {
+				return params{}, fmt.Errorf(badRequestFieldsMsg, name)
+			}
+			fields = append(fields, name)
+		}
+	}
+
+	var retries int
+	if n := strings.TrimSpace(r.FormValue("retries")); n != "" {
+		retries, _ = strconv.Atoi(n)
+	}
+
+	errorBodySize := defaultErrorBodySize
+	if s := strings.TrimSpace(r.FormValue("error_body_size")); s != "" {
+		errorBodySize, _ = strconv.Atoi(s)
+	}
+
+	var maxRetry time.Duration
+	if s := strings.TrimSpace(r.FormValue("max_retry_duration")); s != "" {
+		ms, _ := strconv.ParseInt(s, 10, 64)
+		maxRetry = time.Duration(ms) * time.Millisecond
+	}
+
+	proxy := strings.TrimSpace(r.FormValue("proxy"))
+	if proxy != "" {
+		if _, err := parseProxy(proxy); err != nil {
+			return params{}, errors.New("Bad Request: " + err.Error())
+		}
+	}
+	err = connParam(r, "proxies", conns, func(c *ConnRequest, v string) error {
+		c.proxy = v
+		_, err := parseProxy(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "webhooks", conns, func(c *ConnRequest, v string) error {
+		c.webhook = v
+		return parseWebhook(v)
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "content_types", conns, func(c *ConnRequest, v string) error {
+		c.contentType = v
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "mirrors", conns, func(c *ConnRequest, v string) error {
+		c.mirror = v
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "weights", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.weight, err = strconv.Atoi(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "ttfb", conns, func(c *ConnRequest, v string) error {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		c.ttfb = time.Duration(ms) * time.Millisecond
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "deadlines", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.deadline, err = parseDeadline(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "body_timeouts", conns, func(c *ConnRequest, v string) error {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		c.bodyTimeout = time.Duration(ms) * time.Millisecond
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "max_body_sizes", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.maxBodySize, err = strconv.ParseInt(v, 10, 64)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "required", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.required, err = strconv.ParseBool(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "delays", conns, func(c *ConnRequest, v string) error {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		c.delay = time.Duration(ms) * time.Millisecond
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "fallbacks", conns, func(c *ConnRequest, v string) error {
+		c.fallbacks = append(c.fallbacks, v)
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "sla", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.sla, err = time.ParseDuration(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "depends_on", conns, func(c *ConnRequest, v string) error {
+		c.dependsOn = v
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "conditions", conns, func(c *ConnRequest, v string) error {
+		c.condition = v
+		return parseCondition(v)
+	})
+	if err != nil {
+		return params{}, err
+	}
+	if m := r.Header.Get(methodOverrideHeader); m != "" {
+		method, err := parseMethod(m)
+		if err != nil {
+			return params{}, errors.New("Bad Request: " + methodOverrideHeader + ": " + err.Error())
+		}
+		for i := range conns {
+			if conns[i].method == "" {
+				conns[i].method = method
+			}
+		}
+	}
+	err = connParam(r, "methods", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.method, err = parseMethod(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "checksums", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.checksum, err = parseChecksum(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "accepts", conns, func(c *ConnRequest, v string) error {
+		c.accept = v
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "decode_forms", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.decodeForm, err = strconv.ParseBool(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "raw_encodings", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.rawEncoding, err = strconv.ParseBool(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "no_caches", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.noCache, err = strconv.ParseBool(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "groups", conns, func(c *ConnRequest, v string) error {
+		c.group = v
+		return nil
+	})
+	if err != nil {
+		return params{}, err
+	}
+	err = connParam(r, "orders", conns, func(c *ConnRequest, v string) error {
+		var err error
+		c.order, err = strconv.Atoi(v)
+		return err
+	})
+	if err != nil {
+		return params{}, err
+	}
+
+	return params{
+		timeout:     timeout,
+		deadline:    deadline,
+		respType:    respType,
+		format:      format,
+		delimiter:   r.FormValue("delimiter"),
+		newline:     boolParam(r, "trailing_newline"),
+		inputOrder:  inputOrder,
+		chaos:       chaos,
+		chaosDelay:  chaosDelay,
+		tlsInfo:     boolParam(r, "tls_info"),
+		base:        base,
+		summary:     boolParam(r, "summary"),
+		noContent:   boolParam(r, "no_content"),
+		collapse:    boolParam(r, "collapse_errors"),
+		invalidUTF8: invalidUTF8,
+		name:        name,
+		accept:      strings.TrimSpace(r.FormValue("accept")),
+		decodeForm:  boolParam(r, "decode_form"),
+		camelCase:   boolParam(r, "camel_case"),
+		durationMs:  boolParam(r, "duration_ms"),
+		errorBody:   errorBodySize,
+		proxy:       proxy,
+		debug:       boolParam(r, "debug"),
+		echo:        boolParam(r, "echo"),
+		finalURL:    boolParam(r, "final_url"),
+		retries:     retries,
+		maxRetry:    maxRetry,
+		stale:       boolParam(r, "stale_if_error"),
+		headFirst:   boolParam(r, "head_first"),
+		noCache:     hasNoCache(r),
+		warmup:      boolParam(r, "warmup"),
+		warmupMs:    boolParam(r, "warmup_timing"),
+		headMaxLen:  headMaxLen,
+		headers:     headers,
+		concurrency: concurrency,
+		ramp:        ramp,
+		rampStart:   rampStart,
+		deferHosts:  boolParam(r, "defer_failing"),
+		heartbeat:   heartbeat,
+		stagger:     stagger,
+		jitter:      jitter,
+		onlyFailed:  onlyFailed,
+		compare:     compare,
+		aggregate:   aggregate,
+		labels:      labels,
+		fields:      fields,
+		conns:       conns,
+	}, nil
+}
+
+// parseRequests parses rs of comma separated 'id:url' entries into connection requests.
+// Invalid entries are reported as parseErrors alongside the valid connection requests.
+func parseRequests(rs string) ([]ConnRequest, error) {
+	if rs == "" {
+		return nil, errors.New(badRequestRequiredMsg)
+	}
 	kv := strings.Split(rs, ",")
 	conns := make([]ConnRequest, len(kv))
 
+	var errs parseErrors
 	for i, v := range kv {
+		v = strings.TrimSpace(v)
+		str := strings.SplitN(v, ":", 2)
+		if len(str) < 2 || strings.HasPrefix(str[1], "//") {
+			if v == "" {
+				errs = append(errs, parseError{Index: i, Value: v, Error: badRequestInvalidMsg})
+				continue
+			}
+			conns[i] = ConnRequest{id: generateId(i), url: v}
+			continue
+		}
+		conns[i] = ConnRequest{id: strings.TrimSpace(str[0]), url: strings.TrimSpace(str[1])}
+	}
+	if errs != nil {
+		return conns, errs
+	}
+	return conns, nil
+}
+
+// parseError is an error parsing the connection request at Index.
+type parseError struct {
+	Index int    `json:"index"`
+	Value string `json:"value"`
+	Error string `json:"error"`
+}
+
+// parseErrors are the errors parsing connection requests.
+type parseErrors []parseError
+
+// Error returns the first error.
+func (p parseErrors) Error() string {
+	return p[0].Error
+}
+
+// generateId generates the id of the connection request at index i without an id.
+func generateId(i int) string {
+	return strconv.Itoa(i)
+}
+
+// isJsonRequest reports if r is a POST request with a Json body.
+func isJsonRequest(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t == "application/json"
+}
+
+// connConfig is the Json representation of a connection request.
+type connConfig struct {
+	Id          string            `json:"id"`
+	URL         string            `json:"url"`
+	Proxy       string            `json:"proxy,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Webhook     string            `json:"webhook,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Mirror      string            `json:"mirror,omitempty"`
+	Weight      int               `json:"weight,omitempty"`
+	TTFB        int64             `json:"ttfb,omitempty"`
+	MaxBodySize int64             `json:"max_body_size,omitempty"`
+	BodyTimeout int64             `json:"body_timeout,omitempty"`
+	Required    bool              `json:"required,omitempty"`
+	Delay       int64             `json:"delay,omitempty"`
+	DependsOn   string            `json:"depends_on,omitempty"`
+	Condition   string            `json:"condition,omitempty"`
+	Group       string            `json:"group,omitempty"`
+	Order       int               `json:"order,omitempty"`
+	Method      string            `json:"method,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+	BodyType    string            `json:"body_type,omitempty"`
+	Accept      string            `json:"accept,omitempty"`
+	DecodeForm  bool              `json:"decode_form,omitempty"`
+	NoCache     bool              `json:"no_cache,omitempty"`
+	Criteria    *criteriaConfig   `json:"criteria,omitempty"`
+	Fallbacks   []string          `json:"fallbacks,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	RawEncoding bool              `json:"raw_encoding,omitempty"`
+	Deadline    string            `json:"deadline,omitempty"`
+}
+
+// criteriaConfig is the Json representation of success criteria.
+type criteriaConfig struct {
+	Status       []int            `json:"status,omitempty"`
+	BodyContains string           `json:"body_contains,omitempty"`
+	MaxLatency   int64            `json:"max_latency,omitempty"`
+	ContentType  string           `json:"content_type,omitempty"`
+	All          []criteriaConfig `json:"all,omitempty"`
+	Any          []criteriaConfig `json:"any,omitempty"`
+}
+
+// criteria returns the success criteria of c.
+func (c *criteriaConfig) criteria() *Criteria {
+	if c == nil {
+		return nil
+	}
+	crit := &Criteria{
+		Status:       c.Status,
+		BodyContains: c.BodyContains,
+		MaxLatency:   time.Duration(c.MaxLatency) * time.Millisecond,
+		ContentType:  c.ContentType,
+	}
+	for i := range c.All {
+		crit.All = append(crit.All, *c.All[i].criteria())
+	}
+	for i := range c.Any {
+		crit.Any = append(crit.Any, *c.Any[i].criteria())
+	}
+	return crit
+}
+
+// parseConnConfigs parses a Json array of connConfig from r into connection requests.
+// Invalid entries are reported as parseErrors alongside the valid connection requests.
+func parseConnConfigs(r io.Reader) ([]ConnRequest, error) {
+	var configs []connConfig
+	if err := json.NewDecoder(r).Decode(&configs); err != nil {
+		return nil, errors.New(badRequestJsonMsg)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New(badRequestJsonMsg)
+	}
+	conns := make([]ConnRequest, len(configs))
+	var errs parseErrors
+	for i, c := range configs {
+		fail := func(msg string) {
+			v, _ := json.Marshal(c)
+			errs = append(errs, parseError{Index: i, Value: string(v), Error: msg})
+		}
+		if strings.TrimSpace(c.URL) == "" {
+			fail(badRequestJsonMsg)
+			continue
+		}
+		if strings.TrimSpace(c.Id) == "" {
+			c.Id = generateId(i)
+		}
+		if c.Proxy != "" {
+			if _, err := parseProxy(c.Proxy); err != nil {
+				fail("Bad Request: " + c.Id + ": " + err.Error())
+				continue
+			}
+		}
+		if c.Webhook != "" {
+			if err := parseWebhook(c.Webhook); err != nil {
+				fail("Bad Request: " + c.Id + ": " + err.Error())
+				continue
+			}
+		}
+		if err := parseCondition(c.Condition); err != nil {
+			fail("Bad Request: " + c.Id + ": " + err.Error())
+			continue
+		}
+		method, err := parseMethod(c.Method)
+		if err != nil {
+			fail("Bad Request: " + c.Id + ": " + err.Error())
+			continue
+		}
+		body, err := parseBody(c.Body)
+		if err != nil {
+			fail("Bad Request: " + c.Id + ": " + err.Error())
+			continue
+		}
+		var deadline time.Time
+		if c.Deadline != "" {
+			if deadline, err = parseDeadline(c.Deadline); err != nil {
+				fail("Bad Request: " + c.Id + ": " + err.Error())
+				continue
+			}
+		}
+		var checksum string
+		if c.Checksum != "" {
+			if checksum, err = parseChecksum(c.Checksum); err != nil {
+				fail("Bad Request: " + c.Id + ": " + err.Error())
+				continue
+			}
+		}
+		conns[i] = ConnRequest{
+			id:          strings.TrimSpace(c.Id),
+			url:         strings.TrimSpace(c.URL),
+			proxy:       c.Proxy,
+			meta:        c.Meta,
+			webhook:     c.Webhook,
+			contentType: c.ContentType,
+			mirror:      c.Mirror,
+			weight:      c.Weight,
+			ttfb:        time.Duration(c.TTFB) * time.Millisecond,
+			maxBodySize: c.MaxBodySize,
+			bodyTimeout: time.Duration(c.BodyTimeout) * time.Millisecond,
+			required:    c.Required,
+			delay:       time.Duration(c.Delay) * time.Millisecond,
+			dependsOn:   c.DependsOn,
+			condition:   c.Condition,
+			group:       c.Group,
+			order:       c.Order,
+			method:      method,
+			body:        body,
+			bodyType:    c.BodyType,
+			accept:      c.Accept,
+			decodeForm:  c.DecodeForm,
+			noCache:     c.NoCache,
+			criteria:    c.Criteria.criteria(),
+			fallbacks:   c.Fallbacks,
+			checksum:    checksum,
+			rawEncoding: c.RawEncoding,
+			deadline:    deadline,
+		}
+	}
+	if errs != nil {
+		return conns, errs
+	}
+	return conns, nil
+}
+
+// hasConn reports if conns has a connection request with id.
+func hasConn(conns []ConnRequest, id string) bool {
+	for _, c := range conns {
+		if c.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// connParam parses the request parameter name of comma separated 'id:value' entries
+// and calls set for the connection request with the id.
+func connParam(r *http.Request, name string, conns []ConnRequest, set func(*ConnRequest, string) error) error {
+	p := strings.TrimSpace(r.FormValue(name))
+	if p == "" {
+		return nil
+	}
+	invalid := fmt.Errorf(badRequestConnMsg, name)
+	for _, v := range strings.Split(p, ",") {
 		str := strings.SplitN(v, ":", 2)
 		if len(str) < 2 {
-			return params{}, errors.New(badRequestInvalidMsg)
+			return invalid
+		}
+		id, value := strings.TrimSpace(str[0]), strings.TrimSpace(str[1])
+		found := false
+		for i := range conns {
+			if conns[i].id != id {
+				continue
+			}
+			found = true
+			if err := set(&conns[i], value); err != nil {
+				return errors.New("Bad Request: " + id + ": " + err.Error())
+			}
+		}
+		if !found {
+			return invalid
 		}
-		conns[i] = ConnRequest{strings.TrimSpace(str[0]), strings.TrimSpace(str[1])}
 	}
+	return nil
+}
 
-	return params{
-		timeout,
-		respType,
-		r.FormValue("delimiter"),
-		conns,
-	}, nil
+// auditBodyFilter returns the filter of responses with audited bodies of spec, failed
+// for failed responses or comma separated ids.
+func auditBodyFilter(spec string) func(*Response) bool {
+	if spec == "failed" {
+		return func(r *Response) bool { return !r.isSuccess() }
+	}
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(spec, ",") {
+		ids[strings.TrimSpace(id)] = true
+	}
+	return func(r *Response) bool { return ids[r.id] }
+}
+
+// parseServices parses spec, comma separated name=url base urls of services, into a
+// StaticResolver.
+func parseServices(spec string) (StaticResolver, error) {
+	s := make(StaticResolver)
+	for _, v := range strings.Split(spec, ",") {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) < 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid service %q, expected name=url", v)
+		}
+		u := strings.TrimSpace(kv[1])
+		if _, err := url.Parse(u); err != nil {
+			return nil, err
+		}
+		s[strings.TrimSpace(kv[0])] = u
+	}
+	return s, nil
+}
+
+// hasNoCache reports if r has a Cache-Control: no-cache header.
+func hasNoCache(r *http.Request) bool {
+	for _, v := range r.Header["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// boolParam returns the boolean value of the request parameter name.
+// Missing or invalid values are treated as false.
+func boolParam(r *http.Request, name string) bool {
+	b, _ := strconv.ParseBool(strings.TrimSpace(r.FormValue(name)))
+	return b
 }
 
-// initOrchestra initializes orchestra with type and timeout settings
+// initOrchestra initializes orchestra with type, timeout and base url settings
 func initOrchestra(orchestra *Orchestra, params params) {
 	if params.timeout > 0 {
 		orchestra.SetTimeout(params.timeout)
 	}
+	orchestra.SetDeadline(params.deadline)
+
+	orchestra.SetMaxURLLength(*maxURLLength)
+	orchestra.SetMaxHeaders(*maxHeaders, *maxHeaderSize)
+	orchestra.SetMaxBodySize(*maxBodySize)
+	orchestra.SetMaxRedirectBodySize(*maxRedirectBody)
+	orchestra.SetTotalTimeout(*handlerTimeout)
+	orchestra.SetBodyDeadline(*bodyDeadline)
+	if *spillSize > 0 {
+		orchestra.SetBodyStore(TempFileStore{Dir: *spillDir}, *spillSize)
+	}
+
+	if params.base != "" {
+		orchestra.SetBaseURL(params.base)
+	}
 
+	orchestra.SetSummary(params.summary)
+	orchestra.SetInvalidUTF8(params.invalidUTF8)
+	orchestra.SetName(params.name)
+	orchestra.SetAccept(params.accept)
+	orchestra.SetDecodeForm(params.decodeForm)
+	orchestra.SetCamelCase(params.camelCase)
+	orchestra.SetDurationMs(params.durationMs)
+	orchestra.SetTLSInfo(params.tlsInfo)
+	orchestra.SetErrorBodySize(params.errorBody)
+	orchestra.SetFields(params.fields...)
+	orchestra.SetDebug(params.debug)
+	orchestra.SetEcho(params.echo)
+	orchestra.SetFinalURL(params.finalURL)
+	orchestra.SetCaptureHeaders(params.headers...)
+
+	orchestra.SetHeartbeat(params.heartbeat)
+	orchestra.SetStagger(params.stagger)
+	orchestra.SetJitter(params.jitter)
+	orchestra.SetOnlyFailed(params.onlyFailed)
+	if params.compare != nil {
+		orchestra.SetCompare(params.compare[0], params.compare[1])
+	}
+	if params.aggregate != nil {
+		// validated when parsed.
+		orchestra.SetAggregate(params.aggregate[0], params.aggregate[1])
+	}
+	orchestra.SetNoContentIfFiltered(params.noContent)
+	orchestra.SetCollapseErrors(params.collapse)
+	for k, v := range params.labels {
+		orchestra.SetOutputLabel(k, v)
+	}
+
+	if params.concurrency < 0 {
+		orchestra.SetAdaptiveConcurrency(adaptiveConcurrencyBase, len(params.conns))
+	} else if params.concurrency > 0 {
+		orchestra.SetConcurrency(params.concurrency)
+		orchestra.SetRamp(params.rampStart, params.ramp)
+	}
+	orchestra.SetDeferFailingHosts(params.deferHosts)
+
+	if params.retries > 0 {
+		orchestra.SetRetries(params.retries)
+		orchestra.SetMaxRetryDuration(params.maxRetry)
+	}
+
+	// Cache-Control: no-cache of the request bypasses the cache.
+	cache := serverCache
+	if params.noCache {
+		cache = nil
+	}
+
+	if params.stale {
+		orchestra.SetCache(cache)
+		orchestra.SetStaleIfError(true)
+	}
+
+	if params.warmup {
+		orchestra.SetWarmup(true)
+		orchestra.SetWarmupTiming(params.warmupMs)
+	}
+
+	if params.headFirst {
+		orchestra.SetCache(cache)
+		orchestra.SetHeadFirst(true)
+		orchestra.SetHeadMaxLength(params.headMaxLen)
+	}
+
+	if params.proxy != "" {
+		orchestra.SetProxy(params.proxy)
+	}
+
+	if serverTokenProvider != nil {
+		orchestra.SetTokenProvider(serverTokenProvider)
+	}
+
+	if serverClientCert != nil {
+		orchestra.SetClientCertificate(*serverClientCert)
+	}
+
+	if serverDNSCache != nil {
+		orchestra.SetDNSCache(serverDNSCache)
+	}
+
+	if serverAudit != nil {
+		orchestra.SetAudit(serverAudit)
+		if *auditBodies != "" {
+			orchestra.SetAuditBodies(auditBodyFilter(*auditBodies), *auditBodySize)
+		}
+	}
+
+	orchestra.SetTrailingNewline(params.newline)
+	orchestra.SetStreamInputOrder(params.inputOrder)
+	if params.chaos > 0 {
+		orchestra.SetChaos(params.chaos, params.chaosDelay)
+	}
+	if params.delimiter != "" {
+		orchestra.SetDelimiterString(params.delimiter)
+	}
 	if params.respType > -1 {
 		switch params.respType {
 		case typeDelimiter:
-			orchestra.UseDelimeter()
-			if params.delimiter != "" {
-				orchestra.SetDelimiter(params.delimiter)
-			}
+			orchestra.UseDelimiter()
+			break
+		case typeZip:
+			orchestra.UseZip()
+			break
+		case typeStream:
+			orchestra.UseStream()
+			break
+		case typeSplit:
+			orchestra.UseSplit()
+			break
+		case typeHealth:
+			orchestra.UseHealth()
+			break
+		case typeCustom:
+			orchestra.UseOutputFormat(params.format)
 			break
 		default:
-			orchestra.UseJson()
+			orchestra.UseJSON()
 		}
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// requestSize counts the bytes of a request as sent: the request line, the header
+// fields written by the transport and the body. Only the first request written is
+// counted, not those of redirects it is followed by.
+type requestSize struct {
+	mu      sync.Mutex
+	n       int64
+	written bool // headers of the first request are written
+}
+
+// trace returns req, its size counted in s as it is written.
+func (s *requestSize) trace(req *http.Request) *http.Request {
+	s.n = int64(len(req.Method) + len(" ") + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n"))
+	if req.ContentLength > 0 {
+		s.n += req.ContentLength
+	}
+	trace := &httptrace.ClientTrace{
+		WroteHeaderField: func(key string, values []string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.written {
+				return
+			}
+			for _, v := range values {
+				s.n += int64(len(key) + len(": ") + len(v) + len("\r\n"))
+			}
+		},
+		WroteHeaders: func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.written {
+				s.n += int64(len("\r\n"))
+				s.written = true
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// bytes returns the bytes counted, 0 if the request was not written.
+func (s *requestSize) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.written {
+		return 0
+	}
+	return s.n
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// UseSplit instructs the Orchestra to output a Json object with the successful and
+// skipped responses in results and the failed ones in errors, each keyed by
+// connection id.
+func (o *Orchestra) UseSplit() {
+	o.responseType = typeSplit
+}
+
+// outputSplit writes resps to w as a Json object of results and errors by id.
+// Responses are marshaled one at a time so only one body is held in memory.
+func outputSplit(o *Orchestra, resps []*Response, w io.Writer) error {
+	var results, errs []*Response
+	for _, r := range resps {
+		if !r.isFailure() {
+			results = append(results, r)
+		} else {
+			errs = append(errs, r)
+		}
+	}
+	if _, err := io.WriteString(w, `{"results":`); err != nil {
+		return err
+	}
+	if err := writeJsonObject(w, results); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"errors":`); err != nil {
+		return err
+	}
+	if err := writeJsonObject(w, errs); err != nil {
+		return err
+	}
+	if o.opts.summary {
+		s := newSummary(resps)
+		s.Filtered = o.fetched() - len(resps)
+		s.Name = o.opts.name
+		s.Status = o.status()
+		s.Ramp = o.rampSchedule()
+		s.Aggregate = o.aggregate(resps)
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, `,"summary":%s`, b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// writeJsonObject writes resps to w as a Json object keyed by the ids of the
+// responses.
+func writeJsonObject(w io.Writer, resps []*Response) error {
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	for i, r := range resps {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		id, err := json.Marshal(r.id)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s:%s", id, b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}")
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// BodyStore stores response bodies outside of memory, e.g. to handle orchestrations
+// aggregating large bodies without holding them in memory.
+type BodyStore interface {
+	// Store copies body into the store and returns a reader of the stored body.
+	// The stored body is removed when the reader is closed.
+	Store(body io.Reader) (io.ReadCloser, error)
+}
+
+// TempFileStore is a BodyStore of temporary files in Dir, or the default directory
+// for temporary files if Dir is empty.
+type TempFileStore struct {
+	Dir string
+}
+
+// Store copies body into a temporary file.
+func (s TempFileStore) Store(body io.Reader) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile(s.Dir, "orchestra-body-")
+	if err != nil {
+		return nil, err
+	}
+	t := &tempFile{f}
+	if _, err := io.Copy(f, body); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// tempFile is a temporary file removed when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	if rerr := os.Remove(t.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// SetBodyStore instructs the Orchestra to store response bodies larger than threshold
+// bytes in s as they are fetched, instead of holding them until the output is written.
+// Smaller bodies are read into memory. Stored bodies are removed after the output is
+// written. Defaults to nil for no store.
+func (o *Orchestra) SetBodyStore(s BodyStore, threshold int64) {
+	o.opts.bodyStore = s
+	o.opts.bodyStoreThreshold = threshold
+}
+
+// store reads the body of r into memory if not larger than the body store threshold,
+// and into the body store otherwise. Errors are reported when the body is read.
+func (c *Conn) store(r *Response) {
+	if c.opts.bodyStore == nil || r.spooled {
+		return
+	}
+	c.spool(r, nil)
+}
+
+// spool reads the body of r, limited to its maximum body size, copying it to w as it
+// is read if w is not nil. The body is read into memory if not larger than the body
+// store threshold and into the body store otherwise. Without a body store, it is read
+// into memory limited as in Json output. The body of r is replaced by the body read,
+// followed by the error reading it, if any, which is returned.
+func (c *Conn) spool(r *Response, w io.Writer) error {
+	if r.Response == nil || r.Body == nil {
+		return nil
+	}
+	r.spooled = true
+	body := r.Body
+	defer body.Close()
+	src, threshold := r.bodyReader(), c.opts.bodyStoreThreshold
+	if c.opts.bodyStore == nil {
+		src, threshold = r.jsonBodyReader(), -1
+	}
+	if w != nil {
+		src = io.TeeReader(src, w)
+	}
+	buf := new(bytes.Buffer)
+	var n int64
+	var err error
+	if threshold < 0 {
+		n, err = io.Copy(buf, src)
+	} else {
+		n, err = io.CopyN(buf, src, threshold+1)
+	}
+	if threshold < 0 || n <= threshold {
+		var rest io.Reader = eofReader{}
+		if err == io.EOF {
+			err = nil
+		} else if err != nil {
+			rest = errReader{err}
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(buf, rest))
+		return err
+	}
+	stored, err := c.opts.bodyStore.Store(io.MultiReader(buf, src))
+	if err != nil {
+		log.Println(err)
+		r.Body = ioutil.NopCloser(errReader{err})
+		return err
+	}
+	r.Body = stored
+	r.stored = stored
+	return nil
+}
+
+// removeStoredBodies removes the bodies of o stored in the body store.
+func (o *Orchestra) removeStoredBodies() {
+	for _, c := range o.conns {
+		if c.Response == nil || c.Response.stored == nil {
+			continue
+		}
+		if err := c.Response.stored.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
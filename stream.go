@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Trailers of stream output with the summary of the orchestration.
+const (
+	trailerCount    = "X-Orchestra-Count"
+	trailerFailed   = "X-Orchestra-Failed"
+	trailerFiltered = "X-Orchestra-Filtered"
+	trailerStatus   = "X-Orchestra-Status"
+	trailerDuration = "X-Orchestra-Duration"
+)
+
+// UseStream instructs the Orchestra to stream newline delimited Json responses as
+// each connection completes. The summary is sent in trailers after the responses.
+func (o *Orchestra) UseStream() {
+	o.responseType = typeStream
+}
+
+// SetStreamInputOrder instructs the Orchestra to stream responses in the order of the
+// connections instead of the order they complete in. Completion order writes each
+// response as soon as it completes, for the lowest latency. Input order holds each
+// response until the responses before it are written, so the position of a response
+// is that of its connection, but a slow connection delays all after it. Defaults to
+// false.
+func (o *Orchestra) SetStreamInputOrder(b bool) {
+	o.opts.inputOrder = b
+}
+
+// processStream fetches the connections of o and writes each response to w as soon
+// as it completes, or in input order if set, followed by the summary trailers. If
+// the total timeout elapses, the responses completed so far are followed by the
+// trailers with a failed status.
+func (o *Orchestra) processStream(w http.ResponseWriter) {
+	start := time.Now()
+	w.Header().Set("Content-type", "application/x-ndjson")
+	w.Header().Set("Trailer", trailerCount+", "+trailerFailed+", "+trailerFiltered+", "+trailerStatus+", "+trailerDuration)
+
+	completed := make(chan *Conn, len(o.conns))
+	done, conns := o.fetch(completed)
+	defer o.cleanup(done)
+	n := len(conns)
+	var resps []*Response
+	write := func(c *Conn) {
+		r := c.Response
+		if o.filtered(r) {
+			r.discard()
+			return
+		}
+		resps = append(resps, r)
+		b, err := r.MarshalJSON()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			log.Println(err)
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	var buf *reorderBuffer
+	if o.opts.inputOrder {
+		buf = newReorderBuffer(conns)
+	}
+	received := 0
+	expired := o.expired()
+	for ; received < n; received++ {
+		var c *Conn
+		select {
+		case c = <-completed:
+		case <-expired:
+		}
+		if c == nil {
+			break
+		}
+		if buf == nil {
+			write(c)
+			continue
+		}
+		for _, c := range buf.add(c) {
+			write(c)
+		}
+	}
+	if buf != nil {
+		// responses held behind those still in flight are written in input order.
+		for _, c := range buf.flush() {
+			write(c)
+		}
+	}
+
+	s := newSummary(resps)
+	w.Header().Set(trailerCount, strconv.Itoa(s.Count))
+	w.Header().Set(trailerFailed, strconv.Itoa(s.Failed))
+	w.Header().Set(trailerFiltered, strconv.Itoa(received-len(resps)))
+	if received < n {
+		// responses still in flight are not accounted for.
+		w.Header().Set(trailerStatus, "failed")
+	} else {
+		w.Header().Set(trailerStatus, o.status())
+	}
+	w.Header().Set(trailerDuration, strconv.FormatInt(int64(time.Since(start)/time.Millisecond), 10)+"ms")
+}
+
+// reorderBuffer holds completed connections until those before them in input order
+// have completed.
+type reorderBuffer struct {
+	conns     []*Conn        // connections in input order
+	next      int            // index in conns of the next connection to release
+	completed map[*Conn]bool // completed connections not yet released
+}
+
+// newReorderBuffer creates a reorderBuffer for conns in input order.
+func newReorderBuffer(conns []*Conn) *reorderBuffer {
+	return &reorderBuffer{conns: conns, completed: make(map[*Conn]bool, len(conns))}
+}
+
+// add adds the completed connection c to b and returns the connections released in
+// input order, none if a connection before c has not completed.
+func (b *reorderBuffer) add(c *Conn) []*Conn {
+	b.completed[c] = true
+	var released []*Conn
+	for ; b.next < len(b.conns) && b.completed[b.conns[b.next]]; b.next++ {
+		delete(b.completed, b.conns[b.next])
+		released = append(released, b.conns[b.next])
+	}
+	return released
+}
+
+// flush returns the completed connections held in b in input order, skipping those
+// not completed, and empties b.
+func (b *reorderBuffer) flush() []*Conn {
+	var released []*Conn
+	for ; b.next < len(b.conns); b.next++ {
+		if b.completed[b.conns[b.next]] {
+			delete(b.completed, b.conns[b.next])
+			released = append(released, b.conns[b.next])
+		}
+	}
+	return released
+}
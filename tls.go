@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SetClientCertificate sets the client certificate presented to servers requesting
+// one, for mutual TLS.
+func (o *Orchestra) SetClientCertificate(cert tls.Certificate) {
+	t := o.transport()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+}
+
+// SetHostClientCertificate sets the client certificate presented to host, overriding
+// the certificate set by SetClientCertificate.
+func (o *Orchestra) SetHostClientCertificate(host string, cert tls.Certificate) {
+	if o.opts.hostCerts == nil {
+		o.opts.hostCerts = make(map[string]tls.Certificate)
+	}
+	o.opts.hostCerts[host] = cert
+}
+
+// hostCertificate returns the client certificate for the host of c, if any.
+func (c *Conn) hostCertificate() (tls.Certificate, bool) {
+	if c.opts.hostCerts == nil {
+		return tls.Certificate{}, false
+	}
+	u, err := url.Parse(c.targetURL())
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+	cert, ok := c.opts.hostCerts[u.Hostname()]
+	return cert, ok
+}
+
+// SetTLSInfo instructs the Orchestra to include the subject, issuer and expiry of the
+// certificate of the server in the output of HTTPS responses, e.g. to monitor the
+// expiry of certificates across endpoints. Defaults to false.
+func (o *Orchestra) SetTLSInfo(b bool) {
+	o.opts.tlsInfo = b
+}
+
+// tlsOutput is the output struct of the certificate of the server of a response.
+type tlsOutput struct {
+	Subject  string `json:"subject"`
+	Issuer   string `json:"issuer"`
+	NotAfter string `json:"not_after"`
+}
+
+// tlsOutput returns the certificate details of the server of r if enabled, nil if r
+// is not an HTTPS response.
+func (r *Response) tlsOutput() *tlsOutput {
+	if r.opts == nil || !r.opts.tlsInfo || r.Response == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	return &tlsOutput{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		NotAfter: cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+}
+
+// SetServerNameClientCertificates sets the client certificates presented to servers
+// requesting one by server name (SNI), e.g. example.com or *.example.com for its
+// subdomains. Unlike SetHostClientCertificate, connections keep sharing the transport
+// and its connections, as the certificate is selected during each TLS handshake,
+// including those of redirects. Servers without a certificate are presented the
+// certificate set by SetClientCertificate, if any. Replacing the TLS config of the
+// transport afterwards removes the selection.
+func (o *Orchestra) SetServerNameClientCertificates(certs map[string]tls.Certificate) {
+	t := o.transport()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	cfg := t.TLSClientConfig
+	o.opts.sniCerts = true
+	cfg.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		name, _ := cri.Context().Value(serverNameKey{}).(string)
+		if cert, ok := matchServerName(certs, name); ok {
+			return &cert, nil
+		}
+		if len(cfg.Certificates) > 0 {
+			return &cfg.Certificates[0], nil
+		}
+		// no certificate is sent.
+		return &tls.Certificate{}, nil
+	}
+}
+
+// matchServerName returns the certificate of certs for the server name, by exact name
+// or else by a wildcard of its parent domain.
+func matchServerName(certs map[string]tls.Certificate, name string) (tls.Certificate, bool) {
+	name = strings.ToLower(name)
+	if cert, ok := certs[name]; ok {
+		return cert, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := certs["*"+name[i:]]; ok {
+			return cert, true
+		}
+	}
+	return tls.Certificate{}, false
+}
+
+// serverNameKey is the context key of the server name of a request.
+type serverNameKey struct{}
+
+// serverNameTransport passes the host of each request, including redirects, to the
+// TLS handshake in the request context.
+type serverNameTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip sends req with the host of its url in its context.
+func (t serverNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), serverNameKey{}, req.URL.Hostname())
+	return t.RoundTripper.RoundTrip(req.WithContext(ctx))
+}
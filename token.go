@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenExpiryMargin is how long before expiry a token is refreshed.
+	tokenExpiryMargin = 10 * time.Second
+	// defaultTokenTTL is the lifetime of tokens without an expiry.
+	defaultTokenTTL = 5 * time.Minute
+	// tokenTimeout is the timeout of token requests.
+	tokenTimeout = 10 * time.Second
+)
+
+// TokenProvider obtains bearer tokens from an OAuth2 token endpoint with the client
+// credentials grant. Tokens are cached until shortly before expiry. It is safe for
+// concurrent use and can be shared across Orchestras.
+type TokenProvider struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	hosts        map[string]bool // hosts tokens are sent to, nil for all
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewTokenProvider creates a new TokenProvider for the token endpoint tokenURL.
+func NewTokenProvider(tokenURL, clientID, clientSecret string) *TokenProvider {
+	return &TokenProvider{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: tokenTimeout},
+	}
+}
+
+// Token returns a valid token, refreshing it if expired. Concurrent callers wait
+// for a single refresh.
+func (p *TokenProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.expires) {
+		return p.token, nil
+	}
+	token, ttl, err := p.fetch()
+	if err != nil {
+		return "", err
+	}
+	p.token = token
+	p.expires = time.Now().Add(ttl - expiryMargin(ttl))
+	return token, nil
+}
+
+// expiryMargin returns how long before expiry a token with ttl is refreshed, at most
+// half of ttl so short lived tokens are not expired when stored.
+func expiryMargin(ttl time.Duration) time.Duration {
+	if tokenExpiryMargin > ttl/2 {
+		return ttl / 2
+	}
+	return tokenExpiryMargin
+}
+
+// SetHosts restricts the tokens of p to requests to hosts, host names or host:port
+// pairs compared case insensitively. Requests to other hosts are sent without a
+// token. With no hosts, tokens are sent to every host.
+func (p *TokenProvider) SetHosts(hosts ...string) {
+	p.hosts = nil
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			if p.hosts == nil {
+				p.hosts = make(map[string]bool)
+			}
+			p.hosts[h] = true
+		}
+	}
+}
+
+// allowed reports if tokens of p are sent to requests to u.
+func (p *TokenProvider) allowed(u *url.URL) bool {
+	if p.hosts == nil {
+		return true
+	}
+	return p.hosts[strings.ToLower(u.Host)] || p.hosts[strings.ToLower(u.Hostname())]
+}
+
+// fetch requests a new token from the token endpoint.
+func (p *TokenProvider) fetch() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint responded with %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", 0, err
+	}
+	if t.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint responded without an access token")
+	}
+	ttl := defaultTokenTTL
+	if t.ExpiresIn > 0 {
+		ttl = time.Duration(t.ExpiresIn) * time.Second
+	}
+	return t.AccessToken, ttl, nil
+}
+
+// SetTokenProvider sets the provider of bearer tokens sent in the Authorization
+// header of each request to the hosts of the provider.
+func (o *Orchestra) SetTokenProvider(p *TokenProvider) {
+	o.opts.tokenProvider = p
+}
+
+// authorize sets the bearer token of the token provider of c, if any, on req if
+// the provider allows the host of req.
+func (c *Conn) authorize(req *http.Request) error {
+	if c.opts.tokenProvider == nil || !c.opts.tokenProvider.allowed(req.URL) {
+		return nil
+	}
+	token, err := c.opts.tokenProvider.Token()
+	if err != nil {
+		return err
+	}
+	// the header is shared by all requests of c.
+	h := req.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	req.Header = h
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
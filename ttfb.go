@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeouts reported in the output.
+const (
+	timeoutTotal    = "total"
+	timeoutTTFB     = "ttfb"
+	timeoutDeadline = "deadline"
+)
+
+// client returns the http.Client to send the request of c with. Connections with a
+// time to first byte timeout are not limited by the total timeout, so bodies can
+// stream for as long as needed, up to the body deadline. Connections with a deadline
+// are limited by the deadline instead.
+func (c *Conn) client() *http.Client {
+	if _, ok := c.connDeadline(); c.ttfb <= 0 && !ok {
+		return c.Client
+	}
+	client := *c.Client
+	client.Timeout = 0
+	return &client
+}
+
+// timeoutOf returns which timeout of c caused err, empty if err is not a timeout.
+func (c *Conn) timeoutOf(err error) string {
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		return ""
+	}
+	if c.deadlineExceeded(err) {
+		return timeoutDeadline
+	}
+	// http.Transport has no distinct error for the response header timeout.
+	if c.ttfb > 0 && strings.Contains(err.Error(), "timeout awaiting response headers") {
+		return timeoutTTFB
+	}
+	return timeoutTotal
+}
+
+// SetBodyDeadline sets the maximum duration of requests whose bodies are not limited
+// by the timeout, those of connections with a time to first byte timeout or without
+// a timeout, from sending the request to the end of the body. This keeps upstreams
+// that never end the body from blocking the orchestration. Bodies read for longer
+// fail with a body read timeout. 0 means no limit. Defaults to 5 minutes.
+func (o *Orchestra) SetBodyDeadline(d time.Duration) {
+	o.opts.bodyDeadline = d
+}
+
+// do sends req with the client of c. The request and its body are limited to the
+// deadline of c, if any, or else to the body deadline if the timeout of c does not
+// limit the body.
+func (c *Conn) do(req *http.Request) (*http.Response, error) {
+	client := c.client()
+	if t, ok := c.connDeadline(); ok {
+		parent := req.Context()
+		ctx, cancel := context.WithDeadline(parent, t)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &deadlineBody{rc: resp.Body, parent: parent, ctx: ctx, cancel: cancel, err: errDeadline(t)}
+		return resp, nil
+	}
+	d := c.opts.bodyDeadline
+	if d <= 0 || client.Timeout > 0 {
+		return client.Do(req)
+	}
+	parent := req.Context()
+	ctx, cancel := context.WithTimeout(parent, d)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &deadlineBody{rc: resp.Body, parent: parent, ctx: ctx, cancel: cancel, err: errBodyTimeout(d)}
+	return resp, nil
+}
+
+// deadlineBody is a body limited to the deadline of ctx, after which reads fail
+// with err. Closing it releases ctx.
+type deadlineBody struct {
+	rc     io.ReadCloser
+	parent context.Context // context ctx derives from, cancelled by the total timeout
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error // errBodyTimeout or errDeadline
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() != nil && b.parent.Err() == nil {
+		return n, b.err
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.cancel()
+	return b.rc.Close()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"unicode/utf8"
+)
+
+// InvalidUTF8 is the handling of response bodies that are not valid UTF-8 in Json output.
+type InvalidUTF8 int
+
+const (
+	// UTF8Replace replaces invalid bytes with the Unicode replacement character.
+	UTF8Replace InvalidUTF8 = iota
+	// UTF8Base64 base64 encodes the body, with body_encoding set to base64.
+	UTF8Base64
+	// UTF8Error reports the response as an error.
+	UTF8Error
+)
+
+// bodyEncodingBase64 is the body encoding of base64 encoded bodies in Json output.
+const bodyEncodingBase64 = "base64"
+
+var errInvalidUTF8 = errors.New("response body is not valid UTF-8")
+
+// SetInvalidUTF8 sets the handling of response bodies that are not valid UTF-8 in
+// Json output. Defaults to UTF8Replace.
+func (o *Orchestra) SetInvalidUTF8(h InvalidUTF8) {
+	o.opts.invalidUTF8 = h
+}
+
+// setBody sets the body of out to body as handled by the options of r. It
+// returns errInvalidUTF8 if body is not valid UTF-8 and invalid bodies are errors.
+func (r *Response) setBody(out *respOutput, body []byte) error {
+	if r.opts == nil || utf8.Valid(body) {
+		out.Body = string(body)
+		return nil
+	}
+	switch r.opts.invalidUTF8 {
+	case UTF8Base64:
+		out.Body = base64.StdEncoding.EncodeToString(body)
+		out.BodyEncoding = bodyEncodingBase64
+	case UTF8Error:
+		return errInvalidUTF8
+	default:
+		// invalid bytes are replaced when marshaled.
+		out.Body = string(body)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SetWarmup instructs the Orchestra to send a HEAD request to each unique host before
+// the measured requests, so connections are established and durations reflect steady
+// state latency. Warmup requests are sent concurrently and their responses discarded.
+// Connections with their own transport, due to a proxy, time to first byte timeout or
+// host client certificate, do not share the warmed up connection. Defaults to false.
+func (o *Orchestra) SetWarmup(b bool) {
+	o.opts.warmup = b
+}
+
+// SetWarmupTiming includes the duration of the warmup request of the host of each
+// response in the output. Requires warmup to be set.
+func (o *Orchestra) SetWarmupTiming(b bool) {
+	o.opts.warmupTiming = b
+}
+
+// warmup sends a HEAD request to the host of each of conns, once per host, and
+// waits for all to complete. The duration of the warmup of a host is stored with
+// each connection to the host.
+func warmup(conns []*Conn) {
+	var hosts []string
+	byHost := make(map[string][]*Conn)
+	for _, c := range conns {
+		u, err := url.Parse(c.targetURL())
+		if err != nil || u.Host == "" {
+			continue
+		}
+		host := u.Scheme + "://" + u.Host
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], c)
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(hosts))
+	for _, host := range hosts {
+		go func(conns []*Conn) {
+			defer wg.Done()
+			r := conns[0].send(http.MethodHead)
+			r.connReq = &conns[0].ConnRequest
+			conns[0].audit(r)
+			r.discard()
+			for _, c := range conns {
+				c.warmup = r.duration
+			}
+		}(byHost[host])
+	}
+	wg.Wait()
+}
+
+// warmupMs returns the milliseconds the warmup request to the host of r took, nil if
+// warmup timing is not set.
+func (r *Response) warmupMs() *int64 {
+	if r.opts == nil || !r.opts.warmup || !r.opts.warmupTiming {
+		return nil
+	}
+	ms := int64(r.warmup / time.Millisecond)
+	return &ms
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookTimeout is the timeout of webhook requests.
+const webhookTimeout = 5 * time.Second
+
+var errInvalidWebhook = errors.New("Invalid webhook. Must be an absolute url e.g. http://url.com/hook")
+
+// webhookClient is the http.Client used for webhook requests.
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// parseWebhook validates the webhook url.
+func parseWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return errInvalidWebhook
+	}
+	return nil
+}
+
+// dispatchWebhook asynchronously posts the result of conn to its webhook if the
+// connection succeeded. The result is the Json output without the body.
+func dispatchWebhook(conn *Conn) {
+	if conn.webhook == "" || conn.Response == nil || !conn.Response.isSuccess() {
+		return
+	}
+	b, err := json.Marshal(conn.Response.output())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go func(webhook string) {
+		resp, err := webhookClient.Post(webhook, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		resp.Body.Close()
+	}(conn.webhook)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// zipManifest is the name of the manifest file in zip output.
+const zipManifest = "manifest.json"
+
+// UseZip instructs the Orchestra to use a zip archive for output. Each response body
+// is a file named by the connection id, and a manifest.json file describes the
+// responses including the file of each. Ids with the same file name get a suffix.
+// Responses whose body fails to read have no file and the error in the manifest.
+func (o *Orchestra) UseZip() {
+	o.responseType = typeZip
+}
+
+// outputZip writes resps to w as a zip archive.
+func outputZip(o *Orchestra, resps []*Response, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	manifest := make([]respOutput, len(resps))
+	names := newFilenames(zipManifest)
+	for i, resp := range resps {
+		manifest[i] = resp.output()
+		if manifest[i].Error != "" {
+			continue
+		}
+		body, n, err := readZipBody(resp)
+		resp.responseBytes += n
+		resp.accountBytes(&manifest[i])
+		if err != nil {
+			manifest[i] = respOutput{Id: resp.id, Meta: resp.meta(), Error: err.Error()}
+			continue
+		}
+		manifest[i].File = names.name(resp.id)
+		f, err := zw.Create(manifest[i].File)
+		if err == nil {
+			_, err = io.Copy(f, body)
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	f, err := zw.Create(zipManifest)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readZipBody reads the body of resp into a temporary file, removed when the returned
+// reader is closed, so entries are only created for bodies read in full. It returns
+// the bytes read and the error reading the body, if any.
+func readZipBody(resp *Response) (io.ReadCloser, int64, error) {
+	f, err := ioutil.TempFile("", "orchestra-zip-")
+	if err != nil {
+		return nil, 0, err
+	}
+	t := &tempFile{f}
+	n, err := io.Copy(f, resp.bodyReader())
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		t.Close()
+		return nil, n, err
+	}
+	return t, n, nil
+}
+
+// sanitizeFilename converts id to a safe file name by replacing characters other
+// than letters, digits, '.', '-' and '_'.
+func sanitizeFilename(id string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, id)
+	if strings.Trim(name, ".") == "" {
+		name = strings.Replace(name, ".", "_", -1)
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// filenames makes unique file names of ids.
+type filenames map[string]bool
+
+// newFilenames creates filenames with reserved names that are never returned.
+func newFilenames(reserved ...string) filenames {
+	f := make(filenames)
+	for _, name := range reserved {
+		f[strings.ToLower(name)] = true
+	}
+	return f
+}
+
+// name returns the sanitized file name of id, suffixed with -2, -3 and so on before
+// the extension if taken. Names are compared ignoring case, for case insensitive file
+// systems.
+func (f filenames) name(id string) string {
+	name := sanitizeFilename(id)
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); strings.Trim(name[:i+1], ".") != "" {
+		base, ext = name[:i], name[i:]
+	}
+	for i := 2; f[strings.ToLower(name)]; i++ {
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+	f[strings.ToLower(name)] = true
+	return name
+}